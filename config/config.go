@@ -8,8 +8,49 @@ type Config struct {
 	Ip               string `default:"10.237.0.1/16"`
 	Mtu              int    `default:"1500"`
 	// Verbose          bool   `default:"0"`
-	ServerMode bool `default:"0"`
-	NoDelay    bool
+	ServerMode     bool `default:"0"`
+	NoDelay        bool
+	Datagram       bool
+	Transport      string
+	WsListen       string
+	WsPath         string
+	WsTLS          bool
+	CertFile       string
+	KeyFile        string
+	CAFile         string
+	Pin            string
+	ServerName     string
+	ClientCAFile   string
+	ACLFile        string
+	RevokedFile    string
+	ClientCertFile string
+	ClientKeyFile  string
+	RekeyMB        int
+	RekeyInterval  int
+	Ciphers        string
+	Insecure       bool
+	PlaintextFrom  string
+	BindAddrs      string
+	Bond           bool
+	ReconnectMax   int
+	QueueSize      int
+	QueueDrop      string
+	BatchSize      int
+	BatchDelay     int
+	Compress       string
+	ALPN           string
+	SNI            string
+	Padding        int
+	CoverRate      int
+	MaxFrame       int
+	Advertise      string
+	Hub            string
+	LeaseFile      string
+	ClientID       string
+	PushRoutes     string
+	PushDNS        string
+	PushSearch     string
+	PushMtu        int
 }
 
 var GLOBAL_CONFIG *Config = nil
@@ -7,10 +7,14 @@ require (
 	github.com/golang/protobuf v1.5.2
 	github.com/gookit/color v1.2.0
 	github.com/gookit/gcli/v2 v2.1.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/lucas-clemente/quic-go v0.29.1
 	github.com/rs/zerolog v1.17.2
 	github.com/songgao/water v0.0.0-20190725173103-fd331bda3f4b
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	golang.org/x/net v0.0.0-20220624214902-1bab6f366d9e
+	golang.org/x/sys v0.0.0-20220927170352-d9d178bc13c6
+	google.golang.org/protobuf v1.26.0
 )
 
 require (
@@ -19,18 +23,14 @@ require (
 	github.com/golang/mock v1.6.0 // indirect
 	github.com/gookit/filter v1.0.10 // indirect
 	github.com/gookit/goutil v0.2.0 // indirect
-	github.com/gorilla/websocket v1.4.2 // indirect
 	github.com/marten-seemann/qtls-go1-18 v0.1.2 // indirect
 	github.com/marten-seemann/qtls-go1-19 v0.1.0 // indirect
 	github.com/nxadm/tail v1.4.8 // indirect
 	github.com/onsi/ginkgo v1.16.4 // indirect
-	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
 	golang.org/x/exp v0.0.0-20220722155223-a9213eeb770e // indirect
 	golang.org/x/mod v0.6.0-dev.0.20220106191415-9b9b3d81d5e3 // indirect
-	golang.org/x/sys v0.0.0-20220927170352-d9d178bc13c6 // indirect
 	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211 // indirect
 	golang.org/x/tools v0.1.10 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
-	google.golang.org/protobuf v1.26.0 // indirect
 	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
 )
@@ -91,6 +91,64 @@ func (i *Iface) AddSysRoute(ip *net.IP) {
 	}
 }
 
+// AddRoute routes prefix through the tun interface
+func (i *Iface) AddRoute(prefix *net.IPNet) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("route", "-n", "add", family(prefix), prefix.String(),
+			"-interface", i.Name())
+	} else {
+		cmd = exec.Command("ip", "route", "replace", prefix.String(), "dev", i.Name())
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("add route %s fail: %s %s", prefix, err, string(output))
+	}
+	return nil
+}
+
+// DelRoute removes the route of prefix added by AddRoute
+func (i *Iface) DelRoute(prefix *net.IPNet) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("route", "-n", "delete", family(prefix), prefix.String(),
+			"-interface", i.Name())
+	} else {
+		cmd = exec.Command("ip", "route", "del", prefix.String(), "dev", i.Name())
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("delete route %s fail: %s %s", prefix, err, string(output))
+	}
+	return nil
+}
+
+// SetMTU changes the mtu of the tun interface
+func (i *Iface) SetMTU(mtu int) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("ifconfig", i.Name(), "mtu", strconv.Itoa(mtu))
+	} else {
+		cmd = exec.Command("ip", "link", "set", "dev", i.Name(), "mtu", strconv.Itoa(mtu))
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("set mtu %d fail: %s %s", mtu, err, string(output))
+	}
+	i.mtu = mtu
+	return nil
+}
+
+func family(prefix *net.IPNet) string {
+	if prefix.IP.To4() == nil {
+		return "-inet6"
+	}
+	return "-net"
+}
+
 func (i *Iface) Name() string {
 	return i.ifce.Name()
 }
@@ -16,4 +16,50 @@ func (p PacketIP) GetSourceIP() net.IP {
 
 func (p PacketIP) GetDestinationIP() net.IP {
 	return net.IP(p[16:20])
-}
\ No newline at end of file
+}
+
+const (
+	protoTCP  = 6
+	protoUDP  = 17
+	protoSCTP = 132
+)
+
+// FlowHash hashes the 5-tuple of the packet, every packet of a flow gets
+// the same value so the flow can stay on one connection. The ports are left
+// out for ip fragments and protocols without them
+func (p PacketIP) FlowHash() uint32 {
+	var addrs []byte
+	var proto byte
+	var ports []byte
+	switch {
+	case len(p) >= 20 && p[0]>>4 == 4:
+		ihl := int(p[0]&0x0f) * 4
+		addrs, proto = p[12:20], p[9]
+		// only the first fragment has the ports, leave them out for all
+		fragment := p[6]&0x3f != 0 || p[7] != 0
+		if !fragment && len(p) >= ihl+4 {
+			ports = p[ihl : ihl+4]
+		}
+	case len(p) >= 40 && p[0]>>4 == 6:
+		// extension headers are not followed, they are rare enough
+		addrs, proto = p[8:40], p[6]
+		if len(p) >= 44 {
+			ports = p[40:44]
+		}
+	default:
+		return 0
+	}
+	if proto != protoTCP && proto != protoUDP && proto != protoSCTP {
+		ports = nil
+	}
+
+	// fnv-1a
+	h := uint32(2166136261)
+	for _, part := range [][]byte{addrs, {proto}, ports} {
+		for _, b := range part {
+			h ^= uint32(b)
+			h *= 16777619
+		}
+	}
+	return h
+}
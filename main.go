@@ -33,6 +33,47 @@ type CmdOpts struct {
 	FileDir          string
 	NoDelay          bool
 	ProxyOnly        bool
+	Datagram         bool
+	Transport        string
+	WsListen         string
+	WsPath           string
+	WsTLS            bool
+	CertFile         string
+	KeyFile          string
+	CAFile           string
+	Pin              string
+	ServerName       string
+	ClientCAFile     string
+	ACLFile          string
+	RevokedFile      string
+	ClientCertFile   string
+	ClientKeyFile    string
+	RekeyMB          int
+	RekeyInterval    int
+	Ciphers          string
+	Insecure         bool
+	PlaintextFrom    string
+	BindAddrs        string
+	Bond             bool
+	ReconnectMax     int
+	QueueSize        int
+	QueueDrop        string
+	BatchSize        int
+	BatchDelay       int
+	Compress         string
+	ALPN             string
+	SNI              string
+	Padding          int
+	CoverRate        int
+	MaxFrame         int
+	Advertise        string
+	Hub              string
+	LeaseFile        string
+	ClientID         string
+	PushRoutes       string
+	PushDNS          string
+	PushSearch       string
+	PushMtu          int
 }
 
 // options for the command
@@ -51,18 +92,59 @@ func Command() *gcli.Command {
 	}
 
 	cmd.StrOpt(&cmdOpts.Key, "key", "", "hello-world", "encrpyt key")
-	cmd.StrOpt(&cmdOpts.RemoteAddrs, "remote_addrs", "", "2.2.2.2:8080", "remote server address, only for client")
+	cmd.StrOpt(&cmdOpts.RemoteAddrs, "remote_addrs", "", "2.2.2.2:8080", "remote server addresses, comma separated, addr;priority=n;weight=n, only for client")
 	cmd.StrOpt(&cmdOpts.Listen, "listen", "", "0.0.0.0:8080", "server listen address, only for server")
-	cmd.StrOpt(&cmdOpts.Ip, "ip", "", "10.237.0.1/16", "vpn vip")
+	cmd.StrOpt(&cmdOpts.Ip, "ip", "", "10.237.0.1/16", "vpn vip, auto to lease one from the server")
 	cmd.StrOpt(&cmdOpts.LogLevel, "log_level", "", "info", "log level")
+	cmd.StrOpt(&cmdOpts.Transport, "transport", "", "auto", "quic, tcp, ws or auto, the client falls back from quic to tcp in auto mode, the server listens on all of them")
+	cmd.StrOpt(&cmdOpts.WsListen, "ws_listen", "", "", "websocket listen address, only for server, e.g. 127.0.0.1:8081 behind a reverse proxy")
+	cmd.StrOpt(&cmdOpts.WsPath, "ws_path", "", "/tunnel", "websocket url path")
+	cmd.StrOpt(&cmdOpts.CertFile, "cert", "", "server.crt", "server certificate, a self-signed one is generated when it doesn't exist, only for server")
+	cmd.StrOpt(&cmdOpts.KeyFile, "cert_key", "", "server.key", "server certificate private key, only for server")
+	cmd.StrOpt(&cmdOpts.CAFile, "ca", "", "", "ca bundle to verify the server certificate, system roots are used by default, only for client")
+	cmd.StrOpt(&cmdOpts.Pin, "pin", "", "", "sha256 fingerprint of the server certificate to pin, only for client")
+	cmd.StrOpt(&cmdOpts.ServerName, "server_name", "", "", "server name to verify the certificate against, default to the host of remote_addrs")
+	cmd.StrOpt(&cmdOpts.ClientCAFile, "client_ca", "", "", "require client certificates signed by this ca, only for server")
+	cmd.StrOpt(&cmdOpts.ACLFile, "acl", "", "", "file of client identities and the tunnel ips they may claim, only for server")
+	cmd.StrOpt(&cmdOpts.RevokedFile, "revoked", "", "", "file of revoked client identities or certificate serials, only for server")
+	cmd.StrOpt(&cmdOpts.ClientCertFile, "client_cert", "", "", "client certificate, only for client")
+	cmd.StrOpt(&cmdOpts.ClientKeyFile, "client_key", "", "", "client certificate private key, only for client")
+	cmd.StrOpt(&cmdOpts.Ciphers, "ciphers", "", "auto", "aes-128-gcm, aes-256-gcm, chacha20-poly1305, xchacha20-poly1305 or auto, comma separated, the client offers them in order of preference, the server only accepts these")
+	cmd.StrOpt(&cmdOpts.PlaintextFrom, "plaintext_from", "", "", "cidrs from which unencrypted sessions are accepted, comma separated, only for server")
+	cmd.StrOpt(&cmdOpts.BindAddrs, "bind_addrs", "", "", "local addresses or interfaces to dial from, comma separated, the connections are spread over them, only for client")
+	cmd.StrOpt(&cmdOpts.QueueDrop, "queue_drop", "", "tail", "tail or head, drop the new packet or the oldest one when the send queue of a connection is full")
+	cmd.StrOpt(&cmdOpts.Compress, "compress", "", "none", "deflate or none, packets are compressed when both sides enable it, the ones which don't shrink are sent as they are")
+	cmd.StrOpt(&cmdOpts.ALPN, "alpn", "", "quic-echo-example", "tls application protocols, comma separated, e.g. h3 to look like http/3, has to match on both sides")
+	cmd.StrOpt(&cmdOpts.SNI, "sni", "", "", "server name sent in the tls client hello, the certificate is still verified against server_name, only for client")
+	cmd.StrOpt(&cmdOpts.Advertise, "advertise", "", "", "subnets behind the client routed through the tunnel, comma separated cidrs, only for client")
+	cmd.StrOpt(&cmdOpts.Hub, "hub", "", "off", "off, allow or deny, packets between clients go through the tun, are relayed by the server itself or are dropped, only for server")
+	cmd.StrOpt(&cmdOpts.LeaseFile, "lease_file", "", "", "lease tunnel ips from the subnet of --ip to the clients with --ip auto and keep the leases in this file, only for server")
+	cmd.StrOpt(&cmdOpts.ClientID, "client_id", "", "", "id the server keeps the leased ip for, default to the hostname, the certificate identity is used instead when there is one, only for client")
+	cmd.StrOpt(&cmdOpts.PushRoutes, "push_routes", "", "", "cidrs the clients route through the tunnel, comma separated, only for server")
+	cmd.StrOpt(&cmdOpts.PushDNS, "push_dns", "", "", "dns servers the clients use while connected, comma separated, only for server")
+	cmd.StrOpt(&cmdOpts.PushSearch, "push_search", "", "", "dns search domains the clients use while connected, comma separated, only for server")
 	cmd.StrOpt(&cmdOpts.FileDir, "file_dir", "", "../static", "http file server directory")
 	cmd.IntOpt(&cmdOpts.TransportThreads, "transport_threads", "", 1, "concurrent threads num only for client")
 	cmd.IntOpt(&cmdOpts.Mtu, "mtu", "", 1500, "MTU size")
 	cmd.IntOpt(&cmdOpts.Socks5Port, "socks5_port", "", 2080, "socks5 server port")
 	cmd.IntOpt(&cmdOpts.FileServerPort, "file_svr_port", "", 6061, "http file server port")
+	cmd.IntOpt(&cmdOpts.RekeyMB, "rekey_mb", "", 1024, "rotate the session key after sending this many MB, 0 to disable")
+	cmd.IntOpt(&cmdOpts.RekeyInterval, "rekey_interval", "", 3600, "rotate the session key after this many seconds, 0 to disable")
+	cmd.IntOpt(&cmdOpts.ReconnectMax, "reconnect_max", "", 30, "longest wait between reconnects in seconds, the wait doubles from 0.5s on every failure, only for client")
+	cmd.IntOpt(&cmdOpts.QueueSize, "queue_size", "", 256, "packets waiting to be sent on each connection, the rest are dropped")
+	cmd.IntOpt(&cmdOpts.BatchSize, "batch_size", "", 16384, "coalesce the queued packets into frames up to this many bytes, 0 to disable")
+	cmd.IntOpt(&cmdOpts.BatchDelay, "batch_delay", "", 0, "microseconds to wait for more packets before sending a batch, 0 only coalesces the packets already queued")
+	cmd.IntOpt(&cmdOpts.MaxFrame, "max_frame", "", 65536, "largest frame accepted from the peer in bytes, told in the handshake, raise it with the mtu or the batch size")
+	cmd.IntOpt(&cmdOpts.PushMtu, "push_mtu", "", 0, "tunnel mtu of the clients, no larger than their --mtu, 0 to keep theirs, only for server")
+	cmd.IntOpt(&cmdOpts.Padding, "padding", "", 0, "pad every frame with up to this many random bytes, at most 1024, 0 to disable")
+	cmd.IntOpt(&cmdOpts.CoverRate, "cover_rate", "", 0, "cover frames sent every second on average at random intervals, 0 to disable")
 	cmd.BoolOpt(&cmdOpts.ServerMode, "server_mode", "", false, "if running in server mode")
 	cmd.BoolOpt(&cmdOpts.NoDelay, "nodelay", "", false, "tcp no delay")
 	cmd.BoolOpt(&cmdOpts.ProxyOnly, "proxyonly", "", false, "only enable proxy")
+	cmd.BoolOpt(&cmdOpts.WsTLS, "ws_tls", "", false, "serve websocket with tls instead of plain http, only for server")
+	cmd.BoolOpt(&cmdOpts.Insecure, "insecure", "", false, "allow unencrypted sessions, needed to run without --key")
+	cmd.BoolOpt(&cmdOpts.Bond, "bond", "", false, "bond the connections into one session, packets are spread by rtt and loss and put back in order on the other side, only for client")
+	cmd.BoolOpt(&cmdOpts.Datagram, "datagram", "", false, "carry tunnel packets in quic datagrams, need to be enabled on both sides, packets larger than 1161 bytes still go over the stream")
 
 	return cmd
 }
@@ -81,6 +163,47 @@ func command(c *gcli.Command, args []string) error {
 		Mtu:              cmdOpts.Mtu,
 		ServerMode:       cmdOpts.ServerMode,
 		NoDelay:          cmdOpts.NoDelay,
+		Datagram:         cmdOpts.Datagram,
+		Transport:        cmdOpts.Transport,
+		WsListen:         cmdOpts.WsListen,
+		WsPath:           cmdOpts.WsPath,
+		WsTLS:            cmdOpts.WsTLS,
+		CertFile:         cmdOpts.CertFile,
+		KeyFile:          cmdOpts.KeyFile,
+		CAFile:           cmdOpts.CAFile,
+		Pin:              cmdOpts.Pin,
+		ServerName:       cmdOpts.ServerName,
+		ClientCAFile:     cmdOpts.ClientCAFile,
+		ACLFile:          cmdOpts.ACLFile,
+		RevokedFile:      cmdOpts.RevokedFile,
+		ClientCertFile:   cmdOpts.ClientCertFile,
+		ClientKeyFile:    cmdOpts.ClientKeyFile,
+		RekeyMB:          cmdOpts.RekeyMB,
+		RekeyInterval:    cmdOpts.RekeyInterval,
+		Ciphers:          cmdOpts.Ciphers,
+		Insecure:         cmdOpts.Insecure,
+		PlaintextFrom:    cmdOpts.PlaintextFrom,
+		BindAddrs:        cmdOpts.BindAddrs,
+		Bond:             cmdOpts.Bond,
+		ReconnectMax:     cmdOpts.ReconnectMax,
+		QueueSize:        cmdOpts.QueueSize,
+		QueueDrop:        cmdOpts.QueueDrop,
+		BatchSize:        cmdOpts.BatchSize,
+		BatchDelay:       cmdOpts.BatchDelay,
+		Compress:         cmdOpts.Compress,
+		ALPN:             cmdOpts.ALPN,
+		SNI:              cmdOpts.SNI,
+		Padding:          cmdOpts.Padding,
+		CoverRate:        cmdOpts.CoverRate,
+		MaxFrame:         cmdOpts.MaxFrame,
+		Advertise:        cmdOpts.Advertise,
+		Hub:              cmdOpts.Hub,
+		LeaseFile:        cmdOpts.LeaseFile,
+		ClientID:         cmdOpts.ClientID,
+		PushRoutes:       cmdOpts.PushRoutes,
+		PushDNS:          cmdOpts.PushDNS,
+		PushSearch:       cmdOpts.PushSearch,
+		PushMtu:          cmdOpts.PushMtu,
 	})
 
 	log.InitLog(cmdOpts.LogLevel)
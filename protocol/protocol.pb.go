@@ -24,6 +24,12 @@ type Envelope struct {
 	// Types that are valid to be assigned to Type:
 	//	*Envelope_Ping
 	//	*Envelope_Packet
+	//	*Envelope_Handshake
+	//	*Envelope_Rekey
+	//	*Envelope_Probe
+	//	*Envelope_Batch
+	//	*Envelope_Lease
+	//	*Envelope_Config
 	Type                 isEnvelope_Type `protobuf_oneof:"type"`
 	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
 	XXX_unrecognized     []byte          `json:"-"`
@@ -36,6 +42,7 @@ func (*Envelope) ProtoMessage()    {}
 func (*Envelope) Descriptor() ([]byte, []int) {
 	return fileDescriptor_2bc2336598a3f7e0, []int{0}
 }
+
 func (m *Envelope) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_Envelope.Unmarshal(m, b)
 }
@@ -66,10 +73,46 @@ type Envelope_Packet struct {
 	Packet *MessagePacket `protobuf:"bytes,2,opt,name=packet,proto3,oneof"`
 }
 
+type Envelope_Handshake struct {
+	Handshake *MessageHandshake `protobuf:"bytes,3,opt,name=handshake,proto3,oneof"`
+}
+
+type Envelope_Rekey struct {
+	Rekey *MessageRekey `protobuf:"bytes,4,opt,name=rekey,proto3,oneof"`
+}
+
+type Envelope_Probe struct {
+	Probe *MessageProbe `protobuf:"bytes,5,opt,name=probe,proto3,oneof"`
+}
+
+type Envelope_Batch struct {
+	Batch *MessageBatch `protobuf:"bytes,6,opt,name=batch,proto3,oneof"`
+}
+
+type Envelope_Lease struct {
+	Lease *MessageLease `protobuf:"bytes,7,opt,name=lease,proto3,oneof"`
+}
+
+type Envelope_Config struct {
+	Config *MessageConfig `protobuf:"bytes,8,opt,name=config,proto3,oneof"`
+}
+
 func (*Envelope_Ping) isEnvelope_Type() {}
 
 func (*Envelope_Packet) isEnvelope_Type() {}
 
+func (*Envelope_Handshake) isEnvelope_Type() {}
+
+func (*Envelope_Rekey) isEnvelope_Type() {}
+
+func (*Envelope_Probe) isEnvelope_Type() {}
+
+func (*Envelope_Batch) isEnvelope_Type() {}
+
+func (*Envelope_Lease) isEnvelope_Type() {}
+
+func (*Envelope_Config) isEnvelope_Type() {}
+
 func (m *Envelope) GetType() isEnvelope_Type {
 	if m != nil {
 		return m.Type
@@ -91,11 +134,59 @@ func (m *Envelope) GetPacket() *MessagePacket {
 	return nil
 }
 
+func (m *Envelope) GetHandshake() *MessageHandshake {
+	if x, ok := m.GetType().(*Envelope_Handshake); ok {
+		return x.Handshake
+	}
+	return nil
+}
+
+func (m *Envelope) GetRekey() *MessageRekey {
+	if x, ok := m.GetType().(*Envelope_Rekey); ok {
+		return x.Rekey
+	}
+	return nil
+}
+
+func (m *Envelope) GetProbe() *MessageProbe {
+	if x, ok := m.GetType().(*Envelope_Probe); ok {
+		return x.Probe
+	}
+	return nil
+}
+
+func (m *Envelope) GetBatch() *MessageBatch {
+	if x, ok := m.GetType().(*Envelope_Batch); ok {
+		return x.Batch
+	}
+	return nil
+}
+
+func (m *Envelope) GetLease() *MessageLease {
+	if x, ok := m.GetType().(*Envelope_Lease); ok {
+		return x.Lease
+	}
+	return nil
+}
+
+func (m *Envelope) GetConfig() *MessageConfig {
+	if x, ok := m.GetType().(*Envelope_Config); ok {
+		return x.Config
+	}
+	return nil
+}
+
 // XXX_OneofFuncs is for the internal use of the proto package.
 func (*Envelope) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error, func(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error), func(msg proto.Message) (n int), []interface{}) {
 	return _Envelope_OneofMarshaler, _Envelope_OneofUnmarshaler, _Envelope_OneofSizer, []interface{}{
 		(*Envelope_Ping)(nil),
 		(*Envelope_Packet)(nil),
+		(*Envelope_Handshake)(nil),
+		(*Envelope_Rekey)(nil),
+		(*Envelope_Probe)(nil),
+		(*Envelope_Batch)(nil),
+		(*Envelope_Lease)(nil),
+		(*Envelope_Config)(nil),
 	}
 }
 
@@ -113,6 +204,36 @@ func _Envelope_OneofMarshaler(msg proto.Message, b *proto.Buffer) error {
 		if err := b.EncodeMessage(x.Packet); err != nil {
 			return err
 		}
+	case *Envelope_Handshake:
+		b.EncodeVarint(3<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Handshake); err != nil {
+			return err
+		}
+	case *Envelope_Rekey:
+		b.EncodeVarint(4<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Rekey); err != nil {
+			return err
+		}
+	case *Envelope_Probe:
+		b.EncodeVarint(5<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Probe); err != nil {
+			return err
+		}
+	case *Envelope_Batch:
+		b.EncodeVarint(6<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Batch); err != nil {
+			return err
+		}
+	case *Envelope_Lease:
+		b.EncodeVarint(7<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Lease); err != nil {
+			return err
+		}
+	case *Envelope_Config:
+		b.EncodeVarint(8<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Config); err != nil {
+			return err
+		}
 	case nil:
 	default:
 		return fmt.Errorf("Envelope.Type has unexpected type %T", x)
@@ -139,6 +260,54 @@ func _Envelope_OneofUnmarshaler(msg proto.Message, tag, wire int, b *proto.Buffe
 		err := b.DecodeMessage(msg)
 		m.Type = &Envelope_Packet{msg}
 		return true, err
+	case 3: // type.handshake
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(MessageHandshake)
+		err := b.DecodeMessage(msg)
+		m.Type = &Envelope_Handshake{msg}
+		return true, err
+	case 4: // type.rekey
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(MessageRekey)
+		err := b.DecodeMessage(msg)
+		m.Type = &Envelope_Rekey{msg}
+		return true, err
+	case 5: // type.probe
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(MessageProbe)
+		err := b.DecodeMessage(msg)
+		m.Type = &Envelope_Probe{msg}
+		return true, err
+	case 6: // type.batch
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(MessageBatch)
+		err := b.DecodeMessage(msg)
+		m.Type = &Envelope_Batch{msg}
+		return true, err
+	case 7: // type.lease
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(MessageLease)
+		err := b.DecodeMessage(msg)
+		m.Type = &Envelope_Lease{msg}
+		return true, err
+	case 8: // type.config
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(MessageConfig)
+		err := b.DecodeMessage(msg)
+		m.Type = &Envelope_Config{msg}
+		return true, err
 	default:
 		return false, nil
 	}
@@ -158,6 +327,36 @@ func _Envelope_OneofSizer(msg proto.Message) (n int) {
 		n += 1 // tag and wire
 		n += proto.SizeVarint(uint64(s))
 		n += s
+	case *Envelope_Handshake:
+		s := proto.Size(x.Handshake)
+		n += 1 // tag and wire
+		n += proto.SizeVarint(uint64(s))
+		n += s
+	case *Envelope_Rekey:
+		s := proto.Size(x.Rekey)
+		n += 1 // tag and wire
+		n += proto.SizeVarint(uint64(s))
+		n += s
+	case *Envelope_Probe:
+		s := proto.Size(x.Probe)
+		n += 1 // tag and wire
+		n += proto.SizeVarint(uint64(s))
+		n += s
+	case *Envelope_Batch:
+		s := proto.Size(x.Batch)
+		n += 1 // tag and wire
+		n += proto.SizeVarint(uint64(s))
+		n += s
+	case *Envelope_Lease:
+		s := proto.Size(x.Lease)
+		n += 1 // tag and wire
+		n += proto.SizeVarint(uint64(s))
+		n += s
+	case *Envelope_Config:
+		s := proto.Size(x.Config)
+		n += 1 // tag and wire
+		n += proto.SizeVarint(uint64(s))
+		n += s
 	case nil:
 	default:
 		panic(fmt.Sprintf("proto: unexpected type %T in oneof", x))
@@ -165,12 +364,17 @@ func _Envelope_OneofSizer(msg proto.Message) (n int) {
 	return n
 }
 
+// Instance is random per client process and shared by all its connections,
+// a tunnel ip can't be taken by another instance while its owner is alive
 type MessagePing struct {
 	Timestamp            int64    `protobuf:"varint,1,opt,name=Timestamp,proto3" json:"Timestamp,omitempty"`
 	LocalAddr            string   `protobuf:"bytes,2,opt,name=LocalAddr,proto3" json:"LocalAddr,omitempty"`
 	LocalPrivateAddr     string   `protobuf:"bytes,3,opt,name=LocalPrivateAddr,proto3" json:"LocalPrivateAddr,omitempty"`
 	IP                   string   `protobuf:"bytes,4,opt,name=IP,proto3" json:"IP,omitempty"`
 	DC                   string   `protobuf:"bytes,5,opt,name=DC,proto3" json:"DC,omitempty"`
+	Prefixes             []string `protobuf:"bytes,6,rep,name=Prefixes,proto3" json:"Prefixes,omitempty"`
+	ClientID             string   `protobuf:"bytes,7,opt,name=ClientID,proto3" json:"ClientID,omitempty"`
+	Instance             []byte   `protobuf:"bytes,8,opt,name=Instance,proto3" json:"Instance,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -182,6 +386,7 @@ func (*MessagePing) ProtoMessage()    {}
 func (*MessagePing) Descriptor() ([]byte, []int) {
 	return fileDescriptor_2bc2336598a3f7e0, []int{1}
 }
+
 func (m *MessagePing) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_MessagePing.Unmarshal(m, b)
 }
@@ -235,8 +440,30 @@ func (m *MessagePing) GetDC() string {
 	return ""
 }
 
+func (m *MessagePing) GetPrefixes() []string {
+	if m != nil {
+		return m.Prefixes
+	}
+	return nil
+}
+
+func (m *MessagePing) GetClientID() string {
+	if m != nil {
+		return m.ClientID
+	}
+	return ""
+}
+
+func (m *MessagePing) GetInstance() []byte {
+	if m != nil {
+		return m.Instance
+	}
+	return nil
+}
+
 type MessagePacket struct {
 	Payload              []byte   `protobuf:"bytes,1,opt,name=payload,proto3" json:"payload,omitempty"`
+	Seq                  uint64   `protobuf:"varint,2,opt,name=Seq,proto3" json:"Seq,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -248,6 +475,7 @@ func (*MessagePacket) ProtoMessage()    {}
 func (*MessagePacket) Descriptor() ([]byte, []int) {
 	return fileDescriptor_2bc2336598a3f7e0, []int{2}
 }
+
 func (m *MessagePacket) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_MessagePacket.Unmarshal(m, b)
 }
@@ -273,30 +501,409 @@ func (m *MessagePacket) GetPayload() []byte {
 	return nil
 }
 
+func (m *MessagePacket) GetSeq() uint64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+type MessageHandshake struct {
+	PublicKey            []byte   `protobuf:"bytes,1,opt,name=PublicKey,proto3" json:"PublicKey,omitempty"`
+	Nonce                []byte   `protobuf:"bytes,2,opt,name=Nonce,proto3" json:"Nonce,omitempty"`
+	MAC                  []byte   `protobuf:"bytes,3,opt,name=MAC,proto3" json:"MAC,omitempty"`
+	Ciphers              []string `protobuf:"bytes,4,rep,name=Ciphers,proto3" json:"Ciphers,omitempty"`
+	Session              []byte   `protobuf:"bytes,5,opt,name=Session,proto3" json:"Session,omitempty"`
+	Compression          []string `protobuf:"bytes,6,rep,name=Compression,proto3" json:"Compression,omitempty"`
+	MaxFrame             uint32   `protobuf:"varint,7,opt,name=MaxFrame,proto3" json:"MaxFrame,omitempty"`
+	Epoch                uint64   `protobuf:"varint,8,opt,name=Epoch,proto3" json:"Epoch,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *MessageHandshake) Reset()         { *m = MessageHandshake{} }
+func (m *MessageHandshake) String() string { return proto.CompactTextString(m) }
+func (*MessageHandshake) ProtoMessage()    {}
+func (*MessageHandshake) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{3}
+}
+
+func (m *MessageHandshake) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MessageHandshake.Unmarshal(m, b)
+}
+func (m *MessageHandshake) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MessageHandshake.Marshal(b, m, deterministic)
+}
+func (m *MessageHandshake) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MessageHandshake.Merge(m, src)
+}
+func (m *MessageHandshake) XXX_Size() int {
+	return xxx_messageInfo_MessageHandshake.Size(m)
+}
+func (m *MessageHandshake) XXX_DiscardUnknown() {
+	xxx_messageInfo_MessageHandshake.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MessageHandshake proto.InternalMessageInfo
+
+func (m *MessageHandshake) GetPublicKey() []byte {
+	if m != nil {
+		return m.PublicKey
+	}
+	return nil
+}
+
+func (m *MessageHandshake) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
+func (m *MessageHandshake) GetMAC() []byte {
+	if m != nil {
+		return m.MAC
+	}
+	return nil
+}
+
+func (m *MessageHandshake) GetCiphers() []string {
+	if m != nil {
+		return m.Ciphers
+	}
+	return nil
+}
+
+func (m *MessageHandshake) GetSession() []byte {
+	if m != nil {
+		return m.Session
+	}
+	return nil
+}
+
+func (m *MessageHandshake) GetCompression() []string {
+	if m != nil {
+		return m.Compression
+	}
+	return nil
+}
+
+func (m *MessageHandshake) GetMaxFrame() uint32 {
+	if m != nil {
+		return m.MaxFrame
+	}
+	return 0
+}
+
+func (m *MessageHandshake) GetEpoch() uint64 {
+	if m != nil {
+		return m.Epoch
+	}
+	return 0
+}
+
+type MessageRekey struct {
+	Phase                uint32   `protobuf:"varint,1,opt,name=Phase,proto3" json:"Phase,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *MessageRekey) Reset()         { *m = MessageRekey{} }
+func (m *MessageRekey) String() string { return proto.CompactTextString(m) }
+func (*MessageRekey) ProtoMessage()    {}
+func (*MessageRekey) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{4}
+}
+
+func (m *MessageRekey) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MessageRekey.Unmarshal(m, b)
+}
+func (m *MessageRekey) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MessageRekey.Marshal(b, m, deterministic)
+}
+func (m *MessageRekey) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MessageRekey.Merge(m, src)
+}
+func (m *MessageRekey) XXX_Size() int {
+	return xxx_messageInfo_MessageRekey.Size(m)
+}
+func (m *MessageRekey) XXX_DiscardUnknown() {
+	xxx_messageInfo_MessageRekey.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MessageRekey proto.InternalMessageInfo
+
+func (m *MessageRekey) GetPhase() uint32 {
+	if m != nil {
+		return m.Phase
+	}
+	return 0
+}
+
+type MessageProbe struct {
+	Timestamp            int64    `protobuf:"varint,1,opt,name=Timestamp,proto3" json:"Timestamp,omitempty"`
+	Reply                bool     `protobuf:"varint,2,opt,name=Reply,proto3" json:"Reply,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *MessageProbe) Reset()         { *m = MessageProbe{} }
+func (m *MessageProbe) String() string { return proto.CompactTextString(m) }
+func (*MessageProbe) ProtoMessage()    {}
+func (*MessageProbe) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{5}
+}
+
+func (m *MessageProbe) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MessageProbe.Unmarshal(m, b)
+}
+func (m *MessageProbe) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MessageProbe.Marshal(b, m, deterministic)
+}
+func (m *MessageProbe) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MessageProbe.Merge(m, src)
+}
+func (m *MessageProbe) XXX_Size() int {
+	return xxx_messageInfo_MessageProbe.Size(m)
+}
+func (m *MessageProbe) XXX_DiscardUnknown() {
+	xxx_messageInfo_MessageProbe.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MessageProbe proto.InternalMessageInfo
+
+func (m *MessageProbe) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *MessageProbe) GetReply() bool {
+	if m != nil {
+		return m.Reply
+	}
+	return false
+}
+
+// several packet envelopes coalesced into one frame by the writer
+type MessageBatch struct {
+	Envelopes            [][]byte `protobuf:"bytes,1,rep,name=Envelopes,proto3" json:"Envelopes,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *MessageBatch) Reset()         { *m = MessageBatch{} }
+func (m *MessageBatch) String() string { return proto.CompactTextString(m) }
+func (*MessageBatch) ProtoMessage()    {}
+func (*MessageBatch) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{6}
+}
+
+func (m *MessageBatch) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MessageBatch.Unmarshal(m, b)
+}
+func (m *MessageBatch) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MessageBatch.Marshal(b, m, deterministic)
+}
+func (m *MessageBatch) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MessageBatch.Merge(m, src)
+}
+func (m *MessageBatch) XXX_Size() int {
+	return xxx_messageInfo_MessageBatch.Size(m)
+}
+func (m *MessageBatch) XXX_DiscardUnknown() {
+	xxx_messageInfo_MessageBatch.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MessageBatch proto.InternalMessageInfo
+
+func (m *MessageBatch) GetEnvelopes() [][]byte {
+	if m != nil {
+		return m.Envelopes
+	}
+	return nil
+}
+
+// the client asks for a tunnel ip with IP empty, the server answers with
+// the leased ip/prefix or an Error
+type MessageLease struct {
+	ClientID             string   `protobuf:"bytes,1,opt,name=ClientID,proto3" json:"ClientID,omitempty"`
+	IP                   string   `protobuf:"bytes,2,opt,name=IP,proto3" json:"IP,omitempty"`
+	Error                string   `protobuf:"bytes,3,opt,name=Error,proto3" json:"Error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *MessageLease) Reset()         { *m = MessageLease{} }
+func (m *MessageLease) String() string { return proto.CompactTextString(m) }
+func (*MessageLease) ProtoMessage()    {}
+func (*MessageLease) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{7}
+}
+
+func (m *MessageLease) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MessageLease.Unmarshal(m, b)
+}
+func (m *MessageLease) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MessageLease.Marshal(b, m, deterministic)
+}
+func (m *MessageLease) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MessageLease.Merge(m, src)
+}
+func (m *MessageLease) XXX_Size() int {
+	return xxx_messageInfo_MessageLease.Size(m)
+}
+func (m *MessageLease) XXX_DiscardUnknown() {
+	xxx_messageInfo_MessageLease.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MessageLease proto.InternalMessageInfo
+
+func (m *MessageLease) GetClientID() string {
+	if m != nil {
+		return m.ClientID
+	}
+	return ""
+}
+
+func (m *MessageLease) GetIP() string {
+	if m != nil {
+		return m.IP
+	}
+	return ""
+}
+
+func (m *MessageLease) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+// network configuration pushed by the server to each connection after its
+// first ping, MTU 0 keeps the one of the client
+type MessageConfig struct {
+	Routes               []string `protobuf:"bytes,1,rep,name=Routes,proto3" json:"Routes,omitempty"`
+	DNS                  []string `protobuf:"bytes,2,rep,name=DNS,proto3" json:"DNS,omitempty"`
+	Search               []string `protobuf:"bytes,3,rep,name=Search,proto3" json:"Search,omitempty"`
+	MTU                  uint32   `protobuf:"varint,4,opt,name=MTU,proto3" json:"MTU,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *MessageConfig) Reset()         { *m = MessageConfig{} }
+func (m *MessageConfig) String() string { return proto.CompactTextString(m) }
+func (*MessageConfig) ProtoMessage()    {}
+func (*MessageConfig) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2bc2336598a3f7e0, []int{8}
+}
+
+func (m *MessageConfig) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MessageConfig.Unmarshal(m, b)
+}
+func (m *MessageConfig) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MessageConfig.Marshal(b, m, deterministic)
+}
+func (m *MessageConfig) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MessageConfig.Merge(m, src)
+}
+func (m *MessageConfig) XXX_Size() int {
+	return xxx_messageInfo_MessageConfig.Size(m)
+}
+func (m *MessageConfig) XXX_DiscardUnknown() {
+	xxx_messageInfo_MessageConfig.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MessageConfig proto.InternalMessageInfo
+
+func (m *MessageConfig) GetRoutes() []string {
+	if m != nil {
+		return m.Routes
+	}
+	return nil
+}
+
+func (m *MessageConfig) GetDNS() []string {
+	if m != nil {
+		return m.DNS
+	}
+	return nil
+}
+
+func (m *MessageConfig) GetSearch() []string {
+	if m != nil {
+		return m.Search
+	}
+	return nil
+}
+
+func (m *MessageConfig) GetMTU() uint32 {
+	if m != nil {
+		return m.MTU
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Envelope)(nil), "Envelope")
 	proto.RegisterType((*MessagePing)(nil), "MessagePing")
 	proto.RegisterType((*MessagePacket)(nil), "MessagePacket")
+	proto.RegisterType((*MessageHandshake)(nil), "MessageHandshake")
+	proto.RegisterType((*MessageRekey)(nil), "MessageRekey")
+	proto.RegisterType((*MessageProbe)(nil), "MessageProbe")
+	proto.RegisterType((*MessageBatch)(nil), "MessageBatch")
+	proto.RegisterType((*MessageLease)(nil), "MessageLease")
+	proto.RegisterType((*MessageConfig)(nil), "MessageConfig")
 }
 
 func init() { proto.RegisterFile("protocol.proto", fileDescriptor_2bc2336598a3f7e0) }
 
 var fileDescriptor_2bc2336598a3f7e0 = []byte{
-	// 242 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2b, 0x28, 0xca, 0x2f,
-	0xc9, 0x4f, 0xce, 0xcf, 0xd1, 0x03, 0x33, 0x94, 0x12, 0xb8, 0x38, 0x5c, 0xf3, 0xca, 0x52, 0x73,
-	0xf2, 0x0b, 0x52, 0x85, 0x94, 0xb8, 0x58, 0x0a, 0x32, 0xf3, 0xd2, 0x25, 0x18, 0x15, 0x18, 0x35,
-	0xb8, 0x8d, 0x78, 0xf4, 0x7c, 0x53, 0x8b, 0x8b, 0x13, 0xd3, 0x53, 0x03, 0x32, 0xf3, 0xd2, 0x3d,
-	0x18, 0x82, 0xc0, 0x72, 0x42, 0x1a, 0x5c, 0x6c, 0x05, 0x89, 0xc9, 0xd9, 0xa9, 0x25, 0x12, 0x4c,
-	0x60, 0x55, 0x7c, 0x70, 0x55, 0x60, 0x51, 0x0f, 0x86, 0x20, 0xa8, 0xbc, 0x13, 0x1b, 0x17, 0x4b,
-	0x49, 0x65, 0x41, 0xaa, 0xd2, 0x54, 0x46, 0x2e, 0x6e, 0x24, 0x93, 0x84, 0x64, 0xb8, 0x38, 0x43,
-	0x32, 0x73, 0x53, 0x8b, 0x4b, 0x12, 0x73, 0x0b, 0xc0, 0x56, 0x31, 0x07, 0x21, 0x04, 0x40, 0xb2,
-	0x3e, 0xf9, 0xc9, 0x89, 0x39, 0x8e, 0x29, 0x29, 0x45, 0x60, 0x2b, 0x38, 0x83, 0x10, 0x02, 0x42,
-	0x5a, 0x5c, 0x02, 0x60, 0x4e, 0x40, 0x51, 0x66, 0x59, 0x62, 0x49, 0x2a, 0x58, 0x11, 0x33, 0x58,
-	0x11, 0x86, 0xb8, 0x10, 0x1f, 0x17, 0x93, 0x67, 0x80, 0x04, 0x0b, 0x58, 0x96, 0xc9, 0x33, 0x00,
-	0xc4, 0x77, 0x71, 0x96, 0x60, 0x85, 0xf0, 0x5d, 0x9c, 0x95, 0x34, 0xb9, 0x78, 0x51, 0x9c, 0x2e,
-	0x24, 0xc1, 0xc5, 0x5e, 0x90, 0x58, 0x99, 0x93, 0x9f, 0x98, 0x02, 0x76, 0x16, 0x4f, 0x10, 0x8c,
-	0xeb, 0x24, 0x1c, 0x25, 0x98, 0x9b, 0x5a, 0x9c, 0x91, 0x94, 0x59, 0x94, 0xa2, 0x0f, 0x0b, 0xbf,
-	0x24, 0x36, 0x30, 0xcb, 0x18, 0x10, 0x00, 0x00, 0xff, 0xff, 0x2f, 0x7d, 0x15, 0x9a, 0x52, 0x01,
-	0x00, 0x00,
+	// 614 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x54, 0x4d, 0x6f, 0xd3, 0x40,
+	0x10, 0x8d, 0xed, 0x24, 0x8d, 0xa7, 0x4e, 0x29, 0xab, 0x0a, 0xad, 0x10, 0x87, 0xc8, 0x02, 0xa9,
+	0x42, 0xa8, 0x08, 0x38, 0x72, 0x6a, 0x9c, 0xa2, 0x44, 0xb4, 0x95, 0xb5, 0x29, 0x17, 0x6e, 0x1b,
+	0x67, 0x1b, 0x5b, 0x75, 0xbc, 0xae, 0xed, 0x56, 0xcd, 0x4f, 0xe5, 0xc6, 0x95, 0x7f, 0x81, 0x66,
+	0x36, 0x76, 0xe2, 0x72, 0xe0, 0x36, 0xef, 0xa3, 0xdb, 0x9d, 0xb7, 0xcf, 0x81, 0xa3, 0xbc, 0xd0,
+	0x95, 0x8e, 0x74, 0x7a, 0x46, 0x83, 0xff, 0xcb, 0x86, 0xc1, 0x45, 0xf6, 0xa8, 0x52, 0x9d, 0x2b,
+	0xe6, 0x43, 0x37, 0x4f, 0xb2, 0x15, 0xb7, 0x46, 0xd6, 0xe9, 0xe1, 0x67, 0xef, 0xec, 0x4a, 0x95,
+	0xa5, 0x5c, 0xa9, 0x30, 0xc9, 0x56, 0xd3, 0x8e, 0x20, 0x8d, 0x9d, 0x42, 0x3f, 0x97, 0xd1, 0x9d,
+	0xaa, 0xb8, 0x4d, 0xae, 0xa3, 0xc6, 0x45, 0xec, 0xb4, 0x23, 0xb6, 0x3a, 0xfb, 0x04, 0x6e, 0x2c,
+	0xb3, 0x65, 0x19, 0xcb, 0x3b, 0xc5, 0x1d, 0x32, 0xbf, 0xac, 0xcd, 0xd3, 0x5a, 0x98, 0x76, 0xc4,
+	0xce, 0xc5, 0xde, 0x41, 0xaf, 0x50, 0x77, 0x6a, 0xc3, 0xbb, 0x64, 0x1f, 0xd6, 0x76, 0x81, 0xe4,
+	0xb4, 0x23, 0x8c, 0x8a, 0xb6, 0xbc, 0xd0, 0x0b, 0xc5, 0x7b, 0x6d, 0x5b, 0x88, 0x24, 0xda, 0x48,
+	0x45, 0xdb, 0x42, 0x56, 0x51, 0xcc, 0xfb, 0x6d, 0xdb, 0x18, 0x49, 0xb4, 0x91, 0x8a, 0xb6, 0x54,
+	0xc9, 0x52, 0xf1, 0x83, 0xb6, 0xed, 0x12, 0x49, 0xb4, 0x91, 0x8a, 0x8b, 0x47, 0x3a, 0xbb, 0x4d,
+	0x56, 0x7c, 0xd0, 0x5e, 0x3c, 0x20, 0x16, 0x17, 0x37, 0xfa, 0xb8, 0x0f, 0xdd, 0x6a, 0x93, 0x2b,
+	0xff, 0x8f, 0x05, 0x87, 0x7b, 0x11, 0xb2, 0x37, 0xe0, 0xde, 0x24, 0x6b, 0x55, 0x56, 0x72, 0x9d,
+	0x53, 0xc6, 0x8e, 0xd8, 0x11, 0xa8, 0x5e, 0xea, 0x48, 0xa6, 0xe7, 0xcb, 0x65, 0x41, 0xd9, 0xba,
+	0x62, 0x47, 0xb0, 0xf7, 0x70, 0x4c, 0x20, 0x2c, 0x92, 0x47, 0x59, 0x29, 0x32, 0x39, 0x64, 0xfa,
+	0x87, 0x67, 0x47, 0x60, 0xcf, 0x42, 0x8a, 0xd0, 0x15, 0xf6, 0x2c, 0x44, 0x3c, 0x09, 0x28, 0x2b,
+	0x57, 0xd8, 0x93, 0x80, 0xbd, 0x86, 0x41, 0x58, 0xa8, 0xdb, 0xe4, 0x49, 0x95, 0xbc, 0x3f, 0x72,
+	0x4e, 0x5d, 0xd1, 0x60, 0xd4, 0x82, 0x34, 0x51, 0x59, 0x35, 0x9b, 0x50, 0x1e, 0xae, 0x68, 0x30,
+	0x6a, 0xb3, 0xac, 0xac, 0x64, 0x16, 0x29, 0xca, 0xc0, 0x13, 0x0d, 0xf6, 0xbf, 0xc2, 0xb0, 0xd5,
+	0x03, 0xc6, 0xe1, 0x20, 0x97, 0x9b, 0x54, 0xcb, 0x25, 0xad, 0xea, 0x89, 0x1a, 0xb2, 0x63, 0x70,
+	0xe6, 0xea, 0x9e, 0x56, 0xec, 0x0a, 0x1c, 0xfd, 0xdf, 0x16, 0x1c, 0x3f, 0x2f, 0x06, 0xe6, 0x11,
+	0x3e, 0x2c, 0xd2, 0x24, 0xfa, 0xae, 0x36, 0xdb, 0x23, 0x76, 0x04, 0x3b, 0x81, 0xde, 0xb5, 0xc6,
+	0x8b, 0xd8, 0xa4, 0x18, 0x80, 0x47, 0x5f, 0x9d, 0x07, 0x14, 0x8c, 0x27, 0x70, 0xc4, 0x6b, 0x04,
+	0x49, 0x1e, 0xab, 0xa2, 0xe4, 0x5d, 0x5a, 0xb5, 0x86, 0xa8, 0xcc, 0x55, 0x59, 0x26, 0x3a, 0xa3,
+	0x68, 0x3c, 0x51, 0x43, 0x36, 0x82, 0xc3, 0x40, 0xaf, 0xf3, 0x62, 0xab, 0x9a, 0x88, 0xf6, 0x29,
+	0x4c, 0xe2, 0x4a, 0x3e, 0x7d, 0x2b, 0xe4, 0xda, 0xb4, 0x66, 0x28, 0x1a, 0x8c, 0x37, 0xbb, 0xc8,
+	0x75, 0x14, 0x53, 0x44, 0x5d, 0x61, 0x80, 0xff, 0x16, 0xbc, 0xfd, 0x2e, 0xa3, 0x2b, 0x8c, 0xb1,
+	0x74, 0x16, 0xfd, 0xb9, 0x01, 0xfe, 0x18, 0xbc, 0xfd, 0x2a, 0xff, 0xa7, 0x31, 0x27, 0xd0, 0x13,
+	0x2a, 0x4f, 0x37, 0x94, 0xc1, 0x40, 0x18, 0xe0, 0x7f, 0x00, 0x6f, 0xbf, 0xe7, 0x78, 0x46, 0xfd,
+	0x81, 0x97, 0xdc, 0x1a, 0x39, 0x98, 0x63, 0x43, 0xf8, 0x21, 0x78, 0xfb, 0x75, 0x6f, 0xbd, 0xbf,
+	0xf5, 0xec, 0xfd, 0x4d, 0xaf, 0xec, 0xa6, 0x57, 0xb8, 0x69, 0x51, 0xe8, 0xba, 0x88, 0x06, 0xf8,
+	0x11, 0x0c, 0x5b, 0x1f, 0x06, 0x7b, 0x05, 0x7d, 0xa1, 0x1f, 0xaa, 0xed, 0x7f, 0x77, 0xc5, 0x16,
+	0xe1, 0x63, 0x4d, 0xae, 0xe7, 0xdc, 0x26, 0x12, 0x47, 0x74, 0xce, 0x95, 0x2c, 0xa2, 0x98, 0x3b,
+	0xc6, 0x69, 0x10, 0x3d, 0xeb, 0xcd, 0x0f, 0x6a, 0xf4, 0x50, 0xe0, 0x38, 0x7e, 0xf1, 0x73, 0x78,
+	0x5f, 0x3d, 0x64, 0x1f, 0xeb, 0x5f, 0xb3, 0x45, 0x9f, 0xa6, 0x2f, 0x7f, 0x07, 0x00, 0x34, 0x1e,
+	0xd5, 0x9d, 0xe0, 0x04, 0x00, 0x00,
 }
@@ -1,10 +1,15 @@
 package qtun
 
 import (
-	"math/rand"
+	"fmt"
+	"net"
+	"os"
 	"os/exec"
+	"os/signal"
 	"runtime"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -19,30 +24,184 @@ import (
 type App struct {
 	config *config.Config
 	client *transport.Client
-	routes map[string]map[string]struct{}
+	routes *routeTable
+	// tunnel ip and key each connection is bound to by its ping
+	owners map[*transport.ServerConn]binding
+	// guards owners and iface, the connections start before the tun
 	mutex  sync.RWMutex
 	server *transport.Server
 	iface  *iface.Iface
 	tm     timer.Timer
+	hub    hubMode
+	leases *leasePool
+	// the ip/prefix leased to the client with --ip auto
+	leased chan string
+	// network config pushed by the server, applied by the client
+	pushed *protocol.MessageConfig
+	netcfg netConfig
 }
 
 func NewApp() *App {
 	return &App{
 		config: config.GetInstance(),
-		routes: make(map[string]map[string]struct{}),
+		routes: newRouteTable(),
+		owners: make(map[*transport.ServerConn]binding),
 		tm:     timer.NewTimer(),
+		leased: make(chan string, 1),
 	}
 }
 
 func (this *App) Run() error {
+	carriers, err := transport.GetCarriers(this.config.Transport)
+	if err != nil {
+		return err
+	}
+	suites, err := transport.GetCipherSuites(this.config.Ciphers)
+	if err != nil {
+		return err
+	}
+	if this.config.Key == "" && !this.config.Insecure {
+		return fmt.Errorf("empty --key disables encryption, set --insecure to run an unencrypted tunnel")
+	}
+	queue, err := transport.NewQueuePolicy(this.config.QueueSize, this.config.QueueDrop)
+	if err != nil {
+		return err
+	}
+	batch, err := transport.NewBatchPolicy(this.config.BatchSize, this.config.BatchDelay)
+	if err != nil {
+		return err
+	}
+	compression, err := transport.ParseCompression(this.config.Compress)
+	if err != nil {
+		return err
+	}
+	obfs, err := transport.NewObfsPolicy(this.config.Padding, this.config.CoverRate)
+	if err != nil {
+		return err
+	}
+	alpn := transport.ParseALPN(this.config.ALPN)
+	prefixes, err := parsePrefixes(this.config.Advertise)
+	if err != nil {
+		return err
+	}
+	if len(prefixes) > 0 && this.config.ServerMode {
+		return fmt.Errorf("only clients advertise subnets, the server routes them")
+	}
+	if this.config.Ip == "auto" && this.config.ServerMode {
+		return fmt.Errorf("the server needs its --ip, the clients lease theirs from its subnet")
+	}
+	err = transport.CheckMaxFrame(this.config.MaxFrame, this.config.Mtu)
+	if err != nil {
+		return err
+	}
+	if this.config.Datagram && this.config.Mtu > transport.DatagramMTU {
+		log.Info().Int("mtu", this.config.Mtu).Int("datagram_mtu", transport.DatagramMTU).
+			Msg("packets larger than datagram_mtu don't fit into a quic datagram and go over the stream, lower --mtu to carry all of them in datagrams")
+	}
+
 	if config.GetInstance().ServerMode {
-		this.server = transport.NewServer(this.config.Listen, this, this.config.Key)
+		this.hub, err = parseHubMode(this.config.Hub)
+		if err != nil {
+			return err
+		}
+		this.pushed, err = newPushConfig(this.config.PushRoutes, this.config.PushDNS,
+			this.config.PushSearch, this.config.PushMtu)
+		if err != nil {
+			return err
+		}
+		if this.config.LeaseFile != "" {
+			this.leases, err = newLeasePool(this.config.Ip, this.config.LeaseFile)
+			if err != nil {
+				return err
+			}
+		}
+		this.server = transport.NewServer(this.config.Listen, this, this.config.Key, carriers)
+		this.server.SetCipherSuites(suites)
+		plaintext, err := transport.NewPlaintextPolicy(this.config.Insecure, this.config.PlaintextFrom)
+		if err != nil {
+			return err
+		}
+		this.server.SetPlaintextPolicy(plaintext)
+		this.server.SetQueuePolicy(queue)
+		this.server.SetBatchPolicy(batch)
+		this.server.SetCompression(compression)
+		this.server.SetObfsPolicy(obfs)
+		this.server.SetMaxFrame(this.config.MaxFrame)
+		err = this.server.LoadCertificate(this.config.CertFile, this.config.KeyFile)
+		if err != nil {
+			return err
+		}
+		this.server.SetALPN(alpn)
+		if this.config.ClientCAFile != "" {
+			err = this.server.EnableClientAuth(this.config.ClientCAFile, this.config.ACLFile, this.config.RevokedFile)
+			if err != nil {
+				return err
+			}
+		} else if this.config.ACLFile != "" || this.config.RevokedFile != "" {
+			return fmt.Errorf("acl and revocation list need client certificates, please set --client_ca")
+		}
 		go this.server.Start()
 		this.CleanRoute()
 	} else {
-		this.client = transport.NewClient(this.config.RemoteAddrs, this.config.Key, this.config.TransportThreads, this)
+		clientTLS, err := transport.NewClientTLS(this.config.CAFile, this.config.Pin, this.config.ServerName)
+		if err != nil {
+			return err
+		}
+		clientTLS.SetALPN(alpn)
+		clientTLS.SetSNI(this.config.SNI)
+		if this.config.ClientCertFile != "" {
+			err = clientTLS.LoadCertificate(this.config.ClientCertFile, this.config.ClientKeyFile)
+			if err != nil {
+				return err
+			}
+		}
+		endpoints, err := transport.ParseEndpoints(this.config.RemoteAddrs)
+		if err != nil {
+			return err
+		}
+		this.client = transport.NewClient(endpoints, this.config.Key, this.config.TransportThreads, this, carriers, clientTLS)
+		this.client.SetCipherSuites(suites)
+		this.client.SetQueuePolicy(queue)
+		this.client.SetBatchPolicy(batch)
+		this.client.SetCompression(compression)
+		this.client.SetObfsPolicy(obfs)
+		this.client.SetMaxFrame(this.config.MaxFrame)
+		if this.config.Ip == "auto" {
+			clientID := this.config.ClientID
+			if clientID == "" {
+				clientID, err = os.Hostname()
+				if err != nil {
+					return err
+				}
+			}
+			this.client.EnableLease(clientID)
+		}
+		if len(prefixes) > 0 {
+			advertise := []string{}
+			for _, prefix := range prefixes {
+				advertise = append(advertise, prefix.String())
+			}
+			this.client.SetPrefixes(advertise)
+		}
+		if this.config.BindAddrs != "" {
+			this.client.SetBinds(strings.Split(this.config.BindAddrs, ","))
+		}
+		if this.config.Bond {
+			err = this.client.EnableBond()
+			if err != nil {
+				return err
+			}
+		}
+		if runtime.GOOS == "linux" {
+			err = restoreResolvConf()
+			if err != nil {
+				log.Error().Err(err).Msg("restore resolv.conf fail")
+			}
+		}
 		this.client.Start()
 		this.SetProxy()
+		this.revertOnExit()
+		defer this.netcfg.revert()
 	}
 
 	return this.StartFetchTunInterface()
@@ -51,28 +210,78 @@ func (this *App) Run() error {
 func (this *App) CleanRoute() {
 	this.tm.RegisterTask(func() {
 		log.Info().Msg("start to clean route")
-		for dst, conns := range this.routes {
-			for c := range conns {
-				conn := this.server.GetConnsByAddr(c)
-				if conn == nil || conn.IsClosed() {
-					log.Info().Str("conn", c).
-						Str("dst", dst).
-						Msg("remove dead conns from route")
-					delete(this.routes[dst], c)
-					this.server.DeleteDeadConn(c)
-				}
+		for _, c := range this.routes.allConns() {
+			conn := this.server.GetConnsByAddr(c)
+			if conn == nil || conn.IsClosed() {
+				log.Info().Str("conn", c).Msg("remove dead conns from route")
+				this.removeConn(c)
 			}
 		}
+
+		if this.leases != nil {
+			this.leases.flush()
+		}
+
+		this.mutex.Lock()
+		for conn := range this.owners {
+			if conn.IsClosed() {
+				delete(this.owners, conn)
+			}
+		}
+		this.mutex.Unlock()
 	}, time.Minute)
 	this.tm.Start()
 }
 
+// removeConn forgets a dead connection, and the system routes of the subnets
+// nobody serves any more
+func (this *App) removeConn(c string) {
+	for _, r := range this.routes.removeConn(c) {
+		if tun := this.tun(); r.advertised && tun != nil {
+			err := tun.DelRoute(r.prefix)
+			if err != nil {
+				log.Error().Err(err).Msg("delete system route fail")
+			}
+		}
+	}
+	this.server.DeleteDeadConn(c)
+}
+
+// removeDeadConns removes the dead connections routed to dst, and tells
+// if there were any
+func (this *App) removeDeadConns(dst net.IP) bool {
+	removed := false
+	for _, c := range this.routes.lookup(dst) {
+		conn := this.server.GetConnsByAddr(c)
+		if conn == nil || conn.IsClosed() {
+			this.removeConn(c)
+			removed = true
+		}
+	}
+	return removed
+}
+
 func (this *App) StartFetchTunInterface() error {
-	this.iface = iface.New("", this.config.Ip, this.config.Mtu)
-	err := this.iface.Start()
+	ip := this.config.Ip
+	if ip == "auto" && !this.config.ServerMode {
+		log.Info().Msg("waiting for the server to lease the tunnel ip")
+		ip = <-this.leased
+	}
+	tun := iface.New("", ip, this.config.Mtu)
+	err := tun.Start()
 	if err != nil {
 		return err
 	}
+	this.mutex.Lock()
+	this.iface = tun
+	this.mutex.Unlock()
+	if this.config.Ip == "auto" && !this.config.ServerMode {
+		// the pings go out from now on, the server routes to us
+		this.client.SetIP(ip)
+	}
+	if !this.config.ServerMode {
+		this.netcfg.setIface(tun, this.config.Mtu)
+	}
 
 	for i := 0; i < 10; i++ {
 		go this.FetchAndProcessTunPkt(i)
@@ -81,82 +290,204 @@ func (this *App) StartFetchTunInterface() error {
 	return this.FetchAndProcessTunPkt(255)
 }
 
+// tun returns the tun interface, nil until it's up
+func (this *App) tun() *iface.Iface {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.iface
+}
+
+// writeTun writes a packet received from the tunnel to the tun interface,
+// it's dropped while the interface isn't up yet
+func (this *App) writeTun(pkt iface.PacketIP) {
+	tun := this.tun()
+	if tun == nil {
+		log.Debug().IPAddr("dst", pkt.GetDestinationIP()).Msg("tun interface is not up yet, drop")
+		return
+	}
+	tun.Write(pkt)
+}
+
+// FetchAndProcessTunPkt reads every packet into a pooled buffer of its own,
+// which is handed down to the connection and sent from where it was read
 func (this *App) FetchAndProcessTunPkt(workerNum int) error {
 	mtu := config.GetInstance().Mtu
-	pkt := iface.NewPacketIP(mtu)
 	for {
-		n, err := this.iface.Read(pkt)
+		pkt := transport.NewPacket(mtu)
+		n, err := this.iface.Read(pkt.IP())
 		if err != nil {
+			pkt.Free()
 			log.Error().Err(err).Msg("FetchAndProcessTunPkt read ip pkt error")
 			return err
 		}
-		src := pkt.GetSourceIP().String()
-		dst := pkt.GetDestinationIP().String()
+		pkt = pkt.Truncate(n)
+		ip := pkt.IP()
 
-		log.Debug().Int("workder", workerNum).Str("src", src).Str("dst", dst).
+		log.Debug().Int("workder", workerNum).IPAddr("src", ip.GetSourceIP()).
+			IPAddr("dst", ip.GetDestinationIP()).
 			Int("len", n).Msg("FetchAndProcessTunPkt::got tun packet")
 
 		if config.GetInstance().ServerMode {
-			for {
-				this.mutex.Lock()
-				conns, ok := this.routes[dst]
-				if !ok {
-					log.Info().Int("workder", workerNum).Str("src", src).
-						Str("dst", dst).
-						Msg("FetchAndProcessTunPkt::no route, packet dropped")
-					this.mutex.Unlock()
-					break
-				}
-
-				if conns == nil {
-					log.Info().Int("workder", workerNum).Str("src", src).
-						Str("dst", dst).
-						Msg("FetchAndProcessTunPkt::has route but no connection, packet dropped")
-					this.mutex.Unlock()
-					break
-				}
-
-				keys := []string{}
-				for k := range conns {
-					keys = append(keys, k)
-				}
-				this.mutex.Unlock()
-				if len(keys) == 0 {
-					log.Info().Int("workder", workerNum).Str("src", src).
-						Str("dst", dst).
-						Msg("FetchAndProcessTunPkt::no conns, packet dropped")
-					break
-				}
-
-				idx := rand.Intn(len(keys))
-
-				conn := this.server.GetConnsByAddr(keys[idx])
-				if conn == nil || conn.IsClosed() {
-					log.Info().Int("workder", workerNum).Str("src", src).
-						Str("dst", dst).
-						Msg("FetchAndProcessTunPkt::no connection, packet dropped")
-					this.mutex.Lock()
-					delete(this.routes[dst], keys[idx])
-					this.mutex.Unlock()
-					// this.routes[dst] = conns
-					this.server.DeleteDeadConn(keys[idx])
-				} else {
-					log.Debug().Int("workder", workerNum).Str("src", src).Str("dst", dst).
-						Int("len", n).Msg("FetchAndProcessTunPkt::send packet")
-					conn.SendPacket(pkt)
-					log.Debug().Int("workder", workerNum).Str("src", src).Str("dst", dst).
-						Int("len", n).Msg("FetchAndProcessTunPkt::send packet done")
-					break
-				}
+			if !this.sendToClient(pkt) {
+				log.Info().Int("workder", workerNum).IPAddr("src", ip.GetSourceIP()).
+					IPAddr("dst", ip.GetDestinationIP()).
+					Msg("FetchAndProcessTunPkt::no route, packet dropped")
+				pkt.Free()
 			}
 		} else {
 			//client send packet
-			this.client.SendPacket(pkt)
+			this.client.SendTunPacket(pkt)
+		}
+	}
+}
+
+// sendToClient sends pkt to the client owning its destination, and tells if
+// there is one, pkt is taken over unless there isn't
+func (this *App) sendToClient(pkt transport.Packet) bool {
+	ip := pkt.IP()
+	flow := ip.FlowHash()
+	for {
+		keys := this.routes.lookup(ip.GetDestinationIP())
+		if len(keys) == 0 {
+			return false
 		}
+
+		// pin the flow to one of the connections of the client
+		idx := transport.PickFlow(flow, keys)
+
+		conn := this.server.GetConnsByAddr(keys[idx])
+		if conn == nil || conn.IsClosed() {
+			log.Info().IPAddr("dst", ip.GetDestinationIP()).Str("conn", keys[idx]).
+				Msg("dead connection removed from route")
+			this.removeConn(keys[idx])
+			continue
+		}
+
+		log.Debug().IPAddr("dst", ip.GetDestinationIP()).Int("len", len(ip)).
+			Msg("sendToClient::send packet")
+		conn.SendTunPacket(pkt)
+		return true
+	}
+}
+
+// binding is the tunnel ip a connection claims, and the key it's registered
+// under, its LocalAddr, which has to be on that ip
+type binding struct {
+	owner string
+	key   string
+}
+
+// bind binds conn to the tunnel ip it claims and the key it announces, false
+// when the key isn't on the ip or conn has claimed other ones before, so a
+// connection registers one key only
+func (this *App) bind(conn *transport.ServerConn, owner, key string) bool {
+	if ip := localAddrIP(key); ip == nil || ip.String() != owner {
+		return false
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if bound, ok := this.owners[conn]; ok {
+		return bound.owner == owner && bound.key == key
 	}
+	this.owners[conn] = binding{owner: owner, key: key}
+	return true
+}
+
+func (this *App) ownerOf(conn *transport.ServerConn) string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.owners[conn].owner
+}
+
+// localAddrIP returns the tunnel ip of the LocalAddr of a ping, which is
+// ip/prefix:port
+func localAddrIP(localAddr string) net.IP {
+	i := strings.LastIndex(localAddr, ":")
+	if i < 0 {
+		return nil
+	}
+	host := localAddr[:i]
+	if j := strings.Index(host, "/"); j >= 0 {
+		host = host[:j]
+	}
+	return net.ParseIP(host)
+}
+
+// allowSource tells if pkt may come from conn, its source has to be routed
+// to the client conn is bound to, which drops the packets of a connection
+// which hasn't pinged yet as well
+func (this *App) allowSource(pkt iface.PacketIP, conn *transport.ServerConn) bool {
+	bound := this.ownerOf(conn)
+	owner, ok := this.routes.ownerOf(pkt.GetSourceIP())
+	if bound == "" || !ok || owner != bound {
+		log.Debug().Str("identity", conn.Identity()).Str("bound", bound).
+			IPAddr("src", pkt.GetSourceIP()).IPAddr("dst", pkt.GetDestinationIP()).
+			Msg("spoofed source address, packet dropped")
+		return false
+	}
+	return true
+}
+
+// lease answers the lease request of a client
+func (this *App) lease(req *protocol.MessageLease, conn *transport.ServerConn) {
+	reply := &protocol.MessageLease{ClientID: req.GetClientID()}
+	key := leaseKey(conn.Identity(), req.GetClientID())
+	if this.leases == nil {
+		reply.Error = "no address pool on the server, start the client with its --ip"
+	} else if key == "" {
+		reply.Error = "no client id"
+	} else {
+		allowed, ok := this.server.Prefixes(conn)
+		if !ok {
+			allowed = []*net.IPNet{this.leases.subnet}
+		}
+		ip, err := this.leases.acquire(key, allowed)
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		reply.IP = ip
+	}
+	if reply.Error != "" {
+		log.Warn().Str("identity", conn.Identity()).Str("client_id", req.GetClientID()).
+			Str("err", reply.Error).Msg("lease refused")
+	}
+
+	data, err := proto.Marshal(&protocol.Envelope{
+		Type: &protocol.Envelope_Lease{Lease: reply},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("lease::proto marshal err")
+		return
+	}
+	conn.Write(data)
+}
+
+// pushConfig sends the network config to a new connection
+func (this *App) pushConfig(conn *transport.ServerConn) {
+	data, err := proto.Marshal(&protocol.Envelope{
+		Type: &protocol.Envelope_Config{Config: this.pushed},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("pushConfig::proto marshal err")
+		return
+	}
+	conn.Write(data)
 }
 
 func (this *App) ServerOnData(buf []byte, conn *transport.ServerConn) {
+	if pkt, ok := transport.ParsePacket(buf); ok {
+		log.Debug().Int("pkt_len", len(pkt)).IPAddr("src", pkt.GetSourceIP()).
+			IPAddr("dst", pkt.GetDestinationIP()).
+			Msg("received packet")
+
+		if !this.allowSource(pkt, conn) {
+			return
+		}
+		this.forward(pkt, conn)
+		return
+	}
+
 	ep := protocol.Envelope{}
 	err := proto.Unmarshal(buf, &ep)
 	if err != nil {
@@ -167,24 +498,89 @@ func (this *App) ServerOnData(buf []byte, conn *transport.ServerConn) {
 	switch ep.Type.(type) {
 	case *protocol.Envelope_Ping:
 		ping := ep.GetPing()
-		//根据Client发来的Ping包信息来添加路由
-		this.mutex.Lock()
-
-		if _, ok := this.routes[ping.GetIP()]; ok {
-			this.routes[ping.GetIP()][ping.GetLocalAddr()] = struct{}{}
-		} else {
-			this.routes[ping.GetIP()] = map[string]struct{}{
-				ping.GetLocalAddr(): struct{}{},
-			}
+		if !this.server.AllowIP(conn, ping.GetIP()) {
+			log.Warn().Str("identity", conn.Identity()).Str("ip", ping.GetIP()).
+				Msg("client is not allowed to claim the ip, connection closed")
+			conn.Close()
+			return
 		}
 
+		//根据Client发来的Ping包信息来添加路由
 		log.Debug().Str("local", ping.GetLocalAddr()).Str("ip", ping.GetIP()).
-			Msg("Proto Ping")
+			Strs("prefixes", ping.GetPrefixes()).Msg("Proto Ping")
 
-		log.Info().Interface("route", this.routes).Msg("Route Table")
+		ip := net.ParseIP(ping.GetIP())
+		if ip == nil {
+			log.Warn().Str("identity", conn.Identity()).Str("ip", ping.GetIP()).
+				Msg("invalid ip in ping, ignored")
+			return
+		}
+		owner := ip.String()
+		holder := routeHolder(conn.Identity(), ping.GetInstance())
+		first := this.ownerOf(conn) == ""
+		if this.leases != nil {
+			err := this.leases.claim(leaseKey(conn.Identity(), ping.GetClientID()), ip)
+			if err != nil {
+				log.Warn().Err(err).Str("identity", conn.Identity()).Str("client_id", ping.GetClientID()).
+					Msg("client claims the ip leased to another one, connection closed")
+				conn.Close()
+				return
+			}
+		}
+		if !this.bind(conn, owner, ping.GetLocalAddr()) {
+			log.Warn().Str("identity", conn.Identity()).Str("ip", owner).
+				Str("local", ping.GetLocalAddr()).Str("bound", this.ownerOf(conn)).
+				Msg("connection claims another ip or key, connection closed")
+			conn.Close()
+			return
+		}
+		if !this.server.SetConns(ping.GetLocalAddr(), conn) {
+			log.Warn().Str("identity", conn.Identity()).Str("local", ping.GetLocalAddr()).
+				Msg("key belongs to another live connection, connection closed")
+			conn.Close()
+			return
+		}
+		_, err := this.routes.add(hostPrefix(ip), owner, holder, ping.GetLocalAddr(), false)
+		if err != nil && this.removeDeadConns(ip) {
+			// the owner is gone, its routes haven't been cleaned yet
+			_, err = this.routes.add(hostPrefix(ip), owner, holder, ping.GetLocalAddr(), false)
+		}
+		if err != nil {
+			log.Warn().Str("identity", conn.Identity()).Str("ip", owner).
+				Msg("ip is owned by another client, connection closed")
+			conn.Close()
+			return
+		}
+		if first && this.pushed != nil {
+			this.pushConfig(conn)
+		}
 
-		this.server.SetConns(ping.GetLocalAddr(), conn)
-		this.mutex.Unlock()
+		for _, cidr := range ping.GetPrefixes() {
+			_, prefix, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.Warn().Str("identity", conn.Identity()).Str("prefix", cidr).
+					Msg("invalid prefix in ping, ignored")
+				continue
+			}
+			if !this.server.AllowPrefix(conn, prefix) {
+				log.Warn().Str("identity", conn.Identity()).Str("prefix", cidr).
+					Msg("client is not allowed to advertise the prefix, ignored")
+				continue
+			}
+			added, err := this.routes.add(prefix, owner, holder, ping.GetLocalAddr(), true)
+			if err != nil {
+				// the conflict is logged by the route table
+				continue
+			}
+			if tun := this.tun(); added && tun != nil {
+				err = tun.AddRoute(prefix)
+				if err != nil {
+					log.Error().Err(err).Msg("add system route fail")
+				}
+			}
+		}
+	case *protocol.Envelope_Lease:
+		this.lease(ep.GetLease(), conn)
 	case *protocol.Envelope_Packet:
 		pkt := iface.PacketIP(ep.GetPacket().GetPayload())
 
@@ -192,11 +588,23 @@ func (this *App) ServerOnData(buf []byte, conn *transport.ServerConn) {
 			IPAddr("dst", pkt.GetDestinationIP()).
 			Msg("received protobuf packet")
 
-		this.iface.Write(pkt)
+		if !this.allowSource(pkt, conn) {
+			return
+		}
+		this.forward(pkt, conn)
 	}
 }
 
 func (this *App) ClientOnData(buf []byte) {
+	if pkt, ok := transport.ParsePacket(buf); ok {
+		log.Debug().Int("pkt_len", len(pkt)).IPAddr("src", pkt.GetSourceIP()).
+			IPAddr("dst", pkt.GetDestinationIP()).
+			Msg("received packet")
+
+		this.writeTun(pkt)
+		return
+	}
+
 	ep := protocol.Envelope{}
 	err := proto.Unmarshal(buf, &ep)
 	if err != nil {
@@ -226,6 +634,19 @@ func (this *App) ClientOnData(buf []byte) {
 
 		// this.server.SetConns(ping.GetLocalAddr(), conn)
 		// this.mutex.Unlock()
+	case *protocol.Envelope_Lease:
+		lease := ep.GetLease()
+		if lease.GetError() != "" {
+			log.Error().Str("err", lease.GetError()).Msg("server refused to lease an ip")
+			return
+		}
+		log.Info().Str("ip", lease.GetIP()).Msg("tunnel ip leased")
+		select {
+		case this.leased <- lease.GetIP():
+		default:
+		}
+	case *protocol.Envelope_Config:
+		this.netcfg.push(ep.GetConfig())
 	case *protocol.Envelope_Packet:
 		pkt := iface.PacketIP(ep.GetPacket().GetPayload())
 
@@ -233,10 +654,23 @@ func (this *App) ClientOnData(buf []byte) {
 			IPAddr("dst", pkt.GetDestinationIP()).
 			Msg("received protobuf packet")
 
-		this.iface.Write(pkt)
+		this.writeTun(pkt)
 	}
 }
 
+// revertOnExit reverts the network config pushed by the server when the
+// client is stopped
+func (this *App) revertOnExit() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		log.Info().Str("signal", sig.String()).Msg("client stop")
+		this.netcfg.revert()
+		os.Exit(0)
+	}()
+}
+
 func (this *App) SetProxy() {
 	var cmd *exec.Cmd
 
@@ -0,0 +1,62 @@
+package qtun
+
+import (
+	"fmt"
+
+	"github.com/matthewgao/qtun/iface"
+	"github.com/matthewgao/qtun/transport"
+	"github.com/rs/zerolog/log"
+)
+
+// hubMode decides what the server does with the packets from a client to
+// another client
+type hubMode int
+
+const (
+	// written to the tun like any other packet, the kernel routes them back
+	// into the tunnel when ip forwarding is on
+	hubOff hubMode = iota
+	// relayed to the connection of the other client without the tun
+	hubAllow
+	// dropped, clients only talk to the server and the networks behind it
+	hubDeny
+)
+
+// parseHubMode parses --hub
+func parseHubMode(mode string) (hubMode, error) {
+	switch mode {
+	case "", "off":
+		return hubOff, nil
+	case "allow":
+		return hubAllow, nil
+	case "deny":
+		return hubDeny, nil
+	}
+	return hubOff, fmt.Errorf("unknown hub mode %q, expect off, allow or deny", mode)
+}
+
+// forward hands a packet received from a client to the tun, or to the client
+// owning its destination in hub mode. A packet is never relayed back to the
+// client it came from, that would loop through the tunnel
+func (this *App) forward(pkt iface.PacketIP, from *transport.ServerConn) {
+	if this.hub != hubOff && this.routes.lookup(pkt.GetDestinationIP()) != nil {
+		if this.hub == hubDeny {
+			log.Debug().Str("identity", from.Identity()).IPAddr("src", pkt.GetSourceIP()).
+				IPAddr("dst", pkt.GetDestinationIP()).
+				Msg("client to client packet denied")
+			return
+		}
+		if owner, _ := this.routes.ownerOf(pkt.GetDestinationIP()); owner == this.ownerOf(from) {
+			log.Debug().Str("identity", from.Identity()).IPAddr("src", pkt.GetSourceIP()).
+				IPAddr("dst", pkt.GetDestinationIP()).
+				Msg("packet back to its own client dropped")
+			return
+		}
+		relay := transport.CopyPacket(pkt)
+		if this.sendToClient(relay) {
+			return
+		}
+		relay.Free()
+	}
+	this.writeTun(pkt)
+}
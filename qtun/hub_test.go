@@ -0,0 +1,111 @@
+package qtun
+
+import (
+	"crypto/x509"
+	"expvar"
+	"net"
+	"testing"
+
+	"github.com/matthewgao/qtun/transport"
+)
+
+func TestParseHubMode(t *testing.T) {
+	for mode, expect := range map[string]hubMode{"": hubOff, "off": hubOff, "allow": hubAllow, "deny": hubDeny} {
+		if got, err := parseHubMode(mode); err != nil || got != expect {
+			t.Fatalf("bad: %q is %v, %v", mode, got, err)
+		}
+	}
+	if _, err := parseHubMode("relay"); err == nil {
+		t.Fatalf("bad: unknown mode accepted")
+	}
+}
+
+// testConn is a connection which is never run, the packets sent to it stay
+// in its queue
+type testConn struct {
+	net.Conn
+}
+
+func (testConn) SendDatagram([]byte) error             { return nil }
+func (testConn) ReceiveDatagram() ([]byte, error)      { return nil, nil }
+func (testConn) SupportsDatagrams() bool               { return false }
+func (testConn) PeerCertificates() []*x509.Certificate { return nil }
+
+// queued is the number of packets waiting in the send queues of all the
+// connections, published by the transport
+func queued() int64 {
+	if depth, ok := expvar.Get("transport").(*expvar.Map).Get("send_queue_depth").(*expvar.Int); ok {
+		return depth.Value()
+	}
+	return 0
+}
+
+// testHub is a server with the clients 10.4.4.3, which has 192.168.10.0/24
+// behind it, and 10.4.4.4 connected
+func testHub(t *testing.T, mode hubMode) (*App, *transport.ServerConn, *transport.ServerConn) {
+	app := &App{
+		hub:    mode,
+		routes: newRouteTable(),
+		owners: make(map[*transport.ServerConn]binding),
+		server: transport.NewServer("", nil, "", nil),
+	}
+	a := transport.NewServerConn(testConn{}, "", nil, false)
+	b := transport.NewServerConn(testConn{}, "", nil, false)
+	for _, v := range []struct {
+		conn  *transport.ServerConn
+		owner string
+		key   string
+	}{
+		{a, "10.4.4.3", "10.4.4.3/24:1000"},
+		{b, "10.4.4.4", "10.4.4.4/24:1000"},
+	} {
+		if !app.bind(v.conn, v.owner, v.key) || !app.server.SetConns(v.key, v.conn) {
+			t.Fatalf("bad: %s not registered", v.key)
+		}
+		app.routes.add(hostPrefix(net.ParseIP(v.owner)), v.owner, "", v.key, false)
+	}
+	app.routes.add(mustPrefix(t, "192.168.10.0/24"), "10.4.4.3", "", "10.4.4.3/24:1000", true)
+	return app, a, b
+}
+
+func TestApp_Forward(t *testing.T) {
+	for _, v := range []struct {
+		mode    hubMode
+		src     string
+		dst     string
+		relayed bool
+	}{
+		{hubAllow, "10.4.4.3", "10.4.4.4", true},
+		{hubAllow, "192.168.10.7", "10.4.4.4", true},
+		{hubAllow, "10.4.4.4", "192.168.10.7", true},
+		{hubDeny, "10.4.4.3", "10.4.4.4", false},
+		{hubDeny, "10.4.4.4", "192.168.10.7", false},
+		// not to a client, it goes to the tun, which isn't up here
+		{hubAllow, "10.4.4.3", "8.8.8.8", false},
+	} {
+		app, a, b := testHub(t, v.mode)
+		from := a
+		if v.src == "10.4.4.4" {
+			from = b
+		}
+
+		before := queued()
+		app.forward(testPacket(v.src, v.dst), from)
+		if relayed := queued() == before+1; relayed != v.relayed {
+			t.Fatalf("bad: %v %s to %s relayed %v", v.mode, v.src, v.dst, relayed)
+		}
+	}
+}
+
+func TestApp_ForwardHairpin(t *testing.T) {
+	app, a, _ := testHub(t, hubAllow)
+
+	// its own tunnel ip, or the network behind it, stay with the client
+	for _, dst := range []string{"10.4.4.3", "192.168.10.7"} {
+		before := queued()
+		app.forward(testPacket("10.4.4.3", dst), a)
+		if queued() != before {
+			t.Fatalf("bad: %s relayed back to its client", dst)
+		}
+	}
+}
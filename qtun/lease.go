@@ -0,0 +1,291 @@
+package qtun
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// an address which hasn't been seen for leaseHold is handed to another
+// client when the pool runs out
+const leaseHold = 24 * time.Hour
+
+// leasePool hands out the tunnel ips of the subnet of the server to the
+// clients started with --ip auto. A lease belongs to the identity of the
+// client certificate, or the client id when there is none, so a returning
+// client gets the same address. The clients with a static ip inside the
+// subnet reserve it with their ping. The leases are kept in a json file:
+//
+//	{"cn:alice-laptop": {"ip": "10.4.4.3", "seen": "2022-09-01T10:00:00Z"}}
+type leasePool struct {
+	mutex  sync.Mutex
+	subnet *net.IPNet
+	server net.IP
+	file   string
+	leases map[string]*lease
+	// the key of each leased ip
+	owners map[string]string
+	// seen has changed since the file was written
+	dirty bool
+}
+
+type lease struct {
+	IP   string    `json:"ip"`
+	Seen time.Time `json:"seen"`
+}
+
+// newLeasePool makes the pool of cidr, the --ip of the server, and loads
+// the leases of file
+func newLeasePool(cidr, file string) (*leasePool, error) {
+	server, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	p := &leasePool{
+		subnet: subnet,
+		server: server,
+		file:   file,
+		leases: make(map[string]*lease),
+		owners: make(map[string]string),
+	}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load leases fail: %s", err)
+	}
+	leases := map[string]*lease{}
+	err = json.Unmarshal(data, &leases)
+	if err != nil {
+		return nil, fmt.Errorf("load leases fail: %s", err)
+	}
+	for key, l := range leases {
+		ip := net.ParseIP(l.IP)
+		if !p.usable(ip) {
+			log.Warn().Str("key", key).Str("ip", l.IP).Msg("lease outside of the pool, dropped")
+			continue
+		}
+		if _, ok := p.owners[ip.String()]; ok {
+			continue
+		}
+		l.IP = ip.String()
+		p.leases[key] = l
+		p.owners[l.IP] = key
+	}
+	log.Info().Str("file", file).Int("size", len(p.leases)).Msg("leases loaded")
+	return p, nil
+}
+
+// leaseKey is the key of the lease of a client, empty when the client can't
+// be told apart from the others
+func leaseKey(identity, clientID string) string {
+	if identity != "" {
+		return "cn:" + identity
+	}
+	if clientID != "" {
+		return "id:" + clientID
+	}
+	return ""
+}
+
+// usable tells if ip may be leased, the address of the server, and the
+// network and broadcast addresses of an ipv4 subnet are not
+func (p *leasePool) usable(ip net.IP) bool {
+	if ip == nil || !p.subnet.Contains(ip) || ip.Equal(p.server) {
+		return false
+	}
+	if ip.To4() == nil {
+		return true
+	}
+	ones, bits := p.subnet.Mask.Size()
+	if bits-ones < 2 {
+		return true
+	}
+	last := make(net.IP, len(p.subnet.IP))
+	for i := range last {
+		last[i] = p.subnet.IP[i] | ^p.subnet.Mask[i]
+	}
+	return !ip.Equal(p.subnet.IP) && !ip.Equal(last)
+}
+
+// acquire returns the ip/prefix leased to key, taken from the allowed
+// cidrs, which is the subnet of the pool for a client without acl. A lease
+// the acl doesn't allow any more is replaced
+func (p *leasePool) acquire(key string, allowed []*net.IPNet) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if l, ok := p.leases[key]; ok {
+		if within(allowed, net.ParseIP(l.IP)) {
+			l.Seen = time.Now()
+			p.dirty = true
+			return p.prefix(l.IP), nil
+		}
+		log.Info().Str("key", key).Str("ip", l.IP).Msg("lease not allowed by the acl, replaced")
+	}
+
+	ip := ""
+	for _, ipNet := range allowed {
+		if ip = p.free(ipNet); ip != "" {
+			break
+		}
+	}
+	if ip == "" {
+		ip = p.reclaim(allowed)
+	}
+	if ip == "" {
+		if len(allowed) == 0 {
+			return "", fmt.Errorf("no address of pool %s is allowed by the acl", p.subnet)
+		}
+		return "", fmt.Errorf("address pool %s is exhausted", p.subnet)
+	}
+
+	p.take(key, ip)
+	log.Info().Str("key", key).Str("ip", ip).Msg("ip leased")
+	p.persist()
+	return p.prefix(ip), nil
+}
+
+// within tells if one of cidrs contains ip
+func within(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range cidrs {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// claim is called with the ip in every ping, it fails when the ip is
+// leased to another client, and reserves it otherwise
+func (p *leasePool) claim(key string, ip net.IP) error {
+	if !p.usable(ip) {
+		return nil
+	}
+	if key == "" {
+		key = "ip:" + ip.String()
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if owner, ok := p.owners[ip.String()]; ok {
+		if owner != key {
+			return fmt.Errorf("%s is leased to %s", ip, owner)
+		}
+		p.leases[key].Seen = time.Now()
+		p.dirty = true
+		return nil
+	}
+
+	p.take(key, ip.String())
+	log.Info().Str("key", key).Str("ip", ip.String()).Msg("ip reserved")
+	p.persist()
+	return nil
+}
+
+// take leases ip to key, in place of the ip key had
+func (p *leasePool) take(key, ip string) {
+	if l, ok := p.leases[key]; ok {
+		delete(p.owners, l.IP)
+	}
+	p.leases[key] = &lease{IP: ip, Seen: time.Now()}
+	p.owners[ip] = key
+}
+
+// free returns the first address nobody has in the part of the pool
+// inside cidr
+func (p *leasePool) free(cidr *net.IPNet) string {
+	ones, _ := cidr.Mask.Size()
+	poolOnes, _ := p.subnet.Mask.Size()
+	switch {
+	case ones >= poolOnes && p.subnet.Contains(cidr.IP):
+	case ones < poolOnes && cidr.Contains(p.subnet.IP):
+		cidr = p.subnet
+	default:
+		return ""
+	}
+
+	n := new(big.Int).SetBytes(cidr.IP)
+	one := big.NewInt(1)
+	for ip := cidr.IP; cidr.Contains(ip); {
+		if _, ok := p.owners[ip.String()]; !ok && p.usable(ip) {
+			return ip.String()
+		}
+		n.Add(n, one)
+		b := n.Bytes()
+		if len(b) > len(cidr.IP) {
+			return ""
+		}
+		ip = make(net.IP, len(cidr.IP))
+		copy(ip[len(ip)-len(b):], b)
+	}
+	return ""
+}
+
+// reclaim takes back the address inside the allowed cidrs seen the longest
+// ago, if it's older than leaseHold
+func (p *leasePool) reclaim(allowed []*net.IPNet) string {
+	oldest := ""
+	for key, l := range p.leases {
+		if time.Since(l.Seen) > leaseHold && within(allowed, net.ParseIP(l.IP)) && (oldest == "" || l.Seen.Before(p.leases[oldest].Seen)) {
+			oldest = key
+		}
+	}
+	if oldest == "" {
+		return ""
+	}
+	ip := p.leases[oldest].IP
+	log.Info().Str("key", oldest).Str("ip", ip).Msg("stale lease reclaimed")
+	delete(p.leases, oldest)
+	delete(p.owners, ip)
+	return ip
+}
+
+func (p *leasePool) prefix(ip string) string {
+	ones, _ := p.subnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones)
+}
+
+// flush writes the leases when the clients seen have changed
+func (p *leasePool) flush() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.dirty {
+		p.persist()
+	}
+}
+
+// persist saves a new lease, which is kept in memory anyway when the file
+// can't be written
+func (p *leasePool) persist() {
+	err := p.save()
+	if err != nil {
+		log.Error().Err(err).Msg("save leases fail")
+	}
+}
+
+func (p *leasePool) save() error {
+	data, err := json.MarshalIndent(p.leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	// written aside and renamed, a crash never leaves half a file
+	err = os.WriteFile(p.file+".tmp", data, 0600)
+	if err == nil {
+		err = os.Rename(p.file+".tmp", p.file)
+	}
+	if err != nil {
+		return err
+	}
+	p.dirty = false
+	return nil
+}
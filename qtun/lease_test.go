@@ -0,0 +1,118 @@
+package qtun
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLeasePool(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "leases.json")
+	pool, err := newLeasePool("10.4.4.1/24", file)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	alice, err := pool.acquire("cn:alice", []*net.IPNet{pool.subnet})
+	if err != nil || alice != "10.4.4.2/24" {
+		t.Fatalf("bad: %s %v", alice, err)
+	}
+	if again, _ := pool.acquire("cn:alice", []*net.IPNet{pool.subnet}); again != alice {
+		t.Fatalf("bad: %s", again)
+	}
+	bob, _ := pool.acquire("id:bob", []*net.IPNet{pool.subnet})
+	if bob != "10.4.4.3/24" {
+		t.Fatalf("bad: %s", bob)
+	}
+
+	// a returning client gets the same address after a restart
+	pool, err = newLeasePool("10.4.4.1/24", file)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if again, _ := pool.acquire("id:bob", []*net.IPNet{pool.subnet}); again != bob {
+		t.Fatalf("bad: %s", again)
+	}
+}
+
+func TestLeasePool_Claim(t *testing.T) {
+	pool, _ := newLeasePool("10.4.4.1/24", filepath.Join(t.TempDir(), "leases.json"))
+	pool.acquire("cn:alice", []*net.IPNet{pool.subnet})
+
+	if err := pool.claim("cn:alice", net.ParseIP("10.4.4.2")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := pool.claim("cn:eve", net.ParseIP("10.4.4.2")); err == nil {
+		t.Fatalf("bad: ip of alice claimed by eve")
+	}
+	// a static ip is reserved, addresses outside the pool are not tracked
+	if err := pool.claim("", net.ParseIP("10.4.4.3")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ip, _ := pool.acquire("cn:bob", []*net.IPNet{pool.subnet}); ip != "10.4.4.4/24" {
+		t.Fatalf("bad: %s", ip)
+	}
+	if err := pool.claim("cn:eve", net.ParseIP("10.5.5.5")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestLeasePool_Exhausted(t *testing.T) {
+	pool, _ := newLeasePool("10.4.4.1/30", filepath.Join(t.TempDir(), "leases.json"))
+	if ip, err := pool.acquire("cn:alice", []*net.IPNet{pool.subnet}); err != nil || ip != "10.4.4.2/30" {
+		t.Fatalf("bad: %s %v", ip, err)
+	}
+	if _, err := pool.acquire("cn:bob", []*net.IPNet{pool.subnet}); err == nil {
+		t.Fatalf("bad: network or broadcast address leased")
+	}
+
+	// the address of a client gone for long is taken back
+	pool.leases["cn:alice"].Seen = time.Now().Add(-leaseHold - time.Hour)
+	if ip, err := pool.acquire("cn:bob", []*net.IPNet{pool.subnet}); err != nil || ip != "10.4.4.2/30" {
+		t.Fatalf("bad: %s %v", ip, err)
+	}
+	if _, ok := pool.leases["cn:alice"]; ok {
+		t.Fatalf("bad: stale lease kept")
+	}
+}
+
+func TestLeasePool_ACL(t *testing.T) {
+	pool, _ := newLeasePool("10.4.4.1/24", filepath.Join(t.TempDir(), "leases.json"))
+	pool.acquire("cn:bob", []*net.IPNet{pool.subnet})
+
+	alice := []*net.IPNet{mustPrefix(t, "10.4.4.8/31"), mustPrefix(t, "10.9.9.0/24")}
+	if ip, err := pool.acquire("cn:alice", alice); err != nil || ip != "10.4.4.8/24" {
+		t.Fatalf("bad: %s %v", ip, err)
+	}
+	if ip, err := pool.acquire("cn:carol", alice); err != nil || ip != "10.4.4.9/24" {
+		t.Fatalf("bad: %s %v", ip, err)
+	}
+	if _, err := pool.acquire("cn:dave", alice); err == nil {
+		t.Fatalf("bad: ip outside of the acl leased")
+	}
+	if _, err := pool.acquire("cn:eve", nil); err == nil {
+		t.Fatalf("bad: ip leased without acl entry")
+	}
+
+	// a wider cidr allows the whole pool
+	if ip, err := pool.acquire("cn:dave", []*net.IPNet{mustPrefix(t, "10.0.0.0/8")}); err != nil || ip != "10.4.4.3/24" {
+		t.Fatalf("bad: %s %v", ip, err)
+	}
+	// the lease of bob isn't allowed any more
+	if ip, err := pool.acquire("cn:bob", []*net.IPNet{mustPrefix(t, "10.4.4.16/28")}); err != nil || ip != "10.4.4.16/24" {
+		t.Fatalf("bad: %s %v", ip, err)
+	}
+	if _, ok := pool.owners["10.4.4.2"]; ok {
+		t.Fatalf("bad: old lease of bob kept")
+	}
+}
+
+func TestApp_WriteTunBeforeStart(t *testing.T) {
+	// the lease and the first packets can come before the tun is up
+	app := &App{}
+	app.writeTun(testPacket("10.4.4.2", "10.4.4.3"))
+	if app.tun() != nil {
+		t.Fatalf("bad: tun before start")
+	}
+}
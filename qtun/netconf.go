@@ -0,0 +1,285 @@
+package qtun
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/matthewgao/qtun/iface"
+	"github.com/matthewgao/qtun/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// resolvConf is replaced when there is no resolvectl, the original one is
+// kept in resolvBackup meanwhile, so it survives a crash
+var (
+	resolvConf   = "/etc/resolv.conf"
+	resolvBackup = "/etc/resolv.conf.qtun"
+)
+
+// newPushConfig parses --push_routes, --push_dns, --push_search and
+// --push_mtu, nil when there is nothing to push. The pushed mtu can't be
+// larger than the one of the clients, their packet buffers are sized by it
+func newPushConfig(routes, dns, search string, mtu int) (*protocol.MessageConfig, error) {
+	msg := &protocol.MessageConfig{}
+
+	prefixes, err := parsePrefixes(routes)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range prefixes {
+		msg.Routes = append(msg.Routes, prefix.String())
+	}
+	for _, addr := range splitList(dns) {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid dns server %q", addr)
+		}
+		msg.DNS = append(msg.DNS, ip.String())
+	}
+	msg.Search = splitList(search)
+	if mtu != 0 && (mtu < 576 || mtu > 65535) {
+		return nil, fmt.Errorf("invalid mtu %d to push, expect 576 to 65535", mtu)
+	}
+	msg.MTU = uint32(mtu)
+
+	if len(msg.Routes) == 0 && len(msg.DNS) == 0 && len(msg.Search) == 0 && msg.MTU == 0 {
+		return nil, nil
+	}
+	return msg, nil
+}
+
+func splitList(list string) []string {
+	result := []string{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// netConfig applies the configuration pushed by the server to the client,
+// and reverts it when the client exits, it's kept while the connections
+// are reconnecting. Only linux is supported, the
+// routes go to the tun interface, the dns servers to systemd-resolved for
+// the tun interface, or to /etc/resolv.conf when there is no resolvectl
+type netConfig struct {
+	mutex   sync.Mutex
+	iface   *iface.Iface
+	mtu     int
+	pending *protocol.MessageConfig
+	applied *protocol.MessageConfig
+	routes  []*net.IPNet
+	// resolvectl has been set up, or the resolv.conf replaced
+	resolved bool
+	resolv   []byte
+}
+
+// push applies msg, or keeps it until the tun interface is up
+func (n *netConfig) push(msg *protocol.MessageConfig) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.applied != nil && proto.Equal(n.applied, msg) {
+		return
+	}
+	n.pending = msg
+	if n.iface != nil {
+		n.apply()
+	}
+}
+
+// setIface applies the configuration received so far, mtu is the one of the
+// interface, restored on revert
+func (n *netConfig) setIface(i *iface.Iface, mtu int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.iface, n.mtu = i, mtu
+	if n.pending != nil {
+		n.apply()
+	}
+}
+
+func (n *netConfig) apply() {
+	msg := n.pending
+	n.pending = nil
+	if runtime.GOOS != "linux" {
+		log.Info().Str("os", runtime.GOOS).Strs("routes", msg.GetRoutes()).Strs("dns", msg.GetDNS()).
+			Strs("search", msg.GetSearch()).Uint32("mtu", msg.GetMTU()).
+			Msg("pushed network config not support please set it manually")
+		n.applied = msg
+		return
+	}
+
+	// the config of a server we've failed over to replaces the old one
+	n.revertLocked()
+	n.applied = msg
+	log.Info().Strs("routes", msg.GetRoutes()).Strs("dns", msg.GetDNS()).
+		Strs("search", msg.GetSearch()).Uint32("mtu", msg.GetMTU()).
+		Msg("apply pushed network config")
+
+	if mtu := int(msg.GetMTU()); mtu != 0 {
+		if mtu > n.mtu {
+			log.Warn().Int("mtu", mtu).Int("local_mtu", n.mtu).
+				Msg("pushed mtu is larger than --mtu, ignored")
+		} else if err := n.iface.SetMTU(mtu); err != nil {
+			log.Error().Err(err).Msg("set pushed mtu fail")
+		}
+	}
+
+	for _, cidr := range msg.GetRoutes() {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Warn().Str("route", cidr).Msg("invalid pushed route, ignored")
+			continue
+		}
+		err = n.iface.AddRoute(prefix)
+		if err != nil {
+			log.Error().Err(err).Msg("add pushed route fail")
+			continue
+		}
+		n.routes = append(n.routes, prefix)
+	}
+
+	if len(msg.GetDNS()) > 0 || len(msg.GetSearch()) > 0 {
+		err := n.setDNS(msg.GetDNS(), msg.GetSearch())
+		if err != nil {
+			log.Error().Err(err).Msg("set pushed dns fail")
+		}
+	}
+}
+
+func (n *netConfig) setDNS(servers, search []string) error {
+	if _, err := exec.LookPath("resolvectl"); err == nil {
+		n.resolved = true
+		if len(servers) > 0 {
+			err = run("resolvectl", append([]string{"dns", n.iface.Name()}, servers...)...)
+			if err != nil {
+				return err
+			}
+		}
+		if len(search) > 0 {
+			return run("resolvectl", append([]string{"domain", n.iface.Name()}, search...)...)
+		}
+		return nil
+	}
+
+	old, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(resolvBackup, old, 0644)
+	if err != nil {
+		return fmt.Errorf("backup %s fail: %s", resolvConf, err)
+	}
+	err = os.WriteFile(resolvConf, renderResolvConf(old, servers, search), 0644)
+	if err != nil {
+		os.Remove(resolvBackup)
+		return err
+	}
+	n.resolv = old
+	return nil
+}
+
+// restoreResolvConf puts back the resolv.conf a client which has crashed
+// didn't get to restore, it's called when the client starts
+func restoreResolvConf() error {
+	old, err := os.ReadFile(resolvBackup)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(resolvConf, old, 0644)
+	if err != nil {
+		return err
+	}
+	log.Warn().Str("backup", resolvBackup).Msg("resolv.conf left by the last run restored")
+	return os.Remove(resolvBackup)
+}
+
+// renderResolvConf puts servers and search in front of the old resolv.conf,
+// its nameservers are kept behind as a fallback, options go along
+func renderResolvConf(old []byte, servers, search []string) []byte {
+	b := &strings.Builder{}
+	b.WriteString("# generated by qtun, restored when it exits\n")
+	for _, server := range servers {
+		fmt.Fprintf(b, "nameserver %s\n", server)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(b, "search %s\n", strings.Join(search, " "))
+	}
+	for _, line := range strings.Split(string(old), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		if len(search) > 0 && (fields[0] == "search" || fields[0] == "domain") {
+			continue
+		}
+		b.WriteString(line + "\n")
+	}
+	return []byte(b.String())
+}
+
+// revert undoes the applied configuration
+func (n *netConfig) revert() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.revertLocked()
+}
+
+func (n *netConfig) revertLocked() {
+	if n.applied == nil || runtime.GOOS != "linux" {
+		return
+	}
+	log.Info().Msg("revert pushed network config")
+
+	for _, prefix := range n.routes {
+		err := n.iface.DelRoute(prefix)
+		if err != nil {
+			log.Error().Err(err).Msg("delete pushed route fail")
+		}
+	}
+	n.routes = nil
+
+	if n.resolved {
+		err := run("resolvectl", "revert", n.iface.Name())
+		if err != nil {
+			log.Error().Err(err).Msg("revert pushed dns fail")
+		}
+		n.resolved = false
+	}
+	if n.resolv != nil {
+		err := os.WriteFile(resolvConf, n.resolv, 0644)
+		if err != nil {
+			log.Error().Err(err).Msg("restore resolv.conf fail")
+		} else {
+			os.Remove(resolvBackup)
+		}
+		n.resolv = nil
+	}
+
+	if n.applied.GetMTU() != 0 && int(n.applied.GetMTU()) <= n.mtu {
+		err := n.iface.SetMTU(n.mtu)
+		if err != nil {
+			log.Error().Err(err).Msg("restore mtu fail")
+		}
+	}
+	n.applied = nil
+}
+
+func run(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s fail: %s %s", name, strings.Join(args, " "), err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package qtun
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matthewgao/qtun/protocol"
+)
+
+func TestNewPushConfig(t *testing.T) {
+	if msg, err := newPushConfig("", "", "", 0); msg != nil || err != nil {
+		t.Fatalf("bad: %v %v", msg, err)
+	}
+
+	msg, err := newPushConfig("192.168.10.1/24, 10.0.0.0/8", "10.4.4.2", "corp.example.com,example.com", 1400)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(msg.Routes) != 2 || msg.Routes[0] != "192.168.10.0/24" || len(msg.DNS) != 1 ||
+		len(msg.Search) != 2 || msg.MTU != 1400 {
+		t.Fatalf("bad: %v", msg)
+	}
+
+	for _, v := range [][4]string{{"192.168.10.0", "", ""}, {"", "dns.example.com", ""}} {
+		if _, err := newPushConfig(v[0], v[1], v[2], 0); err == nil {
+			t.Fatalf("bad: %v accepted", v)
+		}
+	}
+	if _, err := newPushConfig("", "", "", 100); err == nil {
+		t.Fatalf("bad: tiny mtu accepted")
+	}
+}
+
+func TestRenderResolvConf(t *testing.T) {
+	old := "# managed\nnameserver 8.8.8.8\nsearch home.lan\noptions edns0\n"
+	out := string(renderResolvConf([]byte(old), []string{"10.4.4.2"}, []string{"corp.example.com"}))
+	expect := "# generated by qtun, restored when it exits\n" +
+		"nameserver 10.4.4.2\nsearch corp.example.com\nnameserver 8.8.8.8\noptions edns0\n"
+	if out != expect {
+		t.Fatalf("bad: %q", out)
+	}
+
+	// the old search domains stay when none is pushed
+	out = string(renderResolvConf([]byte(old), []string{"10.4.4.2"}, nil))
+	if out != "# generated by qtun, restored when it exits\n"+
+		"nameserver 10.4.4.2\nnameserver 8.8.8.8\nsearch home.lan\noptions edns0\n" {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
+func TestNetConfig_Pending(t *testing.T) {
+	n := &netConfig{}
+	msg := &protocol.MessageConfig{Routes: []string{"192.168.10.0/24"}}
+	n.push(msg)
+	if n.pending != msg || n.applied != nil {
+		t.Fatalf("bad: applied without the tun interface")
+	}
+	// nothing to revert
+	n.revert()
+}
+
+func TestRestoreResolvConf(t *testing.T) {
+	dir := t.TempDir()
+	defer func(conf, backup string) { resolvConf, resolvBackup = conf, backup }(resolvConf, resolvBackup)
+	resolvConf, resolvBackup = filepath.Join(dir, "resolv.conf"), filepath.Join(dir, "resolv.conf.qtun")
+
+	// nothing left by the last run
+	os.WriteFile(resolvConf, []byte("nameserver 8.8.8.8\n"), 0644)
+	if err := restoreResolvConf(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// the last run has crashed with the pushed dns in place
+	os.WriteFile(resolvConf, renderResolvConf([]byte("nameserver 8.8.8.8\n"), []string{"10.4.4.2"}, nil), 0644)
+	os.WriteFile(resolvBackup, []byte("nameserver 8.8.8.8\n"), 0644)
+	if err := restoreResolvConf(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if data, _ := os.ReadFile(resolvConf); string(data) != "nameserver 8.8.8.8\n" {
+		t.Fatalf("bad: %q", data)
+	}
+	if _, err := os.Stat(resolvBackup); !os.IsNotExist(err) {
+		t.Fatalf("bad: backup kept %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package qtun
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// routeTable maps the destinations of the tun packets to the connections of
+// the clients. Every client owns the host route of its tunnel ip and the
+// subnets it advertises, a packet goes to the longest prefix containing its
+// destination. A prefix belongs to the first client advertising it until
+// all the connections of that client are gone, the others are refused, so
+// a tunnel ip can't be taken by another client while its owner is alive. A
+// client is told apart by its holder, see routeHolder
+type routeTable struct {
+	mutex   sync.RWMutex
+	entries map[prefixKey]*route
+	// prefix lengths in use, longest first, of ipv4 and ipv6
+	lengths [2][]int
+	// prefixes refused to another owner, so a conflict is logged once
+	conflicts map[prefixKey]map[string]struct{}
+}
+
+// prefixKey is a masked address in the 16 bytes form, the length of an ipv4
+// prefix counts the 96 bits in front
+type prefixKey struct {
+	ip   [16]byte
+	bits int
+}
+
+type route struct {
+	prefix *net.IPNet
+	// tunnel ip and holder of the client
+	owner  string
+	holder string
+	// advertised by the client, rather than the host route of its tunnel
+	// ip, these are added to the system routes
+	advertised bool
+	// sorted, replaced rather than modified so a lookup can use it without
+	// the lock
+	conns []string
+}
+
+// routeHolder is the identity of the client certificate and the instance id
+// the client picks at start, without client certificates the identity of
+// all of them is empty
+func routeHolder(identity string, instance []byte) string {
+	return identity + "/" + hex.EncodeToString(instance)
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		entries:   make(map[prefixKey]*route),
+		conflicts: make(map[prefixKey]map[string]struct{}),
+	}
+}
+
+// parsePrefixes parses --advertise
+func parsePrefixes(cidrs string) ([]*net.IPNet, error) {
+	prefixes := []*net.IPNet{}
+	for _, cidr := range splitList(cidrs) {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q: %s", cidr, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// hostPrefix returns the prefix of ip alone
+func hostPrefix(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func family(ip net.IP) int {
+	if ip.To4() != nil {
+		return 0
+	}
+	return 1
+}
+
+func makeKey(ip net.IP, bits int) prefixKey {
+	key := prefixKey{bits: bits}
+	copy(key.ip[:], ip.To16())
+	for i := range key.ip {
+		switch {
+		case bits >= 8:
+			bits -= 8
+		case bits > 0:
+			key.ip[i] &= byte(0xff << (8 - bits))
+			bits = 0
+		default:
+			key.ip[i] = 0
+		}
+	}
+	return key
+}
+
+func prefixToKey(prefix *net.IPNet) prefixKey {
+	ones, size := prefix.Mask.Size()
+	if size == 32 {
+		ones += 96
+	}
+	return makeKey(prefix.IP, ones)
+}
+
+// add routes prefix to conn of owner, it tells if the prefix is new, and
+// fails when the prefix belongs to another client
+func (t *routeTable) add(prefix *net.IPNet, owner, holder, conn string, advertised bool) (bool, error) {
+	key := prefixToKey(prefix)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	r, ok := t.entries[key]
+	if ok && (r.owner != owner || r.holder != holder) {
+		err := fmt.Errorf("%s of %s(%s) is routed to %s(%s)", prefix, owner, holder, r.owner, r.holder)
+		if _, logged := t.conflicts[key][owner]; !logged {
+			if t.conflicts[key] == nil {
+				t.conflicts[key] = make(map[string]struct{})
+			}
+			t.conflicts[key][owner] = struct{}{}
+			log.Warn().Err(err).Str("conn", conn).Msg("route conflict, prefix refused")
+		}
+		return false, err
+	}
+
+	if ok {
+		i := sort.SearchStrings(r.conns, conn)
+		if i < len(r.conns) && r.conns[i] == conn {
+			return false, nil
+		}
+		conns := make([]string, 0, len(r.conns)+1)
+		conns = append(conns, r.conns[:i]...)
+		conns = append(conns, conn)
+		r.conns = append(conns, r.conns[i:]...)
+		return false, nil
+	}
+
+	for _, other := range t.entries {
+		if other.owner != owner && (other.prefix.Contains(prefix.IP) || prefix.Contains(other.prefix.IP)) {
+			log.Warn().Str("prefix", prefix.String()).Str("owner", owner).
+				Str("other", other.prefix.String()).Str("other_owner", other.owner).
+				Msg("route overlaps the one of another client, the longest prefix wins")
+		}
+	}
+
+	t.entries[key] = &route{
+		prefix:     prefix,
+		owner:      owner,
+		holder:     holder,
+		advertised: advertised,
+		conns:      []string{conn},
+	}
+	f := family(prefix.IP)
+	lengths := t.lengths[f]
+	i := sort.Search(len(lengths), func(i int) bool { return lengths[i] <= key.bits })
+	if i == len(lengths) || lengths[i] != key.bits {
+		lengths = append(lengths, 0)
+		copy(lengths[i+1:], lengths[i:])
+		lengths[i] = key.bits
+		t.lengths[f] = lengths
+	}
+	log.Info().Str("prefix", prefix.String()).Str("owner", owner).Str("conn", conn).
+		Msg("route added")
+	return true, nil
+}
+
+// lookup returns the connections of the longest prefix containing dst
+func (t *routeTable) lookup(dst net.IP) []string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if r := t.find(dst); r != nil {
+		return r.conns
+	}
+	return nil
+}
+
+// ownerOf returns the tunnel ip of the client the longest prefix containing
+// src belongs to, a packet from src is only accepted from that client
+func (t *routeTable) ownerOf(src net.IP) (string, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if r := t.find(src); r != nil {
+		return r.owner, true
+	}
+	return "", false
+}
+
+func (t *routeTable) find(ip net.IP) *route {
+	for _, bits := range t.lengths[family(ip)] {
+		if r, ok := t.entries[makeKey(ip, bits)]; ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// allConns returns the connections of all the routes
+func (t *routeTable) allConns() []string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	seen := map[string]struct{}{}
+	conns := []string{}
+	for _, r := range t.entries {
+		for _, c := range r.conns {
+			if _, ok := seen[c]; !ok {
+				seen[c] = struct{}{}
+				conns = append(conns, c)
+			}
+		}
+	}
+	return conns
+}
+
+// removeConn takes conn out of all the routes, and returns the routes left
+// without any connection, which are removed
+func (t *routeTable) removeConn(conn string) []*route {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	removed := []*route{}
+	for key, r := range t.entries {
+		i := sort.SearchStrings(r.conns, conn)
+		if i == len(r.conns) || r.conns[i] != conn {
+			continue
+		}
+		if len(r.conns) > 1 {
+			conns := make([]string, 0, len(r.conns)-1)
+			conns = append(conns, r.conns[:i]...)
+			r.conns = append(conns, r.conns[i+1:]...)
+			continue
+		}
+
+		delete(t.entries, key)
+		delete(t.conflicts, key)
+		removed = append(removed, r)
+		log.Info().Str("prefix", r.prefix.String()).Str("owner", r.owner).
+			Msg("route removed")
+	}
+	if len(removed) > 0 {
+		t.compactLengths()
+	}
+	return removed
+}
+
+// compactLengths drops the prefix lengths nobody uses any more
+func (t *routeTable) compactLengths() {
+	used := [2]map[int]struct{}{{}, {}}
+	for key, r := range t.entries {
+		used[family(r.prefix.IP)][key.bits] = struct{}{}
+	}
+	for f, lengths := range t.lengths {
+		kept := []int{}
+		for _, bits := range lengths {
+			if _, ok := used[f][bits]; ok {
+				kept = append(kept, bits)
+			}
+		}
+		t.lengths[f] = kept
+	}
+}
@@ -0,0 +1,197 @@
+package qtun
+
+import (
+	"net"
+	"testing"
+
+	"github.com/matthewgao/qtun/iface"
+	"github.com/matthewgao/qtun/transport"
+)
+
+func mustPrefix(t *testing.T, cidr string) *net.IPNet {
+	_, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return prefix
+}
+
+func TestRouteTable_Lookup(t *testing.T) {
+	table := newRouteTable()
+	table.add(hostPrefix(net.ParseIP("10.4.4.3")), "10.4.4.3", "", "a", false)
+	table.add(mustPrefix(t, "192.168.0.0/16"), "10.4.4.3", "", "a", true)
+	table.add(hostPrefix(net.ParseIP("10.4.4.4")), "10.4.4.4", "", "b", false)
+	table.add(mustPrefix(t, "192.168.10.0/24"), "10.4.4.4", "", "b", true)
+	table.add(mustPrefix(t, "fd00::/64"), "10.4.4.4", "", "b", true)
+
+	for dst, conn := range map[string]string{
+		"10.4.4.3":      "a",
+		"10.4.4.4":      "b",
+		"192.168.1.1":   "a",
+		"192.168.10.20": "b",
+		"fd00::1":       "b",
+		"10.4.4.5":      "",
+		"8.8.8.8":       "",
+		"fd01::1":       "",
+	} {
+		conns := table.lookup(net.ParseIP(dst))
+		if conn == "" && conns != nil || conn != "" && (len(conns) != 1 || conns[0] != conn) {
+			t.Fatalf("bad: %s to %v", dst, conns)
+		}
+	}
+	// ipv4 packets carry 4 bytes addresses
+	if conns := table.lookup(net.ParseIP("192.168.10.20").To4()); len(conns) != 1 || conns[0] != "b" {
+		t.Fatalf("bad: %v", conns)
+	}
+}
+
+func TestRouteTable_Conflict(t *testing.T) {
+	table := newRouteTable()
+	prefix := mustPrefix(t, "192.168.10.0/24")
+	if added, err := table.add(prefix, "10.4.4.3", "", "a1", true); !added || err != nil {
+		t.Fatalf("bad: %v %v", added, err)
+	}
+	if added, err := table.add(prefix, "10.4.4.3", "", "a2", true); added || err != nil {
+		t.Fatalf("bad: %v %v", added, err)
+	}
+	if _, err := table.add(prefix, "10.4.4.4", "", "b", true); err == nil {
+		t.Fatalf("bad: prefix of another client taken")
+	}
+	if conns := table.lookup(net.ParseIP("192.168.10.1")); len(conns) != 2 {
+		t.Fatalf("bad: %v", conns)
+	}
+
+	// the prefix is free once its owner is gone
+	if removed := table.removeConn("a1"); len(removed) != 0 {
+		t.Fatalf("bad: %d routes removed", len(removed))
+	}
+	removed := table.removeConn("a2")
+	if len(removed) != 1 || !removed[0].advertised || removed[0].prefix.String() != "192.168.10.0/24" {
+		t.Fatalf("bad: %v", removed)
+	}
+	if conns := table.lookup(net.ParseIP("192.168.10.1")); conns != nil {
+		t.Fatalf("bad: %v", conns)
+	}
+	if len(table.lengths[0]) != 0 {
+		t.Fatalf("bad: %v", table.lengths)
+	}
+	if added, err := table.add(prefix, "10.4.4.4", "", "b", true); !added || err != nil {
+		t.Fatalf("bad: %v %v", added, err)
+	}
+}
+
+func TestRouteTable_Identity(t *testing.T) {
+	table := newRouteTable()
+	host := hostPrefix(net.ParseIP("10.4.4.3"))
+	if _, err := table.add(host, "10.4.4.3", "alice", "a", false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := table.add(host, "10.4.4.3", "alice", "a2", false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := table.add(host, "10.4.4.3", "eve", "e", false); err == nil {
+		t.Fatalf("bad: ip of alice taken by eve")
+	}
+	if owner, ok := table.ownerOf(net.ParseIP("10.4.4.3")); !ok || owner != "10.4.4.3" {
+		t.Fatalf("bad: %s %v", owner, ok)
+	}
+}
+
+func TestRouteTable_Instance(t *testing.T) {
+	// without client certificates only the instance tells the clients apart
+	table := newRouteTable()
+	host := hostPrefix(net.ParseIP("10.4.4.3"))
+	alice, eve := routeHolder("", []byte{1}), routeHolder("", []byte{2})
+	if _, err := table.add(host, "10.4.4.3", alice, "a", false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := table.add(host, "10.4.4.3", alice, "a2", false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := table.add(host, "10.4.4.3", eve, "e", false); err == nil {
+		t.Fatalf("bad: ip of alice taken by another instance")
+	}
+	if conns := table.lookup(net.ParseIP("10.4.4.3")); len(conns) != 2 {
+		t.Fatalf("bad: %v", conns)
+	}
+}
+
+func testPacket(src, dst string) iface.PacketIP {
+	pkt := iface.NewPacketIP(20)
+	pkt[0] = 0x45
+	copy(pkt[12:16], net.ParseIP(src).To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	return pkt
+}
+
+func TestApp_AllowSource(t *testing.T) {
+	app := &App{routes: newRouteTable(), owners: make(map[*transport.ServerConn]binding)}
+	a, b := &transport.ServerConn{}, &transport.ServerConn{}
+	app.routes.add(hostPrefix(net.ParseIP("10.4.4.3")), "10.4.4.3", "", "a", false)
+	app.routes.add(mustPrefix(t, "192.168.10.0/24"), "10.4.4.3", "", "a", true)
+	app.routes.add(hostPrefix(net.ParseIP("10.4.4.4")), "10.4.4.4", "", "b", false)
+
+	if app.allowSource(testPacket("10.4.4.3", "10.4.4.2"), a) {
+		t.Fatalf("bad: packet accepted before the ping")
+	}
+	if !app.bind(a, "10.4.4.3", "10.4.4.3/24:1000") || !app.bind(b, "10.4.4.4", "10.4.4.4/24:1000") {
+		t.Fatalf("bad: bind fail")
+	}
+	if app.bind(a, "10.4.4.5", "10.4.4.5/24:1000") {
+		t.Fatalf("bad: connection bound to another ip")
+	}
+
+	for _, v := range []struct {
+		src  string
+		conn *transport.ServerConn
+		ok   bool
+	}{
+		{"10.4.4.3", a, true},
+		{"192.168.10.7", a, true},
+		{"10.4.4.4", b, true},
+		{"10.4.4.3", b, false},
+		{"192.168.10.7", b, false},
+		{"8.8.8.8", a, false},
+	} {
+		if app.allowSource(testPacket(v.src, "10.4.4.2"), v.conn) != v.ok {
+			t.Fatalf("bad: %s expect %v", v.src, v.ok)
+		}
+	}
+}
+
+func TestApp_Bind(t *testing.T) {
+	app := &App{owners: make(map[*transport.ServerConn]binding)}
+	a, b := &transport.ServerConn{}, &transport.ServerConn{}
+
+	if app.bind(a, "10.4.4.3", "10.4.4.4/24:1000") {
+		t.Fatalf("bad: key of another ip accepted")
+	}
+	if app.bind(a, "10.4.4.3", "garbage") {
+		t.Fatalf("bad: invalid key accepted")
+	}
+	if !app.bind(a, "10.4.4.3", "10.4.4.3/24:1000") {
+		t.Fatalf("bad: bind fail")
+	}
+	if !app.bind(a, "10.4.4.3", "10.4.4.3/24:1000") {
+		t.Fatalf("bad: same key refused")
+	}
+	if app.bind(a, "10.4.4.3", "10.4.4.3/24:1001") {
+		t.Fatalf("bad: second key registered on a connection")
+	}
+	if !app.bind(b, "fd00::3", "fd00::3/64:1000") {
+		t.Fatalf("bad: bind ipv6 fail")
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := parsePrefixes(" 192.168.10.1/24, fd00::/64,")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(prefixes) != 2 || prefixes[0].String() != "192.168.10.0/24" || prefixes[1].String() != "fd00::/64" {
+		t.Fatalf("bad: %v", prefixes)
+	}
+	if _, err := parsePrefixes("192.168.10.0"); err == nil {
+		t.Fatalf("bad: invalid prefix accepted")
+	}
+}
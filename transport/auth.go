@@ -0,0 +1,193 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Authorizer maps a verified client certificate to an identity, which is
+// the subject common name, and decides which tunnel ips the identity may
+// claim in its ping
+//
+// acl file, one identity per line, followed by the cidrs it may claim, the
+// subnets it advertises have to be inside them as well:
+//
+//	alice-laptop 10.4.4.3/32
+//	office-gw    10.4.4.10/32,10.4.4.11/32
+//
+// revoked file, one identity or certificate serial (serial:hex) per line,
+// it's reloaded when modified so a client can be revoked without restart
+type Authorizer struct {
+	acl         map[string][]*net.IPNet
+	revokedFile string
+	revoked     map[string]struct{}
+	revokedMod  time.Time
+	mutex       sync.Mutex
+}
+
+func LoadAuthorizer(aclFile, revokedFile string) (*Authorizer, error) {
+	a := &Authorizer{
+		revokedFile: revokedFile,
+		revoked:     make(map[string]struct{}),
+	}
+
+	if aclFile != "" {
+		acl, err := loadACL(aclFile)
+		if err != nil {
+			return nil, err
+		}
+		a.acl = acl
+	}
+
+	if revokedFile != "" {
+		err := a.reloadRevoked()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func readLines(file string) ([][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := [][]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.Fields(line))
+	}
+	return lines, scanner.Err()
+}
+
+func loadACL(file string) (map[string][]*net.IPNet, error) {
+	lines, err := readLines(file)
+	if err != nil {
+		return nil, fmt.Errorf("load acl fail: %s", err)
+	}
+
+	acl := make(map[string][]*net.IPNet)
+	for _, fields := range lines {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid acl line %q, expect: identity cidr[,cidr]", strings.Join(fields, " "))
+		}
+		for _, cidr := range strings.Split(fields[1], ",") {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid acl cidr %q of %s: %s", cidr, fields[0], err)
+			}
+			acl[fields[0]] = append(acl[fields[0]], ipNet)
+		}
+	}
+	return acl, nil
+}
+
+func (a *Authorizer) reloadRevoked() error {
+	info, err := os.Stat(a.revokedFile)
+	if err != nil {
+		return fmt.Errorf("load revocation list fail: %s", err)
+	}
+	if info.ModTime().Equal(a.revokedMod) {
+		return nil
+	}
+
+	lines, err := readLines(a.revokedFile)
+	if err != nil {
+		return fmt.Errorf("load revocation list fail: %s", err)
+	}
+	revoked := make(map[string]struct{})
+	for _, fields := range lines {
+		revoked[strings.ToLower(fields[0])] = struct{}{}
+	}
+
+	a.revoked = revoked
+	a.revokedMod = info.ModTime()
+	log.Info().Str("file", a.revokedFile).Int("size", len(revoked)).Msg("revocation list loaded")
+	return nil
+}
+
+// Identify is called on every new session, the certificate has already
+// been verified against the client ca by the tls handshake
+func (a *Authorizer) Identify(certs []*x509.Certificate) (string, error) {
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no client certificate")
+	}
+	cert := certs[0]
+	identity := cert.Subject.CommonName
+	if identity == "" {
+		return "", fmt.Errorf("client certificate has no common name")
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.revokedFile != "" {
+		err := a.reloadRevoked()
+		if err != nil {
+			// keep using the last list rather than letting everyone in
+			log.Error().Err(err).Msg("reload revocation list fail")
+		}
+	}
+
+	serial := "serial:" + strings.ToLower(cert.SerialNumber.Text(16))
+	if _, ok := a.revoked[strings.ToLower(identity)]; ok {
+		return "", fmt.Errorf("client %s is revoked", identity)
+	}
+	if _, ok := a.revoked[serial]; ok {
+		return "", fmt.Errorf("client %s certificate %s is revoked", identity, serial)
+	}
+	return identity, nil
+}
+
+// AllowIP tells if identity may claim ip, everyone may claim any ip when
+// there is no acl
+func (a *Authorizer) AllowIP(identity string, ip net.IP) bool {
+	if a.acl == nil {
+		return true
+	}
+	for _, ipNet := range a.acl[identity] {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prefixes returns the cidrs identity may claim, ok is false when there
+// is no acl and any ip may be claimed
+func (a *Authorizer) Prefixes(identity string) (prefixes []*net.IPNet, ok bool) {
+	if a.acl == nil {
+		return nil, false
+	}
+	return a.acl[identity], true
+}
+
+// AllowPrefix tells if identity may advertise prefix, which has to be
+// inside one of its cidrs
+func (a *Authorizer) AllowPrefix(identity string, prefix *net.IPNet) bool {
+	if a.acl == nil {
+		return true
+	}
+	ones, _ := prefix.Mask.Size()
+	for _, ipNet := range a.acl[identity] {
+		bits, _ := ipNet.Mask.Size()
+		if bits <= ones && ipNet.Contains(prefix.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthorizer(t *testing.T) {
+	dir := t.TempDir()
+	aclFile := filepath.Join(dir, "acl")
+	revokedFile := filepath.Join(dir, "revoked")
+
+	os.WriteFile(aclFile, []byte("# comment\nalice 10.4.4.3/32\nbob 10.4.4.10/32,10.4.5.0/24\n"), 0644)
+	os.WriteFile(revokedFile, []byte(""), 0644)
+
+	auth, err := LoadAuthorizer(aclFile, revokedFile)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	alice := []*x509.Certificate{{Subject: pkix.Name{CommonName: "alice"}, SerialNumber: big.NewInt(0xab)}}
+	identity, err := auth.Identify(alice)
+	if err != nil || identity != "alice" {
+		t.Fatalf("bad: %s %v", identity, err)
+	}
+
+	if !auth.AllowIP("alice", net.ParseIP("10.4.4.3")) {
+		t.Fatalf("alice should claim 10.4.4.3")
+	}
+	if auth.AllowIP("alice", net.ParseIP("10.4.4.10")) {
+		t.Fatalf("alice should not claim 10.4.4.10")
+	}
+	if !auth.AllowIP("bob", net.ParseIP("10.4.5.7")) {
+		t.Fatalf("bob should claim 10.4.5.7")
+	}
+	if auth.AllowIP("eve", net.ParseIP("10.4.4.3")) {
+		t.Fatalf("unknown identity should claim nothing")
+	}
+	if prefixes, ok := auth.Prefixes("bob"); !ok || len(prefixes) != 2 || prefixes[1].String() != "10.4.5.0/24" {
+		t.Fatalf("bad: %v %v", prefixes, ok)
+	}
+	if prefixes, ok := auth.Prefixes("eve"); !ok || len(prefixes) != 0 {
+		t.Fatalf("bad: %v %v", prefixes, ok)
+	}
+
+	_, inside, _ := net.ParseCIDR("10.4.5.128/25")
+	_, wider, _ := net.ParseCIDR("10.4.0.0/16")
+	if !auth.AllowPrefix("bob", inside) {
+		t.Fatalf("bob should advertise 10.4.5.128/25")
+	}
+	if auth.AllowPrefix("bob", wider) {
+		t.Fatalf("bob should not advertise 10.4.0.0/16")
+	}
+
+	// revoke by serial, the list is reloaded on the next session
+	os.WriteFile(revokedFile, []byte("serial:AB\n"), 0644)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(revokedFile, later, later)
+	if _, err := auth.Identify(alice); err == nil {
+		t.Fatalf("alice should be revoked")
+	}
+
+	if _, err := auth.Identify(nil); err == nil {
+		t.Fatalf("expected error without certificate")
+	}
+}
+
+func TestAuthorizer_NoACL(t *testing.T) {
+	auth, err := LoadAuthorizer("", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !auth.AllowIP("anyone", net.ParseIP("10.4.4.3")) {
+		t.Fatalf("everyone may claim any ip without acl")
+	}
+	if _, ok := auth.Prefixes("anyone"); ok {
+		t.Fatalf("everyone may claim any ip without acl")
+	}
+}
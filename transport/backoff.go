@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/matthewgao/qtun/config"
+)
+
+const (
+	reconnectMin = 500 * time.Millisecond
+	// the wait is randomized by this fraction either way
+	reconnectJitter = 0.2
+	// a connection which lived this long resets the backoff, one which
+	// keeps dying right after the handshake doesn't
+	reconnectStable = 30 * time.Second
+)
+
+// backoff is the wait before the next reconnect, it doubles on every
+// failure from reconnectMin up to max. The jitter keeps the clients of a
+// restarted server from coming back all at once
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	jitter  float64
+	attempt uint
+}
+
+// newBackoff reads --reconnect_max, zero falls back to the min interval
+func newBackoff() *backoff {
+	max := reconnectMin
+	if cfg := config.GetInstance(); cfg != nil && cfg.ReconnectMax > 0 {
+		max = time.Duration(cfg.ReconnectMax) * time.Second
+	}
+	return &backoff{min: reconnectMin, max: max, jitter: reconnectJitter}
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 && b.min<<b.attempt < b.max {
+		d = b.min << b.attempt
+		b.attempt++
+	}
+
+	delta := float64(d) * b.jitter
+	return time.Duration(float64(d) - delta + rand.Float64()*2*delta)
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,44 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{min: 100 * time.Millisecond, max: time.Second}
+
+	expect := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, e := range expect {
+		if d := b.next(); d != e*time.Millisecond {
+			t.Fatalf("bad: %d %v", i, d)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d != 100*time.Millisecond {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestBackoff_Jitter(t *testing.T) {
+	b := &backoff{min: time.Second, max: time.Second, jitter: 0.2}
+
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		d := b.next()
+		if d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("bad: %v", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 10 {
+		t.Fatalf("bad: no jitter")
+	}
+}
+
+func TestBackoff_Config(t *testing.T) {
+	if b := newBackoff(); b.max != reconnectMin {
+		t.Fatalf("bad: %v", b.max)
+	}
+}
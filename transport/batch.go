@@ -0,0 +1,223 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// the field numbers of protocol.Envelope and protocol.MessageBatch
+	batchField    = 6
+	envelopeField = 1
+
+	defaultBatchSize = 16 * 1024
+)
+
+// BatchPolicy bounds how many packets the writer coalesces into one frame,
+// one seal and one write, which is most of the cost of a packet in bulk
+// transfers
+type BatchPolicy struct {
+	size  int
+	delay time.Duration
+}
+
+// NewBatchPolicy parses --batch_size and --batch_delay. A batch stops
+// growing at size bytes, 0 disables batching. With no delay only the
+// packets already queued are coalesced, otherwise the writer waits up to
+// delay microseconds for more
+func NewBatchPolicy(size, delay int) (*BatchPolicy, error) {
+	if size < 0 || size > maxFrameLimit {
+		return nil, fmt.Errorf("invalid batch size %d, expect 0 to %d", size, maxFrameLimit)
+	}
+	if delay < 0 {
+		return nil, fmt.Errorf("invalid batch delay %d", delay)
+	}
+	return &BatchPolicy{size: size, delay: time.Duration(delay) * time.Microsecond}, nil
+}
+
+// batcher belongs to the write process of one connection
+type batcher struct {
+	size  int
+	delay time.Duration
+	// limit keeps the batch frames within the max frame size of the peer
+	limit   int
+	packets [][]byte
+	buf     []byte
+	timer   *time.Timer
+}
+
+func newBatcher(policy *BatchPolicy) *batcher {
+	if policy == nil {
+		policy = &BatchPolicy{size: defaultBatchSize}
+	}
+	b := &batcher{size: policy.size, delay: policy.delay}
+	b.setLimit(defaultMaxFrame)
+	return b
+}
+
+// setLimit takes the max frame size of the peer, told in the handshake
+func (b *batcher) setLimit(maxFrame int) {
+	b.limit = maxFrame - frameOverhead - protowire.SizeTag(batchField) - binary.MaxVarintLen32
+}
+
+func batchEntrySize(p []byte) int {
+	return protowire.SizeTag(envelopeField) + protowire.SizeBytes(len(p)-frameHeaderSize)
+}
+
+// collect takes more packets from q after first, and returns them as one
+// batch envelope, or first alone when nothing else is waiting. A packet
+// which doesn't fit into the frame any more is returned as next, it starts
+// the next batch. Like the packets the result has the frame headroom in
+// front, it's only valid until release
+func (b *batcher) collect(first []byte, q *sendQueue) (batch, next []byte) {
+	b.packets = append(b.packets[:0], first)
+	if b.size == 0 {
+		return first, nil
+	}
+
+	total, size := len(first)-frameHeaderSize, batchEntrySize(first)
+	var deadline <-chan time.Time
+	for total < b.size {
+		var data []byte
+		var ok bool
+		select {
+		case data, ok = <-q.ch:
+		default:
+			if b.delay == 0 {
+				return b.marshal(), nil
+			}
+			if deadline == nil {
+				deadline = b.startTimer()
+			}
+			select {
+			case data, ok = <-q.ch:
+			case <-deadline:
+				return b.marshal(), nil
+			}
+		}
+		if !ok {
+			// closed, the write process finds out on its next read
+			break
+		}
+		q.taken()
+		if size+batchEntrySize(data) > b.limit {
+			next = data
+			break
+		}
+		b.packets = append(b.packets, data)
+		total += len(data) - frameHeaderSize
+		size += batchEntrySize(data)
+	}
+	if deadline != nil && !b.timer.Stop() {
+		<-b.timer.C
+	}
+	return b.marshal(), next
+}
+
+func (b *batcher) startTimer() <-chan time.Time {
+	if b.timer == nil {
+		b.timer = time.NewTimer(b.delay)
+	} else {
+		b.timer.Reset(b.delay)
+	}
+	return b.timer.C
+}
+
+// marshal builds the protocol.Envelope of a protocol.MessageBatch by hand,
+// the packets are already marshaled and proto.Marshal would copy them twice
+func (b *batcher) marshal() []byte {
+	if len(b.packets) == 1 {
+		return b.packets[0]
+	}
+	stats.Add(statBatchFrames, 1)
+	stats.Add(statBatchPackets, int64(len(b.packets)))
+
+	size := 0
+	for _, p := range b.packets {
+		size += batchEntrySize(p)
+	}
+	need := frameHeaderSize + protowire.SizeTag(batchField) + protowire.SizeBytes(size) + frameOverhead
+	if cap(b.buf) < need {
+		b.buf = make([]byte, 0, need)
+	}
+	b.buf = b.buf[:frameHeaderSize]
+	b.buf = protowire.AppendTag(b.buf, batchField, protowire.BytesType)
+	b.buf = protowire.AppendVarint(b.buf, uint64(size))
+	for _, p := range b.packets {
+		b.buf = protowire.AppendTag(b.buf, envelopeField, protowire.BytesType)
+		b.buf = protowire.AppendBytes(b.buf, p[frameHeaderSize:])
+	}
+	return b.buf
+}
+
+// release gives the collected packets back to the pool once the result of
+// collect is written
+func (b *batcher) release() {
+	for i, p := range b.packets {
+		freePacketBuf(p)
+		b.packets[i] = nil
+	}
+	b.packets = b.packets[:0]
+}
+
+// unbatch calls deliver with every envelope of a batch, it returns false
+// when data is not a batch. Only the tags are parsed, the envelopes point
+// into data. The batcher never nests batches, deliver would unbatch the
+// inner one again without a bound, so a frame with one is dropped whole
+func unbatch(data []byte, deliver func([]byte)) bool {
+	num, typ, n := protowire.ConsumeTag(data)
+	if n < 0 || num != batchField || typ != protowire.BytesType {
+		return false
+	}
+	batch, n := protowire.ConsumeBytes(data[n:])
+	if n < 0 {
+		return true
+	}
+
+	nested := !eachEnvelope(batch, func(envelope []byte) bool {
+		num, typ, n := protowire.ConsumeTag(envelope)
+		return n < 0 || num != batchField || typ != protowire.BytesType
+	})
+	if nested {
+		stats.Add(statBatchNested, 1)
+		return true
+	}
+	eachEnvelope(batch, func(envelope []byte) bool {
+		deliver(envelope)
+		return true
+	})
+	return true
+}
+
+// eachEnvelope calls fn with the envelopes of batch until it returns false,
+// in which case eachEnvelope returns false too. It stops at the first entry
+// which can't be parsed
+func eachEnvelope(batch []byte, fn func([]byte) bool) bool {
+	for len(batch) > 0 {
+		num, typ, n := protowire.ConsumeTag(batch)
+		if n < 0 {
+			return true
+		}
+		batch = batch[n:]
+		if num != envelopeField || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, batch)
+			if n < 0 {
+				return true
+			}
+			batch = batch[n:]
+			continue
+		}
+		envelope, n := protowire.ConsumeBytes(batch)
+		if n < 0 {
+			return true
+		}
+		batch = batch[n:]
+		if !fn(envelope) {
+			return false
+		}
+	}
+	return true
+}
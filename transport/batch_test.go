@@ -0,0 +1,212 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/matthewgao/qtun/protocol"
+)
+
+func TestNewBatchPolicy(t *testing.T) {
+	policy, err := NewBatchPolicy(1024, 50)
+	if err != nil || policy.size != 1024 || policy.delay != 50*time.Microsecond {
+		t.Fatalf("bad: %+v %v", policy, err)
+	}
+	for _, size := range []int{-1, maxFrameLimit + 1} {
+		if _, err := NewBatchPolicy(size, 0); err == nil {
+			t.Fatalf("bad: size %d accepted", size)
+		}
+	}
+	if _, err := NewBatchPolicy(1024, -1); err == nil {
+		t.Fatalf("bad: negative delay accepted")
+	}
+}
+
+// queued is a packet as WritePacket takes it
+func queued(data string) []byte {
+	return append(newPacketBuf(len(data)), data...)
+}
+
+func TestBatcher_Collect(t *testing.T) {
+	q := newSendQueue(nil)
+	depth := statValue(statQueueDepth)
+	q.push(queued("b"))
+	q.push(queued("c"))
+
+	b := newBatcher(nil)
+	data, _ := b.collect(queued("a"), q)
+	envelope := protocol.Envelope{}
+	if err := proto.Unmarshal(data[frameHeaderSize:], &envelope); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := envelope.GetBatch().GetEnvelopes()
+	if len(out) != 3 || string(out[0]) != "a" || string(out[1]) != "b" || string(out[2]) != "c" {
+		t.Fatalf("bad: %q", out)
+	}
+	if statValue(statQueueDepth) != depth {
+		t.Fatalf("bad: depth %d", statValue(statQueueDepth)-depth)
+	}
+	b.release()
+
+	// nothing else is waiting, the packet goes alone
+	if data, _ := b.collect(queued("a"), q); string(data[frameHeaderSize:]) != "a" {
+		t.Fatalf("bad: %q", data)
+	}
+	b.release()
+}
+
+func TestBatcher_Size(t *testing.T) {
+	q := newSendQueue(nil)
+	q.push(queued("bb"))
+	q.push(queued("cc"))
+
+	b := newBatcher(&BatchPolicy{size: 3})
+	data, _ := b.collect(queued("aa"), q)
+	n := 0
+	if !unbatch(data[frameHeaderSize:], func([]byte) { n++ }) || n != 2 || len(q.ch) != 1 {
+		t.Fatalf("bad: %d in the batch, %d left", n, len(q.ch))
+	}
+	b.release()
+
+	b = newBatcher(&BatchPolicy{size: 0})
+	if data, _ := b.collect(queued("aa"), q); string(data[frameHeaderSize:]) != "aa" || len(q.ch) != 1 {
+		t.Fatalf("bad: batched with batching disabled")
+	}
+	b.release()
+	<-q.ch
+	q.taken()
+}
+
+func TestBatcher_Limit(t *testing.T) {
+	q := newSendQueue(nil)
+	q.push(queued(strings.Repeat("b", 3000)))
+	q.push(queued("c"))
+
+	// the second packet would make the frame larger than the peer accepts
+	b := newBatcher(nil)
+	b.setLimit(minMaxFrame)
+	data, next := b.collect(queued(strings.Repeat("a", 3000)), q)
+	if len(data)-frameHeaderSize != 3000 || len(next)-frameHeaderSize != 3000 {
+		t.Fatalf("bad: %d, next %d", len(data), len(next))
+	}
+	b.release()
+
+	// and starts the next batch
+	n := 0
+	data, next = b.collect(next, q)
+	if !unbatch(data[frameHeaderSize:], func([]byte) { n++ }) || n != 2 || next != nil {
+		t.Fatalf("bad: %d in the batch", n)
+	}
+	b.release()
+}
+
+func TestBatcher_Delay(t *testing.T) {
+	q := newSendQueue(nil)
+	b := newBatcher(&BatchPolicy{size: defaultBatchSize, delay: 100 * time.Millisecond})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.push(queued("b"))
+	}()
+
+	n := 0
+	data, _ := b.collect(queued("a"), q)
+	if !unbatch(data[frameHeaderSize:], func([]byte) { n++ }) || n != 2 {
+		t.Fatalf("bad: %d in the batch", n)
+	}
+	b.release()
+}
+
+func TestUnbatch(t *testing.T) {
+	packet := newBond(nil).marshalPacket(CopyPacket([]byte("hello")))[frameHeaderSize:]
+	data, _ := proto.Marshal(&protocol.Envelope{
+		Type: &protocol.Envelope_Batch{
+			Batch: &protocol.MessageBatch{Envelopes: [][]byte{packet, marshalProbe(1, false)}},
+		},
+	})
+
+	out := [][]byte{}
+	if !unbatch(data, func(data []byte) { out = append(out, data) }) {
+		t.Fatalf("bad: batch not found")
+	}
+	if len(out) != 2 || packetSeq(out[0]) != 1 || !bytes.Equal(out[1], marshalProbe(1, false)) {
+		t.Fatalf("bad: %q", out)
+	}
+	if unbatch(packet, func([]byte) {}) {
+		t.Fatalf("bad: packet taken for a batch")
+	}
+}
+
+func TestUnbatch_Nested(t *testing.T) {
+	packet := newBond(nil).marshalPacket(CopyPacket([]byte("hello")))[frameHeaderSize:]
+	batch := func(envelopes ...[]byte) []byte {
+		data, _ := proto.Marshal(&protocol.Envelope{
+			Type: &protocol.Envelope_Batch{
+				Batch: &protocol.MessageBatch{Envelopes: envelopes},
+			},
+		})
+		return data
+	}
+
+	nested := statValue(statBatchNested)
+	n := 0
+	if !unbatch(batch(packet, batch(packet)), func([]byte) { n++ }) || n != 0 {
+		t.Fatalf("bad: %d envelopes of a nested batch delivered", n)
+	}
+	if statValue(statBatchNested) != nested+1 {
+		t.Fatalf("bad: nested batch not counted")
+	}
+
+	// the inner batches are never looked at
+	data := packet
+	for i := 0; i < 1000; i++ {
+		data = batch(data)
+	}
+	sc := &ServerConn{}
+	sc.deliver(data)
+	if statValue(statBatchNested) != nested+2 {
+		t.Fatalf("bad: nested batch not counted")
+	}
+}
+
+// benchmarkWrite sends 1400 byte packets, the tun readers have queued up to
+// 16 of them every time the writer wakes up
+func benchmarkWrite(b *testing.B, size int) {
+	keys, _, err, _ := runHandshake("hello-world", "hello-world", nil, nil)
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	pkt := make([]byte, 1400)
+	q := newSendQueue(nil)
+	batch := newBatcher(&BatchPolicy{size: size})
+
+	b.SetBytes(int64(len(pkt)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 16 {
+		for j := i; j < i+16 && j < b.N; j++ {
+			q.push(newRawPacket(0, pkt))
+		}
+		for len(q.ch) > 0 {
+			data := <-q.ch
+			q.taken()
+			for data != nil {
+				var frame []byte
+				frame, data = batch.collect(data, q)
+				io.Discard.Write(sealInPlace(frame, keys.send, 0))
+				batch.release()
+			}
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchmarkWrite(b, 0)
+}
+
+func BenchmarkWrite_Batch(b *testing.B) {
+	benchmarkWrite(b, defaultBatchSize)
+}
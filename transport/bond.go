@@ -0,0 +1,454 @@
+package transport
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/matthewgao/qtun/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// bonding turns all the connections of a client into one session, e.g. one
+// over the wired uplink and one over lte. The client sends a random session
+// id in the handshake of every connection, the server groups the connections
+// with the same id. Each side numbers the packets of the session, spreads
+// them over the connections by the rtt and loss measured with probes, and
+// the other side puts them back in order before they reach the tun device,
+// so the inner tcp doesn't take the reordering for loss
+const (
+	// the field numbers of protocol.Envelope and protocol.MessagePacket
+	packetField = 2
+	seqField    = 2
+	probeField  = 5
+
+	sessionIDSize = 16
+	probeInterval = time.Second
+	// the rtt of a path before its first probe comes back
+	initialRTT = 100 * time.Millisecond
+	// a missing packet is given up after reorderTimeout, or when
+	// reorderWindow packets are waiting behind it
+	reorderTimeout = 50 * time.Millisecond
+	reorderWindow  = 1024
+)
+
+func newSessionID() ([]byte, error) {
+	session := make([]byte, sessionIDSize)
+	_, err := io.ReadFull(crand.Reader, session)
+	return session, err
+}
+
+// bond is one bonded session, the client has one for all its connections,
+// the server one per session id
+type bond struct {
+	session []byte
+	seq     uint64
+	mutex   sync.Mutex
+	reorder *reorderBuffer
+	// the reorder buffers of the client, one per epoch of the server
+	// sessions its connections are in. A server numbers the packets from 1
+	// again when it starts the session over, e.g. after a restart
+	epochs map[uint64]*epochReorder
+}
+
+type epochReorder struct {
+	*reorderBuffer
+	conns int
+}
+
+func newBond(session []byte) *bond {
+	return &bond{
+		session: session,
+		reorder: newReorderBuffer(),
+		epochs:  make(map[uint64]*epochReorder),
+	}
+}
+
+// newEpoch is random, so it changes when the server restarts as well
+func newEpoch() uint64 {
+	b := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(crand.Reader, b)
+		if epoch := binary.BigEndian.Uint64(b); err == nil && epoch != 0 {
+			return epoch
+		}
+	}
+}
+
+// attach moves a connection of the client from the epoch old, 0 for none,
+// to epoch, which the server echoes in the handshake, and returns the
+// reorder buffer of the epoch
+func (b *bond) attach(old, epoch uint64) *reorderBuffer {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if e, ok := b.epochs[old]; ok && old != 0 {
+		e.conns--
+		if e.conns == 0 {
+			delete(b.epochs, old)
+		}
+	}
+	e, ok := b.epochs[epoch]
+	if !ok {
+		e = &epochReorder{reorderBuffer: newReorderBuffer()}
+		b.epochs[epoch] = e
+	}
+	e.conns++
+	return e.reorderBuffer
+}
+
+func (b *bond) nextSeq() uint64 {
+	return atomic.AddUint64(&b.seq, 1)
+}
+
+// pick schedules the next packet with smooth weighted round robin, the
+// weight of a path is its delivery rate over its rtt, so a path twice as
+// fast gets twice the packets. path returns the n paths, nil for the ones
+// which are down, so the caller doesn't build a list for every packet. It
+// returns -1 when all of them are down
+func (b *bond) pick(n int, path func(i int) *pathStats) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	best := -1
+	var bestPath *pathStats
+	total := 0.0
+	for i := 0; i < n; i++ {
+		p := path(i)
+		if p == nil {
+			continue
+		}
+		w := p.weight()
+		p.credit += w
+		total += w
+		if best < 0 || p.credit > bestPath.credit {
+			best, bestPath = i, p
+		}
+	}
+	if bestPath != nil {
+		bestPath.credit -= total
+	}
+	return best
+}
+
+func (b *bond) marshalPacket(pkt Packet) []byte {
+	return pkt.frame(b.nextSeq())
+}
+
+// pathStats is the rtt and loss of one connection, measured by a probe
+// every probeInterval
+type pathStats struct {
+	mutex   sync.Mutex
+	srtt    time.Duration
+	loss    float64
+	pending int64
+	// credit is guarded by the mutex of the bond
+	credit float64
+}
+
+func (p *pathStats) reset() {
+	p.mutex.Lock()
+	p.srtt, p.loss, p.pending = 0, 0, 0
+	p.mutex.Unlock()
+}
+
+// probe returns the timestamp of the next probe, the last one is lost if
+// it's still waiting for the reply
+func (p *pathStats) probe(now time.Time) int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.pending != 0 {
+		p.loss = p.loss*7/8 + 1.0/8
+	}
+	p.pending = now.UnixNano()
+	return p.pending
+}
+
+func (p *pathStats) reply(timestamp int64, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if timestamp != p.pending {
+		// too late, it has been counted as lost
+		return
+	}
+	p.pending = 0
+	p.loss = p.loss * 7 / 8
+
+	rtt := time.Duration(now.UnixNano() - timestamp)
+	if p.srtt == 0 {
+		p.srtt = rtt
+	} else {
+		p.srtt = (p.srtt*7 + rtt) / 8
+	}
+}
+
+func (p *pathStats) weight() float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	srtt := p.srtt
+	if srtt <= 0 {
+		srtt = initialRTT
+	}
+	// a path losing everything still gets a trickle, so it can recover
+	return (1 - p.loss + 0.01) / srtt.Seconds()
+}
+
+// handleProbe tells if data is a probe and handles it, a probe from the
+// peer is answered through reply
+func (p *pathStats) handleProbe(data []byte, reply chan<- int64) (bool, error) {
+	num, typ, n := protowire.ConsumeTag(data)
+	if n < 0 || num != probeField || typ != protowire.BytesType {
+		return false, nil
+	}
+
+	envelope := protocol.Envelope{}
+	err := proto.Unmarshal(data, &envelope)
+	if err != nil {
+		return true, err
+	}
+	probe := envelope.GetProbe()
+	if probe.GetReply() {
+		p.reply(probe.GetTimestamp(), time.Now())
+		return true, nil
+	}
+
+	select {
+	case reply <- probe.GetTimestamp():
+	default:
+		// the writer is busy, the peer counts it as lost
+	}
+	return true, nil
+}
+
+func marshalProbe(timestamp int64, reply bool) []byte {
+	data, _ := proto.Marshal(&protocol.Envelope{
+		Type: &protocol.Envelope_Probe{
+			Probe: &protocol.MessageProbe{Timestamp: timestamp, Reply: reply},
+		},
+	})
+	return data
+}
+
+// packetSeq peeks the sequence number of a packet, 0 for everything else,
+// only the tags of an envelope are parsed so it's not unmarshaled twice
+func packetSeq(data []byte) uint64 {
+	if len(data) > 0 && data[0] == rawPacket {
+		seq, n := binary.Uvarint(data[1:])
+		if n <= 0 {
+			return 0
+		}
+		return seq
+	}
+
+	num, typ, n := protowire.ConsumeTag(data)
+	if n < 0 || num != packetField || typ != protowire.BytesType {
+		return 0
+	}
+	packet, n := protowire.ConsumeBytes(data[n:])
+	if n < 0 {
+		return 0
+	}
+
+	for len(packet) > 0 {
+		num, typ, n := protowire.ConsumeTag(packet)
+		if n < 0 {
+			return 0
+		}
+		packet = packet[n:]
+		if num == seqField && typ == protowire.VarintType {
+			seq, n := protowire.ConsumeVarint(packet)
+			if n < 0 {
+				return 0
+			}
+			return seq
+		}
+		n = protowire.ConsumeFieldValue(num, typ, packet)
+		if n < 0 {
+			return 0
+		}
+		packet = packet[n:]
+	}
+	return 0
+}
+
+type reorderEntry struct {
+	data    []byte
+	deliver func([]byte)
+}
+
+// reorderBuffer delivers the packets of a session in sequence order, it's
+// shared by the stream and datagram read processes of all the connections
+type reorderBuffer struct {
+	mutex   sync.Mutex
+	expect  uint64
+	pending map[uint64]reorderEntry
+	timer   *time.Timer
+}
+
+func newReorderBuffer() *reorderBuffer {
+	return &reorderBuffer{pending: make(map[uint64]reorderEntry)}
+}
+
+// push delivers data, or holds it until the packets before it arrive, data
+// is copied when it's held
+func (r *reorderBuffer) push(seq uint64, data []byte, deliver func([]byte)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.expect == 0 {
+		// the first packet of the session
+		r.expect = seq
+	}
+
+	if seq < r.expect {
+		// the gap has been given up already, let the inner tcp sort it out
+		stats.Add(statReorderLate, 1)
+		deliver(data)
+		return
+	}
+
+	if seq > r.expect {
+		if _, ok := r.pending[seq]; ok {
+			return
+		}
+		r.pending[seq] = reorderEntry{data: append([]byte(nil), data...), deliver: deliver}
+		if len(r.pending) >= reorderWindow {
+			r.skip()
+		} else if r.timer == nil {
+			r.timer = time.AfterFunc(reorderTimeout, r.timeout)
+		}
+		return
+	}
+
+	deliver(data)
+	r.expect++
+	r.drain()
+}
+
+func (r *reorderBuffer) drain() {
+	for {
+		e, ok := r.pending[r.expect]
+		if !ok {
+			break
+		}
+		delete(r.pending, r.expect)
+		e.deliver(e.data)
+		r.expect++
+	}
+
+	if len(r.pending) == 0 && r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// skip gives up the packets missing before the first one held
+func (r *reorderBuffer) skip() {
+	first := uint64(0)
+	for seq := range r.pending {
+		if first == 0 || seq < first {
+			first = seq
+		}
+	}
+	stats.Add(statReorderSkipped, int64(first-r.expect))
+	r.expect = first
+	r.drain()
+}
+
+func (r *reorderBuffer) timeout() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.timer = nil
+	if len(r.pending) == 0 {
+		return
+	}
+	r.skip()
+	if len(r.pending) > 0 {
+		r.timer = time.AfterFunc(reorderTimeout, r.timeout)
+	}
+}
+
+// bondTable groups the server connections by the identity and the session
+// id, a client can't join the session of another identity even with its id
+type bondTable struct {
+	mutex  sync.Mutex
+	groups map[string]*bondGroup
+}
+
+type bondGroup struct {
+	*bond
+	// echoed to the client in the handshake, a group made again for the
+	// same session has another one
+	epoch uint64
+	conns []*ServerConn
+}
+
+func newBondTable() *bondTable {
+	return &bondTable{groups: make(map[string]*bondGroup)}
+}
+
+func bondKey(identity string, session []byte) string {
+	return identity + "\x00" + string(session)
+}
+
+func (t *bondTable) join(session []byte, sc *ServerConn) *bondGroup {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := bondKey(sc.identity, session)
+	group, ok := t.groups[key]
+	if !ok {
+		group = &bondGroup{bond: newBond(session), epoch: newEpoch()}
+		t.groups[key] = group
+	}
+	group.conns = append(group.conns, sc)
+	return group
+}
+
+// leave forgets the session with its last connection, a client coming back
+// with the same session id starts over
+func (t *bondTable) leave(session []byte, sc *ServerConn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := bondKey(sc.identity, session)
+	group, ok := t.groups[key]
+	if !ok {
+		return
+	}
+	for i, conn := range group.conns {
+		if conn == sc {
+			group.conns = append(group.conns[:i], group.conns[i+1:]...)
+			break
+		}
+	}
+	if len(group.conns) == 0 {
+		delete(t.groups, key)
+	}
+}
+
+// pick returns the open connection of the group the next packet goes to,
+// nil when there is none
+func (t *bondTable) pick(group *bondGroup) *ServerConn {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	i := group.pick(len(group.conns), func(i int) *pathStats {
+		if group.conns[i].IsClosed() {
+			return nil
+		}
+		return group.conns[i].path
+	})
+	if i < 0 {
+		return nil
+	}
+	return group.conns[i]
+}
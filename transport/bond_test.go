@@ -0,0 +1,289 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/matthewgao/qtun/protocol"
+)
+
+func TestPacketSeq(t *testing.T) {
+	data := newBond(nil).marshalPacket(CopyPacket([]byte("hello")))
+	if seq := packetSeq(data[frameHeaderSize:]); seq != 1 {
+		t.Fatalf("bad: %d", seq)
+	}
+
+	data, _ = proto.Marshal(&protocol.Envelope{
+		Type: &protocol.Envelope_Packet{
+			Packet: &protocol.MessagePacket{Payload: []byte("hello"), Seq: 2},
+		},
+	})
+	if seq := packetSeq(data); seq != 2 {
+		t.Fatalf("bad: %d", seq)
+	}
+	data, _ = proto.Marshal(&protocol.Envelope{
+		Type: &protocol.Envelope_Packet{
+			Packet: &protocol.MessagePacket{Payload: []byte("hello")},
+		},
+	})
+	if seq := packetSeq(data); seq != 0 {
+		t.Fatalf("bad: %d", seq)
+	}
+	if seq := packetSeq(marshalProbe(1, false)); seq != 0 {
+		t.Fatalf("bad: %d", seq)
+	}
+}
+
+func TestReorderBuffer(t *testing.T) {
+	r := newReorderBuffer()
+	out := []string{}
+	deliver := func(data []byte) { out = append(out, string(data)) }
+
+	r.push(10, []byte("a"), deliver)
+	r.push(12, []byte("c"), deliver)
+	r.push(13, []byte("d"), deliver)
+	if len(out) != 1 {
+		t.Fatalf("bad: %v", out)
+	}
+	r.push(11, []byte("b"), deliver)
+	if len(out) != 4 || out[1] != "b" || out[2] != "c" || out[3] != "d" {
+		t.Fatalf("bad: %v", out)
+	}
+	if r.timer != nil || len(r.pending) != 0 {
+		t.Fatalf("bad: %d pending", len(r.pending))
+	}
+}
+
+func TestReorderBuffer_Timeout(t *testing.T) {
+	r := newReorderBuffer()
+	done := make(chan string, 4)
+	deliver := func(data []byte) { done <- string(data) }
+
+	r.push(1, []byte("a"), deliver)
+	r.push(3, []byte("c"), deliver)
+	<-done
+
+	// 2 is given up, and delivered anyway when it shows up late
+	select {
+	case out := <-done:
+		if out != "c" {
+			t.Fatalf("bad: %s", out)
+		}
+	case <-time.After(10 * reorderTimeout):
+		t.Fatalf("bad: still waiting for the gap")
+	}
+	late := statValue(statReorderLate)
+	r.push(2, []byte("b"), deliver)
+	if out := <-done; out != "b" || statValue(statReorderLate) != late+1 {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestBond_Pick(t *testing.T) {
+	b := newBond(nil)
+	fast := &pathStats{srtt: 10 * time.Millisecond}
+	slow := &pathStats{srtt: 20 * time.Millisecond}
+	lossy := &pathStats{srtt: 10 * time.Millisecond, loss: 0.99}
+
+	paths := []*pathStats{fast, nil, slow, lossy}
+
+	count := make([]int, 4)
+	for i := 0; i < 3000; i++ {
+		count[b.pick(len(paths), func(i int) *pathStats { return paths[i] })]++
+	}
+	if count[0] < 1900 || count[1] != 0 || count[2] < 900 || count[3] > 50 {
+		t.Fatalf("bad: %v", count)
+	}
+	if b.pick(1, func(int) *pathStats { return nil }) != -1 {
+		t.Fatalf("bad: picked a path which is down")
+	}
+}
+
+func TestPathStats(t *testing.T) {
+	p := &pathStats{}
+	now := time.Now()
+
+	ts := p.probe(now)
+	p.reply(ts, now.Add(40*time.Millisecond))
+	if p.srtt != 40*time.Millisecond || p.loss != 0 {
+		t.Fatalf("bad: %v %v", p.srtt, p.loss)
+	}
+
+	// the reply of a probe given up is ignored
+	old := p.probe(now)
+	p.probe(now.Add(time.Second))
+	p.reply(old, now.Add(time.Second))
+	if p.loss == 0 || p.srtt != 40*time.Millisecond {
+		t.Fatalf("bad: %v %v", p.srtt, p.loss)
+	}
+}
+
+func TestPathStats_Probe(t *testing.T) {
+	p := &pathStats{}
+	reply := make(chan int64, 1)
+
+	ok, err := p.handleProbe(marshalProbe(42, false), reply)
+	if !ok || err != nil {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if ts := <-reply; ts != 42 {
+		t.Fatalf("bad: %d", ts)
+	}
+
+	ts := p.probe(time.Now())
+	if ok, _ := p.handleProbe(marshalProbe(ts, true), reply); !ok || p.srtt == 0 {
+		t.Fatalf("bad: %v %v", ok, p.srtt)
+	}
+
+	data := newBond(nil).marshalPacket(CopyPacket([]byte("hello")))
+	if ok, _ := p.handleProbe(data[frameHeaderSize:], reply); ok {
+		t.Fatalf("bad: packet taken for a probe")
+	}
+}
+
+func TestHandshake_Session(t *testing.T) {
+	session, err := newSessionID()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, key := range []string{"hello-world", ""} {
+		c, s := net.Pipe()
+		done := make(chan []byte, 1)
+		go func() {
+			result, err := serverHandshake(s, bufio.NewReader(s), key, nil, true, &bytes.Buffer{}, make([]byte, 65536))
+			if err != nil {
+				done <- nil
+				return
+			}
+			done <- result.session
+		}()
+		_, err := clientHandshake(c, bufio.NewReader(c), key, &handshakeOffer{session: session}, &bytes.Buffer{}, make([]byte, 65536))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if got := <-done; !bytes.Equal(got, session) {
+			t.Fatalf("bad: %x", got)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestBondTable(t *testing.T) {
+	table := newBondTable()
+	a, b := &ServerConn{path: &pathStats{}}, &ServerConn{path: &pathStats{}}
+
+	group := table.join([]byte("session"), a)
+	if table.join([]byte("session"), b) != group {
+		t.Fatalf("bad: another group for the same session")
+	}
+	other := &ServerConn{path: &pathStats{}, identity: "other"}
+	if table.join([]byte("session"), other) == group {
+		t.Fatalf("bad: session joined by another identity")
+	}
+	table.leave([]byte("session"), other)
+	b.isClosed = true
+	for i := 0; i < 10; i++ {
+		if conn := table.pick(group); conn != a {
+			t.Fatalf("bad: %p", conn)
+		}
+	}
+	a.isClosed = true
+	if conn := table.pick(group); conn != nil {
+		t.Fatalf("bad: %p", conn)
+	}
+
+	table.leave([]byte("session"), a)
+	table.leave([]byte("session"), b)
+	if len(table.groups) != 0 {
+		t.Fatalf("bad: %d groups", len(table.groups))
+	}
+
+	// the session starts over with another epoch
+	if again := table.join([]byte("session"), a); again.epoch == 0 || again.epoch == group.epoch {
+		t.Fatalf("bad: epoch %d after %d", again.epoch, group.epoch)
+	}
+}
+
+func TestBond_Attach(t *testing.T) {
+	b := newBond(nil)
+	first := b.attach(0, 1)
+	if b.attach(0, 1) != first {
+		t.Fatalf("bad: another reorder buffer for the same epoch")
+	}
+
+	// the server has restarted, its packets are numbered from 1 again
+	first.push(1000, []byte("old"), func([]byte) {})
+	second := b.attach(1, 2)
+	if second == first {
+		t.Fatalf("bad: reorder buffer kept for a new epoch")
+	}
+	out := []string{}
+	second.push(1, []byte("new"), func(data []byte) { out = append(out, string(data)) })
+	if len(out) != 1 || out[0] != "new" || second.expect != 2 {
+		t.Fatalf("bad: %v", out)
+	}
+
+	b.attach(1, 2)
+	if len(b.epochs) != 1 || b.epochs[2].conns != 2 {
+		t.Fatalf("bad: %v", b.epochs)
+	}
+}
+
+func TestHandshake_Epoch(t *testing.T) {
+	session, err := newSessionID()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, key := range []string{"hello-world", ""} {
+		joined := []byte(nil)
+		server := &handshakeOffer{join: func(session []byte) uint64 {
+			joined = session
+			return 42
+		}}
+		client, _, err, serverErr := runHandshakeOffer(key, key, &handshakeOffer{session: session}, server, true)
+		if err != nil || serverErr != nil {
+			t.Fatalf("err: %v %v", err, serverErr)
+		}
+		if client.epoch != 42 || !bytes.Equal(joined, session) {
+			t.Fatalf("bad: epoch %d session %x", client.epoch, joined)
+		}
+	}
+
+	// a client with another key never joins
+	joined := false
+	server := &handshakeOffer{join: func(session []byte) uint64 {
+		joined = true
+		return 42
+	}}
+	_, _, _, serverErr := runHandshakeOffer("hello-world", "other-world", &handshakeOffer{session: session}, server, true)
+	if serverErr == nil || joined {
+		t.Fatalf("bad: client with another key joined, %v", serverErr)
+	}
+}
+
+func TestClient_EnableBond(t *testing.T) {
+	for _, v := range []struct {
+		addrs string
+		ok    bool
+	}{
+		{"1.1.1.1:8080", true},
+		{"1.1.1.1:8080,2.2.2.2:8080;priority=1", true},
+		{"1.1.1.1:8080,2.2.2.2:8080", false},
+	} {
+		endpoints, err := ParseEndpoints(v.addrs)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		err = NewClient(endpoints, "", 2, nil, nil, nil).EnableBond()
+		if (err == nil) != v.ok {
+			t.Fatalf("bad: %s %v", v.addrs, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+var ErrDatagramNotSupported = fmt.Errorf("datagram is not supported by the carrier")
+
+// the default alpn, see --alpn
+const alpn = "quic-echo-example"
+
+// Conn is one tunnel connection, a reliable stream which carries the framed
+// envelopes, plus unreliable datagrams when the carrier supports them
+type Conn interface {
+	io.ReadWriteCloser
+	SendDatagram([]byte) error
+	ReceiveDatagram() ([]byte, error)
+	SupportsDatagrams() bool
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	// PeerCertificates is empty unless the server asks for client certificates
+	PeerCertificates() []*x509.Certificate
+}
+
+type Listener interface {
+	Accept() (Conn, error)
+	Close() error
+}
+
+// Carrier moves the framed and encrypted envelopes between client and server,
+// so the same tunnel can run over quic, plain tcp with tls or websocket.
+// bind is the local address or interface to dial from, empty for any
+type Carrier interface {
+	Name() string
+	Dial(addr, bind string, tlsConf *tls.Config) (Conn, error)
+	Listen(addr string, tlsConf *tls.Config) (Listener, error)
+}
+
+var carriers = map[string]Carrier{
+	"quic": &quicCarrier{},
+	"tcp":  &tcpCarrier{},
+	"ws":   &wsCarrier{},
+}
+
+// defaultCarriers is the order used by "auto", the client falls back to
+// the next one when it keeps failing to dial, the server listens on all of them
+var defaultCarriers = []string{"quic", "tcp"}
+
+// bindIP resolves the local address to dial from, an interface name is
+// resolved on every dial since the address of e.g. a lte modem may change
+func bindIP(bind string) (net.IP, error) {
+	if ip := net.ParseIP(bind); ip != nil {
+		return ip, nil
+	}
+
+	ifi, err := net.InterfaceByName(bind)
+	if err != nil {
+		return nil, fmt.Errorf("bind %s is neither an ip nor an interface: %s", bind, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var found net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if found == nil {
+			found = ipNet.IP
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("interface %s has no address", bind)
+	}
+	return found, nil
+}
+
+// localDialer dials tcp from bind
+func localDialer(bind string) (*net.Dialer, error) {
+	dialer := &net.Dialer{Timeout: tcpHandshakeTimeout}
+	if bind == "" {
+		return dialer, nil
+	}
+	ip, err := bindIP(bind)
+	if err != nil {
+		return nil, err
+	}
+	dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	return dialer, nil
+}
+
+func GetCarriers(names string) ([]Carrier, error) {
+	list := defaultCarriers
+	if names != "" && names != "auto" {
+		list = strings.Split(names, ",")
+	}
+
+	result := []Carrier{}
+	for _, name := range list {
+		carrier, ok := carriers[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown transport %q", name)
+		}
+		result = append(result, carrier)
+	}
+	return result, nil
+}
@@ -0,0 +1,188 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/matthewgao/qtun/config"
+	"github.com/rs/zerolog/log"
+)
+
+// maxDatagramSize is the largest datagram quic-go sends, a DATAGRAM frame
+// of 1220 bytes less its own header
+const maxDatagramSize = 1217
+
+// DatagramMTU is the largest ip packet which always fits into a datagram,
+// with the frame, the largest tag and nonce, and the raw packet header of a
+// bonded session. A larger packet goes over the stream, and padding may
+// push one close to the limit there as well
+const DatagramMTU = maxDatagramSize - frameHeaderSize - frameOverhead - 1 - binary.MaxVarintLen64
+
+type quicCarrier struct{}
+
+func (q *quicCarrier) Name() string {
+	return "quic"
+}
+
+// datagram support is negotiated by quic itself, it's only available
+// when both client and server enable it
+func (q *quicCarrier) config() *quic.Config {
+	return &quic.Config{
+		EnableDatagrams: config.GetInstance().Datagram,
+	}
+}
+
+func (q *quicCarrier) Dial(addr, bind string, tlsConf *tls.Config) (Conn, error) {
+	if bind == "" {
+		session, err := quic.DialAddr(addr, tlsConf, q.config())
+		if err != nil {
+			return nil, err
+		}
+		return q.openStream(session, nil)
+	}
+
+	// quic only binds the local address through its own packet conn
+	ip, err := bindIP(bind)
+	if err != nil {
+		return nil, err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return nil, err
+	}
+	session, err := quic.Dial(pconn, udpAddr, addr, tlsConf, q.config())
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+	return q.openStream(session, pconn)
+}
+
+func (q *quicCarrier) openStream(session quic.Connection, pconn net.PacketConn) (Conn, error) {
+	stream, err := session.OpenStreamSync(context.Background())
+	if err != nil {
+		session.CloseWithError(0x2, "fail to open stream sync")
+		if pconn != nil {
+			pconn.Close()
+		}
+		return nil, err
+	}
+
+	return &quicConn{Stream: stream, sess: session, pconn: pconn}, nil
+}
+
+func (q *quicCarrier) Listen(addr string, tlsConf *tls.Config) (Listener, error) {
+	listener, err := quic.ListenAddr(addr, tlsConf, q.config())
+	if err != nil {
+		return nil, err
+	}
+	l := &quicListener{
+		listener: listener,
+		chanConn: make(chan Conn),
+		chanErr:  make(chan error, 1),
+	}
+	go l.serve()
+	return l, nil
+}
+
+// quicListener waits for the stream of every connection on its own, so a
+// client which never opens it doesn't hold up the others
+type quicListener struct {
+	listener quic.Listener
+	chanConn chan Conn
+	chanErr  chan error
+}
+
+func (l *quicListener) serve() {
+	for {
+		sess, err := l.listener.Accept(context.Background())
+		if err != nil {
+			l.chanErr <- err
+			return
+		}
+		go l.acceptStream(sess)
+	}
+}
+
+func (l *quicListener) acceptStream(sess quic.Connection) {
+	log.Debug().Str("from", sess.RemoteAddr().String()).Msg("quic accept start accept stream")
+	ctx, cancel := context.WithTimeout(context.Background(), tcpHandshakeTimeout)
+	defer cancel()
+	stream, err := sess.AcceptStream(ctx)
+	if err != nil {
+		log.Warn().Err(err).Str("from", sess.RemoteAddr().String()).Msg("quic accept stream fail")
+		sess.CloseWithError(0x2, "no stream")
+		return
+	}
+
+	conn := &quicConn{Stream: stream, sess: sess}
+	select {
+	case l.chanConn <- conn:
+	case <-time.After(tcpHandshakeTimeout):
+		log.Warn().Str("from", sess.RemoteAddr().String()).Msg("quic accept timeout, closed")
+		conn.Close()
+	}
+}
+
+func (l *quicListener) Accept() (Conn, error) {
+	select {
+	case conn := <-l.chanConn:
+		return conn, nil
+	case err := <-l.chanErr:
+		return nil, err
+	}
+}
+
+func (l *quicListener) Close() error {
+	return l.listener.Close()
+}
+
+// pconn is only set when the client dials from a bind address, quic
+// doesn't close a packet conn it didn't create
+type quicConn struct {
+	quic.Stream
+	sess  quic.Connection
+	pconn net.PacketConn
+}
+
+func (c *quicConn) SendDatagram(data []byte) error {
+	return c.sess.SendMessage(data)
+}
+
+func (c *quicConn) ReceiveDatagram() ([]byte, error) {
+	return c.sess.ReceiveMessage()
+}
+
+func (c *quicConn) SupportsDatagrams() bool {
+	return c.sess.ConnectionState().SupportsDatagrams
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.sess.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.sess.RemoteAddr()
+}
+
+func (c *quicConn) PeerCertificates() []*x509.Certificate {
+	return c.sess.ConnectionState().TLS.PeerCertificates
+}
+
+func (c *quicConn) Close() error {
+	c.Stream.Close()
+	err := c.sess.CloseWithError(0x1, "connection closed")
+	if c.pconn != nil {
+		c.pconn.Close()
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+
+	"github.com/matthewgao/qtun/config"
+	"github.com/rs/zerolog/log"
+)
+
+const tcpHandshakeTimeout = time.Second * 10
+
+// tcpCarrier runs the tunnel over tls on top of tcp, for networks which
+// block udp entirely. There is no datagram, everything goes over the stream
+type tcpCarrier struct{}
+
+func (t *tcpCarrier) Name() string {
+	return "tcp"
+}
+
+func (t *tcpCarrier) Dial(addr, bind string, tlsConf *tls.Config) (Conn, error) {
+	dialer, err := localDialer(bind)
+	if err != nil {
+		return nil, err
+	}
+	rawConn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.handshake(tls.Client(rawConn, tlsConf))
+}
+
+func (t *tcpCarrier) Listen(addr string, tlsConf *tls.Config) (Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &tcpListener{
+		listener: listener,
+		carrier:  t,
+		tlsConf:  tlsConf,
+		chanConn: make(chan Conn),
+		chanErr:  make(chan error, 1),
+	}
+	go l.serve()
+	return l, nil
+}
+
+func (t *tcpCarrier) handshake(conn *tls.Conn) (Conn, error) {
+	if tcpConn, ok := conn.NetConn().(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(config.GetInstance().NoDelay)
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(time.Second * 10)
+	}
+
+	conn.SetDeadline(time.Now().Add(tcpHandshakeTimeout))
+	err := conn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &tcpConn{Conn: conn}, nil
+}
+
+// tcpListener runs the tls handshake of every connection on its own, so a
+// client which never finishes it doesn't hold up the others
+type tcpListener struct {
+	listener net.Listener
+	carrier  *tcpCarrier
+	tlsConf  *tls.Config
+	chanConn chan Conn
+	chanErr  chan error
+}
+
+func (l *tcpListener) serve() {
+	for {
+		rawConn, err := l.listener.Accept()
+		if err != nil {
+			l.chanErr <- err
+			return
+		}
+		go l.handshake(rawConn)
+	}
+}
+
+func (l *tcpListener) handshake(rawConn net.Conn) {
+	conn, err := l.carrier.handshake(tls.Server(rawConn, l.tlsConf))
+	if err != nil {
+		log.Warn().Err(err).Str("from", rawConn.RemoteAddr().String()).Msg("tcp tls handshake fail")
+		return
+	}
+
+	select {
+	case l.chanConn <- conn:
+	case <-time.After(tcpHandshakeTimeout):
+		log.Warn().Str("from", rawConn.RemoteAddr().String()).Msg("tcp accept timeout, closed")
+		conn.Close()
+	}
+}
+
+func (l *tcpListener) Accept() (Conn, error) {
+	select {
+	case conn := <-l.chanConn:
+		return conn, nil
+	case err := <-l.chanErr:
+		return nil, err
+	}
+}
+
+func (l *tcpListener) Close() error {
+	return l.listener.Close()
+}
+
+type tcpConn struct {
+	*tls.Conn
+}
+
+func (c *tcpConn) SendDatagram(data []byte) error {
+	return ErrDatagramNotSupported
+}
+
+func (c *tcpConn) ReceiveDatagram() ([]byte, error) {
+	return nil, ErrDatagramNotSupported
+}
+
+func (c *tcpConn) SupportsDatagrams() bool {
+	return false
+}
+
+func (c *tcpConn) PeerCertificates() []*x509.Certificate {
+	return c.Conn.ConnectionState().PeerCertificates
+}
@@ -0,0 +1,290 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"math"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/matthewgao/qtun/config"
+)
+
+// testTLS returns the tls config of a server with a self-signed
+// certificate, and the one of a client trusting anything
+func testTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	dir := t.TempDir()
+	server, err := LoadServerTLSConfig(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return server, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{alpn}}
+}
+
+// acceptOne accepts the next connection of l in the background
+func acceptOne(l Listener) chan Conn {
+	accepted := make(chan Conn, 1)
+	go func() {
+		// nil when it fails
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	return accepted
+}
+
+func TestGetCarriers(t *testing.T) {
+	list, err := GetCarriers("auto")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(list) != 2 || list[0].Name() != "quic" || list[1].Name() != "tcp" {
+		t.Fatalf("bad: %v", list)
+	}
+
+	list, err = GetCarriers("tcp")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(list) != 1 || list[0].Name() != "tcp" {
+		t.Fatalf("bad: %v", list)
+	}
+
+	if _, err := GetCarriers("sctp"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+// roundTrip accepts the connection dialed by dial, and sends a message each
+// way, it fails when Accept is held up longer than a second
+func roundTrip(t *testing.T, l Listener, dial func() (Conn, error)) {
+	accepted := acceptOne(l)
+	client, err := dial()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	// the quic stream shows up with its first bytes
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var server Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatalf("bad: accept is held up")
+	}
+	if server == nil {
+		t.Fatalf("bad: accept fail")
+	}
+	defer server.Close()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
+	if _, err := server.Write([]byte("pong")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
+}
+
+func TestTcpCarrier_Accept(t *testing.T) {
+	config.InitConfig(config.Config{})
+	serverTLS, clientTLS := testTLS(t)
+	c := &tcpCarrier{}
+	l, err := c.Listen("127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	addr := l.(*tcpListener).listener.Addr().String()
+
+	// a client which never starts the tls handshake
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer silent.Close()
+
+	roundTrip(t, l, func() (Conn, error) { return c.Dial(addr, "", clientTLS) })
+}
+
+func TestQuicCarrier_Accept(t *testing.T) {
+	config.InitConfig(config.Config{})
+	serverTLS, clientTLS := testTLS(t)
+	q := &quicCarrier{}
+	l, err := q.Listen("127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	addr := l.(*quicListener).listener.Addr().String()
+
+	// a client which never opens the stream
+	silent, err := quic.DialAddr(addr, clientTLS, q.config())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer silent.CloseWithError(0, "")
+	if _, err := silent.OpenStreamSync(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	roundTrip(t, l, func() (Conn, error) { return q.Dial(addr, "", clientTLS) })
+}
+
+func TestWsCarrier_URL(t *testing.T) {
+	config.InitConfig(config.Config{WsPath: "/tunnel"})
+
+	w := &wsCarrier{}
+	if u := w.url("example.com:443"); u != "wss://example.com:443/tunnel" {
+		t.Fatalf("bad: %s", u)
+	}
+	if u := w.url("ws://127.0.0.1:8081/qtun"); u != "ws://127.0.0.1:8081/qtun" {
+		t.Fatalf("bad: %s", u)
+	}
+}
+
+func TestWsCarrier_Read(t *testing.T) {
+	config.InitConfig(config.Config{WsPath: "/tunnel", WsTLS: true})
+	serverTLS, clientTLS := testTLS(t)
+	w := &wsCarrier{}
+	l, err := w.Listen("127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	addr := l.(*wsListener).listener.Addr().String()
+
+	roundTrip(t, l, func() (Conn, error) { return w.Dial(addr, "", clientTLS) })
+
+	accepted := acceptOne(l)
+	client, err := w.Dial(addr, "", clientTLS)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	server := <-accepted
+	if server == nil {
+		t.Fatalf("bad: accept fail")
+	}
+	defer server.Close()
+
+	// the text and the empty messages are skipped
+	ws := client.(*wsConn).ws
+	for _, v := range []struct {
+		messageType int
+		data        string
+	}{
+		{websocket.BinaryMessage, "hello "},
+		{websocket.TextMessage, "ignored"},
+		{websocket.BinaryMessage, ""},
+		{websocket.BinaryMessage, "world"},
+	} {
+		if err := ws.WriteMessage(v.messageType, []byte(v.data)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// a buffer smaller than one message, and reads never cross two of them
+	var got []string
+	buf := make([]byte, 4)
+	for total := 0; total < len("hello world"); {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		got = append(got, string(buf[:n]))
+		total += n
+	}
+	if strings.Join(got, "|") != "hell|o |worl|d" {
+		t.Fatalf("bad: %q", got)
+	}
+}
+
+func TestQuicCarrier_Datagram(t *testing.T) {
+	config.InitConfig(config.Config{Datagram: true})
+	serverTLS, clientTLS := testTLS(t)
+	q := &quicCarrier{}
+	l, err := q.Listen("127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	accepted := acceptOne(l)
+	conn, err := q.Dial(l.(*quicListener).listener.Addr().String(), "", clientTLS)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if !conn.SupportsDatagrams() {
+		t.Fatalf("bad: datagram not negotiated")
+	}
+
+	// the suite with the largest nonce, and the longest seq
+	secret := bytes.Repeat([]byte{1}, secretSize)
+	send, err := newSendKey(cipherSuites["xchacha20-poly1305"], secret)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	recv, err := newRecvKey(cipherSuites["xchacha20-poly1305"], secret)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c := &ClientConn{conn: conn, buf: &bytes.Buffer{}, sendKey: send, peerMax: defaultMaxFrame}
+
+	// a full packet of --mtu 1500 goes over the stream
+	large := bytes.Repeat([]byte{2}, 1500)
+	fallback := statValue(statDatagramFallback)
+	err = c.writeDatagram(newRawPacket(math.MaxUint64, large))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if statValue(statDatagramFallback) != fallback+1 {
+		t.Fatalf("bad: packet above the limit not counted")
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatalf("bad: accept fail")
+	}
+	defer server.Close()
+	data, err := decodeFrame(bufio.NewReader(server), recv, make([]byte, 65536))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.HasSuffix(data, large) {
+		t.Fatalf("bad: %d bytes", len(data))
+	}
+
+	// DatagramMTU fits
+	small := bytes.Repeat([]byte{3}, DatagramMTU)
+	err = c.writeDatagram(newRawPacket(math.MaxUint64, small))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if statValue(statDatagramFallback) != fallback+1 {
+		t.Fatalf("bad: packet of DatagramMTU went over the stream")
+	}
+	msg, err := server.ReceiveDatagram()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, err = decodeFrame(bytes.NewReader(msg), recv, make([]byte, 65536))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.HasSuffix(data, small) {
+		t.Fatalf("bad: %d bytes", len(data))
+	}
+}
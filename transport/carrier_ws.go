@@ -0,0 +1,209 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/matthewgao/qtun/config"
+	"github.com/rs/zerolog/log"
+)
+
+// wsCarrier runs the tunnel inside a websocket, so the server can sit behind
+// a http reverse proxy (nginx, ingress) which only exposes https. Every frame
+// is sent as one binary message
+type wsCarrier struct{}
+
+func (w *wsCarrier) Name() string {
+	return "ws"
+}
+
+// the remote address can be a full url like wss://host/tunnel, or a plain
+// host:port which is turned into wss://host:port/{ws_path}
+func (w *wsCarrier) url(addr string) string {
+	if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+		return addr
+	}
+	return fmt.Sprintf("wss://%s%s", addr, config.GetInstance().WsPath)
+}
+
+func (w *wsCarrier) Dial(addr, bind string, tlsConf *tls.Config) (Conn, error) {
+	netDialer, err := localDialer(bind)
+	if err != nil {
+		return nil, err
+	}
+
+	// the proxy in front of the server speaks http, not our alpn
+	wsTLSConf := tlsConf.Clone()
+	wsTLSConf.NextProtos = nil
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		NetDialContext:   netDialer.DialContext,
+		TLSClientConfig:  wsTLSConf,
+		HandshakeTimeout: tcpHandshakeTimeout,
+	}
+	ws, resp, err := dialer.Dial(w.url(addr), nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("websocket handshake fail, status %s: %s", resp.Status, err)
+		}
+		return nil, err
+	}
+	return newWsConn(ws), nil
+}
+
+// the server serves plain http by default, tls is expected to be terminated
+// by the reverse proxy, unless --ws_tls is set
+func (w *wsCarrier) Listen(addr string, tlsConf *tls.Config) (Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.GetInstance().WsTLS {
+		wsTLSConf := tlsConf.Clone()
+		wsTLSConf.NextProtos = []string{"http/1.1"}
+		listener = tls.NewListener(listener, wsTLSConf)
+	}
+
+	l := &wsListener{
+		listener: listener,
+		chanConn: make(chan Conn),
+		chanErr:  make(chan error, 1),
+		upgrader: websocket.Upgrader{
+			HandshakeTimeout: tcpHandshakeTimeout,
+			// clients are not browsers, there is no origin to check
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(config.GetInstance().WsPath, l.handle)
+	l.server = &http.Server{Handler: mux}
+	go func() {
+		l.chanErr <- l.server.Serve(listener)
+	}()
+	return l, nil
+}
+
+type wsListener struct {
+	listener net.Listener
+	server   *http.Server
+	upgrader websocket.Upgrader
+	chanConn chan Conn
+	chanErr  chan error
+}
+
+func (l *wsListener) handle(w http.ResponseWriter, r *http.Request) {
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warn().Err(err).Str("from", r.RemoteAddr).Msg("websocket upgrade fail")
+		return
+	}
+
+	select {
+	case l.chanConn <- newWsConn(ws):
+	case <-time.After(tcpHandshakeTimeout):
+		log.Warn().Str("from", r.RemoteAddr).Msg("websocket accept timeout, closed")
+		ws.Close()
+	}
+}
+
+func (l *wsListener) Accept() (Conn, error) {
+	select {
+	case conn := <-l.chanConn:
+		return conn, nil
+	case err := <-l.chanErr:
+		return nil, err
+	}
+}
+
+func (l *wsListener) Close() error {
+	return l.server.Close()
+}
+
+type wsConn struct {
+	ws     *websocket.Conn
+	reader io.Reader
+	wmutex sync.Mutex
+}
+
+func newWsConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{ws: ws}
+}
+
+// Read turns the binary messages back into a byte stream
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	err := c.ws.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsConn) SendDatagram(data []byte) error {
+	return ErrDatagramNotSupported
+}
+
+func (c *wsConn) ReceiveDatagram() ([]byte, error) {
+	return nil, ErrDatagramNotSupported
+}
+
+func (c *wsConn) SupportsDatagrams() bool {
+	return false
+}
+
+// behind a reverse proxy the tls is terminated by the proxy, so there is no
+// client certificate unless the server runs with --ws_tls
+func (c *wsConn) PeerCertificates() []*x509.Certificate {
+	if tlsConn, ok := c.ws.UnderlyingConn().(*tls.Conn); ok {
+		return tlsConn.ConnectionState().PeerCertificates
+	}
+	return nil
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	// "log"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,24 +19,147 @@ import (
 )
 
 type Client struct {
-	remoteAddr string
-	key        string
-	threads    int
-	conns      []*ClientConn
-	mutex      sync.RWMutex
-	serial     int64
-	wg         sync.WaitGroup
-	handler    GrpcHandler
+	remoteAddr  string
+	pool        *serverPool
+	key         string
+	threads     int
+	conns       []*ClientConn
+	mutex       sync.RWMutex
+	serial      int64
+	wg          sync.WaitGroup
+	handler     GrpcHandler
+	carriers    []Carrier
+	clientTLS   *ClientTLS
+	suites      []*CipherSuite
+	binds       []string
+	bond        *bond
+	queue       *QueuePolicy
+	batch       *BatchPolicy
+	compression []string
+	obfs        *ObfsPolicy
+	maxFrame    int
+	prefixes    []string
+	leasing     bool
+	clientID    string
+	instance    []byte
+	ip          atomic.Value
 }
 
-func NewClient(remoteAddr string, key string, threads int, handler GrpcHandler) *Client {
+func NewClient(endpoints []*Endpoint, key string, threads int, handler GrpcHandler, carriers []Carrier, clientTLS *ClientTLS) *Client {
+	addrs := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		addrs = append(addrs, e.Addr)
+	}
+
+	// tells the connections of this client from the ones of another client
+	// with the same identity, e.g. when the server has no client certificates
+	instance, err := newSessionID()
+	utils.POE(err)
+
 	return &Client{
-		remoteAddr: remoteAddr,
+		instance:   instance,
+		remoteAddr: strings.Join(addrs, ","),
+		pool:       newServerPool(endpoints, carrierFallbackAfter*len(carriers), 1),
 		key:        key,
 		threads:    threads,
 		handler:    handler,
+		carriers:   carriers,
+		clientTLS:  clientTLS,
+	}
+
+}
+
+// SetCipherSuites sets the ciphers offered to the server, in order of
+// preference, has to be called before Start
+func (c *Client) SetCipherSuites(suites []*CipherSuite) {
+	c.suites = suites
+}
+
+// SetBinds spreads the connections over the local addresses or interfaces,
+// e.g. one wired and one lte uplink, has to be called before Start
+func (c *Client) SetBinds(binds []string) {
+	c.binds = binds
+	c.pool.binds = len(binds)
+}
+
+// EnableBond joins all the connections into one bonded session, the packets
+// are spread over them by rtt and loss, has to be called before Start. The
+// connections have to be on the same server, which numbers the packets, so
+// a priority can't have more than one server
+func (c *Client) EnableBond() error {
+	endpoints := c.pool.endpoints
+	for i := 1; i < len(endpoints); i++ {
+		if endpoints[i].Priority == endpoints[i-1].Priority && endpoints[i].Addr != endpoints[i-1].Addr {
+			return fmt.Errorf("bonded connections have to be on one server, %s and %s share priority %d",
+				endpoints[i-1].Addr, endpoints[i].Addr, endpoints[i].Priority)
+		}
+	}
+
+	session, err := newSessionID()
+	if err != nil {
+		return err
 	}
+	c.bond = newBond(session)
+	return nil
+}
+
+// SetQueuePolicy bounds the packets waiting for each connection, has to be
+// called before Start
+func (c *Client) SetQueuePolicy(policy *QueuePolicy) {
+	c.queue = policy
+}
+
+// SetBatchPolicy bounds the packets coalesced into one frame, has to be
+// called before Start
+func (c *Client) SetBatchPolicy(policy *BatchPolicy) {
+	c.batch = policy
+}
+
+// SetCompression sets the compression offered to the server, in order of
+// preference, has to be called before Start
+func (c *Client) SetCompression(compression []string) {
+	c.compression = compression
+}
+
+// SetObfsPolicy pads the frames and sends cover traffic, has to be called
+// before Start
+func (c *Client) SetObfsPolicy(policy *ObfsPolicy) {
+	c.obfs = policy
+}
 
+// SetMaxFrame sets the largest frame accepted from the server, see
+// CheckMaxFrame, has to be called before Start
+func (c *Client) SetMaxFrame(maxFrame int) {
+	c.maxFrame = maxFrame
+}
+
+// SetPrefixes sets the subnets behind the client, they are advertised in
+// every ping so the server routes them through the tunnel, has to be called
+// before Start
+func (c *Client) SetPrefixes(prefixes []string) {
+	c.prefixes = prefixes
+}
+
+// EnableLease asks the server for the tunnel ip instead of --ip, the leases
+// are kept for clientID unless the client has a certificate. Pings wait for
+// SetIP, has to be called before Start
+func (c *Client) EnableLease(clientID string) {
+	c.leasing = true
+	c.clientID = clientID
+}
+
+// SetIP sets the tunnel ip/prefix leased by the server
+func (c *Client) SetIP(ip string) {
+	c.ip.Store(ip)
+}
+
+// tunIP returns the tunnel ip/prefix, empty until the lease comes
+func (c *Client) tunIP() string {
+	if !c.leasing {
+		return config.GetInstance().Ip
+	}
+	ip, _ := c.ip.Load().(string)
+	return ip
 }
 
 func (c *Client) Start() {
@@ -43,28 +167,28 @@ func (c *Client) Start() {
 	c.conns = make([]*ClientConn, c.threads)
 	for connIndex := 0; connIndex < c.threads; connIndex++ {
 		c.wg.Add(1)
-		conn := NewClientConn(c.remoteAddr, c.key, connIndex, &c.wg, config.GetInstance().NoDelay)
+		conn := NewClientConn(c.pool, c.key, connIndex, &c.wg, config.GetInstance().NoDelay, c.carriers, c.clientTLS)
 		conn.SetHander(c.handler)
-
-		conn.InitConn()
-		connected := false
-		for index := 0; index < 10; index++ {
-			if conn.IsConnected() {
-				connected = true
-				break
-			}
-			time.Sleep(time.Millisecond * 500)
+		conn.suites = c.suites
+		conn.compression = c.compression
+		conn.bond = c.bond
+		conn.packets = newSendQueue(c.queue)
+		conn.batch = newBatcher(c.batch)
+		conn.obfs = newObfuscator(c.obfs)
+		if c.maxFrame != 0 {
+			conn.maxFrame = c.maxFrame
+			conn.readBuf = newFrameBuf(c.maxFrame)
 		}
-
-		if connected {
-			c.conns[connIndex] = conn
-			go c.conns[connIndex].run()
-		} else {
-			log.Warn().Str("server_addr", c.remoteAddr).
-				Msg("fail to connect to the server after 10 times retry")
-
-			c.wg.Done()
+		if len(c.binds) > 0 {
+			// every bind gets a connection to each server in turn
+			conn.bind = c.binds[connIndex%len(c.binds)]
+			conn.slot = connIndex / len(c.binds)
 		}
+
+		// every slot connects in the background, a dead server doesn't hold
+		// up the others
+		c.conns[connIndex] = conn
+		go conn.run()
 	}
 
 	log.Info().Str("server_addr", c.remoteAddr).Int("conn_num", len(c.conns)).
@@ -72,6 +196,7 @@ func (c *Client) Start() {
 
 	c.mutex.Unlock()
 
+	go c.pool.healthCheck(c.probe, c.failback)
 	go func() {
 		for {
 			c.ping()
@@ -82,6 +207,31 @@ func (c *Client) Start() {
 	}()
 }
 
+// probe tells if the server is reachable over any of the carriers
+func (c *Client) probe(e *Endpoint) error {
+	var err error
+	for _, carrier := range c.carriers {
+		var conn Conn
+		conn, err = carrier.Dial(e.Addr, "", c.clientTLS.Config(e.Addr))
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	return err
+}
+
+// failback moves the connections back when a preferred server returns
+func (c *Client) failback() {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, conn := range c.conns {
+		if conn != nil {
+			conn.rebalance()
+		}
+	}
+}
+
 func (c *Client) Stop() {
 	defer log.Info().Str("server_addr", c.remoteAddr).Int("conn_num", len(c.conns)).
 		Msg("client stop")
@@ -131,6 +281,39 @@ func (c *Client) Write(data []byte) {
 	conn.Write(data)
 }
 
+func (c *Client) WritePacket(data []byte) {
+	serial := atomic.AddInt64(&c.serial, 1)
+	next := int(serial) % c.threads
+	conn := c.conns[next]
+	conn.WritePacket(data)
+}
+
+// WriteFlow sends data over the connection the flow is pinned to, the flows
+// of a connection which is down move to the others until it's back
+func (c *Client) WriteFlow(flow uint32, data []byte) {
+	// PickFlow over the connections which are up, without a list of them
+	var best *ClientConn
+	var bestScore uint32
+	c.mutex.RLock()
+	for _, conn := range c.conns {
+		if conn == nil || !conn.IsConnected() {
+			continue
+		}
+		score := flowScore(flow, conn.flowKey)
+		if best == nil || score > bestScore {
+			best, bestScore = conn, score
+		}
+	}
+	c.mutex.RUnlock()
+
+	if best == nil {
+		// wait for any of them to come back
+		c.WritePacket(data)
+		return
+	}
+	best.WritePacket(data)
+}
+
 //随机找一个可用的连接，为了获取连接地址
 // func (c *Client) GetRemotePortRandom() string {
 // 	serial := atomic.AddInt64(&c.serial, 1)
@@ -161,13 +344,19 @@ func (c *Client) ping() {
 // }
 
 func (c *Client) GetTunLocalAddrWithPortOnConn(conn *ClientConn) string {
-	return fmt.Sprintf("%s:%s", config.GetInstance().Ip, conn.GetConnPort())
+	return fmt.Sprintf("%s:%s", c.tunIP(), conn.GetConnPort())
 }
 
 func (c *Client) SendAllPing() {
+	if c.tunIP() == "" {
+		// nothing to announce before the lease
+		c.requestLease()
+		return
+	}
+
 	for _, v := range c.conns {
-		if v == nil {
-			//FIXME: should delete conn
+		if v == nil || !v.IsConnected() {
+			// it's reconnecting, the ping goes out once it's back
 			continue
 		}
 
@@ -176,7 +365,7 @@ func (c *Client) SendAllPing() {
 }
 
 func (c *Client) SendPing(conn *ClientConn) {
-	ip, _, err := net.ParseCIDR(config.GetInstance().Ip)
+	ip, _, err := net.ParseCIDR(c.tunIP())
 	utils.POE(err)
 
 	localAddr := c.GetTunLocalAddrWithPortOnConn(conn)
@@ -188,6 +377,9 @@ func (c *Client) SendPing(conn *ClientConn) {
 				LocalPrivateAddr: "not_use",
 				DC:               "client",
 				IP:               ip.String(),
+				Prefixes:         c.prefixes,
+				ClientID:         c.clientID,
+				Instance:         c.instance,
 			},
 		},
 	}
@@ -197,14 +389,65 @@ func (c *Client) SendPing(conn *ClientConn) {
 	data, err := proto.Marshal(env)
 	utils.POE(err)
 
-	c.Write(data)
+	// over the connection it announces, a slot which is reconnecting would
+	// hold the ping up
+	conn.Write(data)
 }
 
+// requestLease asks for the tunnel ip over the first connection up, it's
+// repeated with the pings until the answer comes
+func (c *Client) requestLease() {
+	for _, v := range c.conns {
+		if v == nil || !v.IsConnected() {
+			continue
+		}
+
+		env := &protocol.Envelope{
+			Type: &protocol.Envelope_Lease{
+				Lease: &protocol.MessageLease{ClientID: c.clientID},
+			},
+		}
+		log.Debug().Str("client_id", c.clientID).Msg("send lease request")
+		data, err := proto.Marshal(env)
+		utils.POE(err)
+		v.Write(data)
+		return
+	}
+}
+
+// SendPacket sends a copy of pkt
 func (c *Client) SendPacket(pkt iface.PacketIP) {
-	data, _ := proto.Marshal(&protocol.Envelope{
-		Type: &protocol.Envelope_Packet{
-			Packet: &protocol.MessagePacket{Payload: pkt},
-		},
+	c.SendTunPacket(CopyPacket(pkt))
+}
+
+// SendTunPacket sends a packet the tun was read into, it takes pkt over
+func (c *Client) SendTunPacket(pkt Packet) {
+	if c.bond != nil {
+		c.sendBonded(pkt)
+		return
+	}
+
+	c.WriteFlow(pkt.IP().FlowHash(), pkt.frame(0))
+}
+
+// sendBonded numbers the packet and sends it over the connection picked by
+// the scheduler
+func (c *Client) sendBonded(pkt Packet) {
+	data := c.bond.marshalPacket(pkt)
+
+	c.mutex.RLock()
+	i := c.bond.pick(len(c.conns), func(i int) *pathStats {
+		if conn := c.conns[i]; conn != nil && conn.IsConnected() {
+			return conn.path
+		}
+		return nil
 	})
-	c.Write(data)
+	c.mutex.RUnlock()
+
+	if i < 0 {
+		// wait for any of them to come back
+		c.WritePacket(data)
+		return
+	}
+	c.conns[i].WritePacket(data)
 }
@@ -3,54 +3,100 @@ package transport
 import (
 	"bufio"
 	"bytes"
-	"context"
-	"crypto/cipher"
-	crand "crypto/rand"
-	"crypto/tls"
-	"encoding/binary"
 	"fmt"
-	"io"
-	"strings"
+	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/lucas-clemente/quic-go"
-	"github.com/matthewgao/qtun/utils"
 	"github.com/rs/zerolog/log"
 )
 
 var nilBuf = make([]byte, 0)
 
+// how many dial failures in a row before the client falls back to the next carrier
+const carrierFallbackAfter = 3
+
 type ClientConn struct {
 	remoteAddr string
-	key        string
-	conn       quic.Stream
-	session    quic.Connection
-	index      int
-	mutex      sync.RWMutex
-	aesgcm     cipher.AEAD
-	chanWrite  chan []byte
-	chanClose  chan bool
-	wg         sync.WaitGroup
-	parentWG   *sync.WaitGroup
-	connected  bool
-	buf        *bytes.Buffer
-	readBuf    []byte
-	handler    GrpcHandler
-	reader     *bufio.Reader
-	noDelay    bool
+	pool       *serverPool
+	endpoint   *Endpoint
+	// the epoch of the bonded session on the server and its reorder buffer
+	epoch   uint64
+	reorder *reorderBuffer
+	// bind is the local address dialed from, slot is the index among the
+	// connections of the same bind, which picks the server
+	bind      string
+	slot      int
+	bond      *bond
+	path      *pathStats
+	chanProbe chan int64
+	flowKey   string
+	key       string
+	conn      Conn
+	carriers  []Carrier
+	clientTLS *ClientTLS
+	suites    []*CipherSuite
+	// closed to stop the write process of the connection, procs waits for
+	// it and the datagram process before the next connection takes over
+	// the keys and buffers
+	done  chan struct{}
+	procs sync.WaitGroup
+	// offered in the handshake, compress is 1 when the server took it.
+	// maxFrame is the largest frame accepted from the server, peerMax the
+	// largest accepted by the server
+	compression []string
+	compress    int32
+	maxFrame    int
+	peerMax     int
+	carrierIdx  int
+	failures    int
+	index       int
+	mutex       sync.RWMutex
+	sendKey     *sendKey
+	recvKey     *recvKey
+	chanWrite   chan []byte
+	packets     *sendQueue
+	batch       *batcher
+	obfs        *obfuscator
+	chanClose   chan bool
+	wg          sync.WaitGroup
+	parentWG    *sync.WaitGroup
+	connected   bool
+	buf         *bytes.Buffer
+	frame       []byte
+	readBuf     []byte
+	dgramBuf    []byte
+	datagram    bool
+	handler     GrpcHandler
+	reader      *bufio.Reader
+	noDelay     bool
 }
 
-func NewClientConn(remoteAddr, key string, index int, parentWG *sync.WaitGroup, noDelay bool) *ClientConn {
+func NewClientConn(pool *serverPool, key string, index int, parentWG *sync.WaitGroup, noDelay bool, carriers []Carrier, clientTLS *ClientTLS) *ClientConn {
 	return &ClientConn{
-		remoteAddr: remoteAddr,
+		remoteAddr: pool.pick(index).Addr,
+		pool:       pool,
+		slot:       index,
+		path:       &pathStats{},
+		chanProbe:  make(chan int64, 1),
+		flowKey:    strconv.Itoa(index),
 		key:        key,
 		index:      index,
-		chanWrite:  make(chan []byte),
+		carriers:   carriers,
+		clientTLS:  clientTLS,
+		maxFrame:   defaultMaxFrame,
+		peerMax:    defaultMaxFrame,
+		chanWrite:  make(chan []byte, controlQueueSize),
+		packets:    newSendQueue(nil),
+		batch:      newBatcher(nil),
 		chanClose:  make(chan bool),
 		parentWG:   parentWG,
 		buf:        &bytes.Buffer{},
-		readBuf:    make([]byte, 65536),
+		frame:      make([]byte, frameHeaderSize, packetBufSize),
+		readBuf:    newFrameBuf(defaultMaxFrame),
+		dgramBuf:   make([]byte, 65536),
 		noDelay:    noDelay,
 	}
 }
@@ -66,7 +112,13 @@ func (this *ClientConn) IsConnected() bool {
 	return connected
 }
 
+// tryConnect connects to the server the slot should use now, which changes
+// when the active server is down
 func (this *ClientConn) tryConnect() error {
+	return this.tryConnectTo(this.pool.pick(this.slot))
+}
+
+func (this *ClientConn) tryConnectTo(endpoint *Endpoint) error {
 	// tcpAddr, err := net.ResolveTCPAddr("tcp", this.remoteAddr)
 	// if err != nil {
 	// 	return err
@@ -76,24 +128,34 @@ func (this *ClientConn) tryConnect() error {
 		return nil
 	}
 
-	tlsConf := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"quic-echo-example"},
-	}
+	this.mutex.Lock()
+	this.endpoint = endpoint
+	this.remoteAddr = endpoint.Addr
+	this.mutex.Unlock()
 
-	session, err := quic.DialAddr(this.remoteAddr, tlsConf, nil)
+	carrier := this.carriers[this.carrierIdx]
+	conn, err := carrier.Dial(this.remoteAddr, this.bind, this.clientTLS.Config(this.remoteAddr))
 	if err != nil {
+		this.pool.fail(endpoint, this.bind)
+		this.failures++
+		if this.failures >= carrierFallbackAfter {
+			this.nextCarrier()
+		}
 		return err
 	}
 
-	this.session = session
-
-	this.conn, err = this.session.OpenStreamSync(context.Background())
+	this.failures = 0
+	this.reader = bufio.NewReaderSize(conn, 1024*4)
+	err = this.handshake(conn)
 	if err != nil {
-		// this.session.Close()
-		this.session.CloseWithError(0x2, "fail to open stream sync")
-		return err
+		conn.Close()
+		this.pool.fail(endpoint, this.bind)
+		return fmt.Errorf("handshake with %s over %s fail: %s", this.remoteAddr, carrier.Name(), err)
 	}
+	this.pool.succeed(endpoint)
+	this.conn = conn
+	this.datagram = this.conn.SupportsDatagrams()
+	this.path.reset()
 
 	// this.conn.SetReadBuffer(1024 * 1024)
 	// this.conn.SetWriteBuffer(1024 * 1024)
@@ -101,19 +163,65 @@ func (this *ClientConn) tryConnect() error {
 	// this.conn.SetKeepAlive(true)
 	// this.conn.SetKeepAlivePeriod(time.Second * 10)
 	// this.conn.SetReadDeadline(time.Now().Add(timeoutDuration))
-	log.Info().Str("server_addr", this.remoteAddr).Msg("try connect success")
+	log.Info().Str("server_addr", this.remoteAddr).Str("transport", carrier.Name()).
+		Str("bind", this.bind).Bool("datagram", this.datagram).Msg("try connect success")
 	return nil
 }
 
-func (this *ClientConn) crypto() (err error) {
-	if this.key == "" {
-		log.Info().Str("server_addr", this.remoteAddr).
+// switch to the next carrier, e.g. from quic to tcp when udp is blocked
+func (this *ClientConn) nextCarrier() {
+	this.failures = 0
+	if len(this.carriers) < 2 {
+		return
+	}
+
+	from := this.carriers[this.carrierIdx]
+	this.carrierIdx = (this.carrierIdx + 1) % len(this.carriers)
+	log.Warn().Int("thread_index", this.index).Str("server_addr", this.remoteAddr).
+		Str("from", from.Name()).Str("to", this.carriers[this.carrierIdx].Name()).
+		Msg("keep failing to connect, fallback to another transport")
+}
+
+// handshake derives fresh session keys for every new connection
+func (this *ClientConn) handshake(conn Conn) error {
+	timer := time.AfterFunc(handshakeTimeout, func() { conn.Close() })
+	defer timer.Stop()
+	var session []byte
+	if this.bond != nil {
+		session = this.bond.session
+	}
+	result, err := clientHandshake(conn, this.reader, this.key, &handshakeOffer{
+		suites:      this.suites,
+		compression: this.compression,
+		maxFrame:    this.maxFrame,
+		session:     session,
+	}, this.buf, this.readBuf)
+	if err != nil {
+		return err
+	}
+	keys, compression := result.keys, result.compression
+	if this.bond != nil {
+		this.reorder = this.bond.attach(this.epoch, result.epoch)
+		this.epoch = result.epoch
+	}
+	this.peerMax = result.maxFrame
+	this.batch.setLimit(result.maxFrame)
+	if compression != "" {
+		atomic.StoreInt32(&this.compress, 1)
+	} else {
+		atomic.StoreInt32(&this.compress, 0)
+	}
+	if keys == nil {
+		log.Warn().Int("thread_index", this.index).Str("server_addr", this.remoteAddr).
 			Msg("outgoing encryption disabled")
+		this.sendKey, this.recvKey = nil, nil
 		return nil
 	}
-
-	this.aesgcm, err = makeAES128GCM(this.key)
-	return
+	this.sendKey, this.recvKey = keys.send, keys.recv
+	log.Info().Int("thread_index", this.index).Str("server_addr", this.remoteAddr).
+		Str("cipher", keys.send.suite.Name).Str("compression", compression).
+		Int("max_frame", this.peerMax).Msg("handshake success")
+	return nil
 }
 
 func (this *ClientConn) InitConn() error {
@@ -125,13 +233,25 @@ func (this *ClientConn) InitConn() error {
 		}
 	}()
 
-	err := this.crypto()
-	utils.POE(err)
+	var err error
+	// try every server and carrier once before giving up
+	for _, endpoint := range this.pool.candidates(this.slot) {
+		for i := 0; i < len(this.carriers); i++ {
+			err = this.tryConnectTo(endpoint)
+			if err == nil {
+				break
+			}
 
-	err = this.tryConnect()
+			log.Error().Err(err).Int("thread_index", this.index).Str("server_addr", this.remoteAddr).
+				Msg("connect server fail")
+			this.nextCarrier()
+		}
+		if err == nil {
+			break
+		}
+		this.pool.down(endpoint, this.bind)
+	}
 	if err != nil {
-		log.Error().Err(err).Int("thread_index", this.index).Str("server_addr", this.remoteAddr).
-			Msg("connect server fail")
 		return err
 	}
 
@@ -150,8 +270,8 @@ func (this *ClientConn) run() {
 	}()
 
 	this.wg.Add(1)
-	err := this.crypto()
-	utils.POE(err)
+	retry := newBackoff()
+	first := true
 	for {
 		select {
 		case <-this.chanClose:
@@ -159,21 +279,64 @@ func (this *ClientConn) run() {
 		default:
 		}
 
-		err := this.tryConnect()
+		var err error
+		if first {
+			// every server and carrier is tried once, then the slot keeps
+			// retrying the one it should use
+			err, first = this.InitConn(), false
+		} else {
+			err = this.tryConnect()
+		}
 		if err != nil {
 			log.Error().Err(err).Int("thread_index", this.index).Str("server_addr", this.remoteAddr).
 				Msg("connect server fail")
-			time.Sleep(time.Millisecond * 1000)
 		} else {
-			go this.writeProcess()
+			since := time.Now()
+			this.done = make(chan struct{})
+			this.procs.Add(1)
+			go this.writeProcess(this.done)
+			if this.datagram {
+				this.procs.Add(1)
+				go this.datagramProcess()
+			}
 			err = this.readProcess()
+			close(this.done)
+			this.procs.Wait()
 			if err == nil {
 				log.Error().Int("thread_index", this.index).Str("server_addr", this.remoteAddr).
 					Msg("client exit from process ")
 				break
 			}
+			if time.Since(since) >= reconnectStable {
+				retry.reset()
+			}
 		}
+
+		wait := retry.next()
+		log.Info().Int("thread_index", this.index).Str("server_addr", this.remoteAddr).
+			Dur("wait", wait).Msg("reconnect later")
+		select {
+		case <-this.chanClose:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// rebalance moves the connection to the server the slot should use now,
+// e.g. back to the preferred server when it returns
+func (this *ClientConn) rebalance() {
+	this.mutex.RLock()
+	endpoint, conn, connected := this.endpoint, this.conn, this.connected
+	this.mutex.RUnlock()
+
+	if !connected || this.pool.pick(this.slot) == endpoint {
+		return
 	}
+	log.Info().Int("thread_index", this.index).Str("server_addr", endpoint.Addr).
+		Str("to", this.pool.pick(this.slot).Addr).Msg("fail back to the preferred server")
+	// the read process fails and reconnects
+	conn.Close()
 }
 
 func (this *ClientConn) Close() {
@@ -190,7 +353,7 @@ func (this *ClientConn) setConnected(value bool) {
 	this.mutex.Unlock()
 }
 
-func (this *ClientConn) writeProcess() (err error) {
+func (this *ClientConn) writeProcess(done chan struct{}) (err error) {
 	defer func() {
 		if perr := recover(); perr != nil {
 			err = fmt.Errorf("client process panic: %s", perr)
@@ -198,12 +361,10 @@ func (this *ClientConn) writeProcess() (err error) {
 
 		this.setConnected(false)
 		this.conn.Close()
-		// this.session.Close()
-		this.session.CloseWithError(0x1, "fail to write")
 
 		log.Error().Int("thread_index", this.index).Str("server_addr", this.remoteAddr).
 			Msg("client conn closed")
-
+		this.procs.Done()
 	}()
 	this.setConnected(true)
 
@@ -212,14 +373,49 @@ func (this *ClientConn) writeProcess() (err error) {
 
 	// pingTicker := time.NewTicker(time.Second * 1)
 	// defer pingTicker.Stop()
+	var probeTick <-chan time.Time
+	if this.bond != nil {
+		probeTicker := time.NewTicker(probeInterval)
+		defer probeTicker.Stop()
+		probeTick = probeTicker.C
+	}
+	var coverTick <-chan time.Time
+	coverTimer := this.obfs.coverTimer()
+	if coverTimer != nil {
+		defer coverTimer.Stop()
+		coverTick = coverTimer.C
+	}
 	for {
 		select {
 		case <-this.chanClose:
 			return nil
+		case <-done:
+			return nil
 		// case <-pingTicker.C:
 		// 	// err = this.write(nilBuf)
+		case now := <-probeTick:
+			err = this.write(marshalProbe(this.path.probe(now), false))
+		case timestamp := <-this.chanProbe:
+			err = this.write(marshalProbe(timestamp, true))
+		case <-coverTick:
+			err = this.write(this.obfs.cover())
+			coverTimer.Reset(this.obfs.nextCover())
 		case buf := <-this.chanWrite:
 			err = this.write(buf)
+		case buf := <-this.packets.ch:
+			this.packets.taken()
+			if this.datagram {
+				err = this.writeDatagram(buf)
+				freePacketBuf(buf)
+			} else {
+				// a packet left over from a full batch starts the next one
+				for buf != nil && err == nil {
+					var frame []byte
+					frame, buf = this.batch.collect(buf, this.packets)
+					err = this.writeFrame(frame)
+					this.batch.release()
+				}
+			}
 		}
 		if err != nil {
 			return err
@@ -227,64 +423,90 @@ func (this *ClientConn) writeProcess() (err error) {
 	}
 }
 
+// write sends a control message, it's copied behind the frame headroom
 func (this *ClientConn) write(data []byte) error {
+	this.frame = append(this.frame[:frameHeaderSize], data...)
+	return this.writeFrame(this.frame)
+}
+
+// writeFrame seals buf, the frame headroom followed by the payload, in place
+// and writes it to the stream
+func (this *ClientConn) writeFrame(buf []byte) error {
 	if this.conn == nil {
 		return fmt.Errorf("no connection")
 	}
-	var err error
-	this.buf.Reset()
-	var secure uint8 = 0
-	if this.aesgcm != nil {
-		secure = 1
+	err := writeRekey(this.conn, this.buf, this.sendKey)
+	if err != nil {
+		return err
+	}
+	// this.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	frame, ok := sealLimited(buf, this.sendKey, this.obfs.pad(), this.peerMax)
+	if !ok {
+		log.Debug().Int("thread_index", this.index).Int("len", len(buf)).
+			Msg("ClientConn::writeFrame frame is too large for the server, drop")
+		return nil
 	}
-	err = binary.Write(this.buf, binary.LittleEndian, &secure)
+	_, err = this.conn.Write(frame)
+	return err
+}
+
+func (this *ClientConn) writeDatagram(buf []byte) error {
+	if this.conn == nil {
+		return fmt.Errorf("no connection")
+	}
+	err := writeRekey(this.conn, this.buf, this.sendKey)
 	if err != nil {
 		return err
 	}
-	if secure == 0 {
-		dataLen := uint16(len(data))
-		err = binary.Write(this.buf, binary.LittleEndian, &dataLen)
-		if err != nil {
-			return err
-		}
-		_, err = this.buf.Write(data)
-		if err != nil {
-			return err
-		}
-	} else {
-		nonce := make([]byte, this.aesgcm.NonceSize())
-		_, err = io.ReadFull(crand.Reader, nonce)
-		if err != nil {
-			return err
-		}
-		data2 := this.aesgcm.Seal(nil, nonce, data, nil)
-		dataLen := uint16(len(data2))
-		err = binary.Write(this.buf, binary.LittleEndian, &dataLen)
-		if err != nil {
-			return err
-		}
-		_, err = this.buf.Write(data2)
-		if err != nil {
-			return err
-		}
-		_, err = this.buf.Write(nonce)
-		if err != nil {
-			return err
-		}
+	frame, ok := sealLimited(buf, this.sendKey, this.obfs.pad(), this.peerMax)
+	if !ok {
+		log.Debug().Int("thread_index", this.index).Int("len", len(buf)).
+			Msg("ClientConn::writeDatagram frame is too large for the server, drop")
+		return nil
 	}
-	if err == nil {
-		// this.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-		_, err = this.buf.WriteTo(this.conn)
+	if len(frame) <= maxDatagramSize {
+		err = this.conn.SendDatagram(frame)
+		if err == nil {
+			return nil
+		}
+		log.Debug().Err(err).Int("thread_index", this.index).Int("len", len(frame)).
+			Msg("ClientConn::writeDatagram send datagram fail, fallback to stream")
 	}
+	// packet doesn't fit into a datagram frame, fallback to the stream
+	stats.Add(statDatagramFallback, 1)
+	_, err = this.conn.Write(frame)
 	return err
 }
 
+// Write queues a control message, it never blocks, the message is dropped
+// when the queue is full
 func (this *ClientConn) Write(data []byte) {
 	if this == nil || this.chanWrite == nil {
 		log.Warn().Msg("ClientConn::write conn not init, retry later")
 		return
 	}
-	this.chanWrite <- data
+	select {
+	case this.chanWrite <- data:
+	default:
+		stats.Add(statControlDropped, 1)
+		log.Debug().Int("thread_index", this.index).Str("server_addr", this.remoteAddr).
+			Msg("ClientConn::Write control queue full, message dropped")
+	}
+}
+
+// packets go into datagrams when the peer supports them, otherwise they
+// share the stream with the control messages. WritePacket never blocks, the
+// packet is dropped when the queue is full. data is a buffer of
+// newPacketBuf, the connection owns it from now on
+func (this *ClientConn) WritePacket(data []byte) {
+	if this == nil || this.packets == nil {
+		log.Warn().Msg("ClientConn::WritePacket conn not init, retry later")
+		return
+	}
+	if atomic.LoadInt32(&this.compress) == 1 {
+		data = compressPacket(data)
+	}
+	this.packets.push(data)
 }
 
 // func (this *ClientConn) WriteNow(data []byte) error {
@@ -302,22 +524,21 @@ func (sc *ClientConn) readProcess() error {
 		if sc.conn != nil {
 			sc.conn.Close()
 		}
-		// sc.session.Close()
-		sc.session.CloseWithError(0x1, "fail to read")
 		sc.setConnected(false)
 	}()
-	var err error
-	err = sc.crypto()
-	utils.POE(err)
-
 	// sc.conn.SetReadBuffer(1024 * 1024)
 	// sc.conn.SetWriteBuffer(1024 * 1024)
 	// sc.conn.SetNoDelay(sc.noDelay)
 
-	sc.reader = bufio.NewReaderSize(sc.conn, 1024*4)
 	for {
 		// sc.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
 		data, err := sc.read()
+		if err == ErrReplay {
+			// the frame is consumed, the stream is still in sync
+			log.Warn().Err(err).Int("thread_index", sc.index).Str("server_addr", sc.remoteAddr).
+				Msg("ClientConn::runRead drop frame")
+			continue
+		}
 
 		// if err == io.EOF {
 		// 	log.Error().Err(err).Int("thread_index", sc.index).Str("server_addr", sc.remoteAddr).
@@ -332,8 +553,25 @@ func (sc *ClientConn) readProcess() error {
 			return err
 		}
 
+		if ok, err := sc.recvKey.handleRekey(data); ok {
+			if err != nil {
+				log.Error().Err(err).Int("thread_index", sc.index).Str("server_addr", sc.remoteAddr).
+					Msg("ClientConn::runRead rekey fail, break")
+				return err
+			}
+			continue
+		}
+
+		if ok, err := sc.path.handleProbe(data, sc.chanProbe); ok {
+			if err != nil {
+				log.Warn().Err(err).Int("thread_index", sc.index).Str("server_addr", sc.remoteAddr).
+					Msg("ClientConn::runRead bad probe, drop")
+			}
+			continue
+		}
+
 		if sc.handler != nil {
-			sc.handler.ClientOnData(data)
+			sc.deliver(data)
 		} else {
 			log.Error().Int("thread_index", sc.index).Str("server_addr", sc.remoteAddr).
 				Msg("ClientConn::runRead handler is null")
@@ -341,49 +579,75 @@ func (sc *ClientConn) readProcess() error {
 	}
 }
 
-func (sc *ClientConn) read() ([]byte, error) {
-	var err error
-	var secure uint8 = 0
-	reader := sc.reader
-	err = binary.Read(reader, binary.LittleEndian, &secure)
-	if err != nil {
-		return nil, err
+// deliver hands data to the handler, the packets of a bonded session are
+// put back in order first
+func (sc *ClientConn) deliver(data []byte) {
+	if dropCover(data) {
+		return
 	}
-	var dataLen uint16
-	err = binary.Read(reader, binary.LittleEndian, &dataLen)
-	if err != nil {
-		return nil, err
+	if unbatch(data, sc.deliver) {
+		return
 	}
-	_, err = io.ReadFull(reader, sc.readBuf[:dataLen])
-	if err != nil {
-		return nil, err
+	if ok, err := inflatePacket(data, sc.deliver); ok {
+		if err != nil {
+			log.Warn().Err(err).Int("thread_index", sc.index).Str("server_addr", sc.remoteAddr).
+				Msg("ClientConn::deliver bad compressed packet, drop")
+		}
+		return
 	}
-	if secure == 0 {
-		return sc.readBuf[:dataLen], err
+	seq := packetSeq(data)
+	if sc.bond == nil || seq == 0 {
+		sc.handler.ClientOnData(data)
+		return
 	}
+	sc.reorder.push(seq, data, sc.handler.ClientOnData)
+}
 
-	nonce := make([]byte, sc.aesgcm.NonceSize())
-	_, err = io.ReadFull(reader, nonce)
-	if err != nil {
-		return nil, err
-	}
-	plain, err := sc.aesgcm.Open(nil, nonce, sc.readBuf[:dataLen], nil)
-	if err != nil {
-		return nil, err
+func (sc *ClientConn) datagramProcess() {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error().Interface("err", err).Int("thread_index", sc.index).
+				Str("server_addr", sc.remoteAddr).
+				Msg("ClientConn::datagramProcess painc")
+		}
+		sc.procs.Done()
+	}()
+
+	conn := sc.conn
+	for {
+		msg, err := conn.ReceiveDatagram()
+		if err != nil {
+			log.Warn().Err(err).Int("thread_index", sc.index).Str("server_addr", sc.remoteAddr).
+				Msg("ClientConn::datagramProcess receive fail, exit")
+			return
+		}
+
+		data, err := decodeFrame(bytes.NewReader(msg), sc.recvKey, sc.dgramBuf)
+		if err != nil {
+			// a broken datagram only loses one packet, keep the connection
+			log.Error().Err(err).Int("thread_index", sc.index).Str("server_addr", sc.remoteAddr).
+				Msg("ClientConn::datagramProcess decode fail, drop")
+			continue
+		}
+
+		if sc.handler != nil {
+			sc.deliver(data)
+		}
 	}
+}
 
-	return plain, nil
+func (sc *ClientConn) read() ([]byte, error) {
+	return decodeFrame(sc.reader, sc.recvKey, sc.readBuf)
 }
 
 //为了使用 10.4.4.3:port 这样的格式来表示一条tcp连接
 func (sc *ClientConn) GetConnPort() string {
-	// fullWithPort := sc.conn.LocalAddr().String()
-	fullWithPort := sc.session.LocalAddr().String()
-	addrPair := strings.Split(fullWithPort, ":")
+	fullWithPort := sc.conn.LocalAddr().String()
+	_, port, err := net.SplitHostPort(fullWithPort)
 	// log.Printf("get local tcp addr %s", fullWithPort)
 	// fmt.Printf("get conn port %v\n", fullWithPort)
-	if len(addrPair) < 3 {
+	if err != nil {
 		panic("fail to get local tcp port")
 	}
-	return addrPair[3]
+	return port
 }
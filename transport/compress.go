@@ -0,0 +1,204 @@
+package transport
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// the client offers the algorithms of --compress in the handshake, the
+// server picks the first one it accepts as well, covered by the mac like the
+// ciphers. A compressed packet has its own marker instead of rawPacket:
+//
+//	compressedPacket(1) | seq(uvarint) | compressed ip packet
+//
+// and the packets which don't shrink, e.g. tls or video, are sent raw, so
+// there's no need to tell the compressible flows apart
+const (
+	compressedPacket = 0x01
+	// acks and the like don't shrink
+	compressMinSize = 128
+
+	compressDeflate = "deflate"
+)
+
+func init() {
+	stats.Set(statCompressRatio, expvar.Func(func() interface{} {
+		in, out := statInt(statCompressIn), statInt(statCompressOut)
+		if in == 0 {
+			return 1.0
+		}
+		return float64(out) / float64(in)
+	}))
+}
+
+func statInt(name string) int64 {
+	v, ok := stats.Get(name).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+// ParseCompression parses the --compress option, none or a comma separated
+// list in order of preference
+func ParseCompression(names string) ([]string, error) {
+	if names == "" || names == "none" {
+		return nil, nil
+	}
+	result := []string{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name != compressDeflate {
+			return nil, fmt.Errorf("unknown compression %q, expect deflate or none", name)
+		}
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+// negotiateCompression picks the first algorithm offered by the client which
+// the server accepts, empty for none
+func negotiateCompression(offered, accepted []string) string {
+	for _, name := range offered {
+		for _, a := range accepted {
+			if a == name {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// limitWriter collects the compressed packet, it gives up as soon as the
+// packet doesn't shrink
+type limitWriter struct {
+	buf   []byte
+	limit int
+}
+
+var errNoGain = fmt.Errorf("packet doesn't shrink")
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if len(w.buf)+len(p) > w.limit {
+		return 0, errNoGain
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+type deflater struct {
+	w   *flate.Writer
+	out limitWriter
+}
+
+// the state of a flate writer is large, it's shared by all the connections
+var deflaters = sync.Pool{
+	New: func() interface{} {
+		d := &deflater{}
+		d.w, _ = flate.NewWriter(&d.out, flate.BestSpeed)
+		return d
+	},
+}
+
+// compressPacket compresses buf, a raw packet of newRawPacket, into a new
+// pooled buffer and frees buf, or returns buf when it doesn't shrink
+func compressPacket(buf []byte) []byte {
+	data := buf[frameHeaderSize:]
+	if len(data) == 0 || data[0] != rawPacket {
+		return buf
+	}
+	stats.Add(statCompressIn, int64(len(data)))
+	if len(data) < compressMinSize {
+		stats.Add(statCompressOut, int64(len(data)))
+		stats.Add(statCompressSkipped, 1)
+		return buf
+	}
+	_, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return buf
+	}
+
+	d := deflaters.Get().(*deflater)
+	defer deflaters.Put(d)
+	d.out.buf = newPacketBuf(len(data))
+	d.out.buf = append(d.out.buf, data[:1+n]...)
+	d.out.buf[frameHeaderSize] = compressedPacket
+	d.out.limit = frameHeaderSize + len(data) - 1
+	d.w.Reset(&d.out)
+	_, err := d.w.Write(data[1+n:])
+	if err == nil {
+		err = d.w.Close()
+	}
+	out := d.out.buf
+	d.out.buf = nil
+	if err != nil {
+		freePacketBuf(out)
+		stats.Add(statCompressOut, int64(len(data)))
+		stats.Add(statCompressSkipped, 1)
+		return buf
+	}
+
+	freePacketBuf(buf)
+	stats.Add(statCompressOut, int64(len(out)-frameHeaderSize))
+	return out
+}
+
+type inflater struct {
+	r   io.ReadCloser
+	in  bytes.Reader
+	out []byte
+}
+
+var inflaters = sync.Pool{
+	New: func() interface{} {
+		// one more byte to tell a packet which is too large
+		f := &inflater{out: make([]byte, maxRawPacketSize+1)}
+		f.r = flate.NewReader(&f.in)
+		return f
+	},
+}
+
+// inflatePacket tells if data is a compressed packet, and hands it to
+// deliver as a raw packet, which is only valid during the call
+func inflatePacket(data []byte, deliver func([]byte)) (bool, error) {
+	if len(data) == 0 || data[0] != compressedPacket {
+		return false, nil
+	}
+	_, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return true, fmt.Errorf("invalid compressed packet")
+	}
+
+	f := inflaters.Get().(*inflater)
+	defer inflaters.Put(f)
+	f.in.Reset(data[1+n:])
+	err := f.r.(flate.Resetter).Reset(&f.in, nil)
+	if err != nil {
+		return true, err
+	}
+	copy(f.out, data[:1+n])
+	f.out[0] = rawPacket
+	size := 1 + n
+	for {
+		if size == len(f.out) {
+			return true, fmt.Errorf("compressed packet is too large")
+		}
+		var m int
+		m, err = f.r.Read(f.out[size:])
+		size += m
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return true, fmt.Errorf("decompress packet fail: %s", err)
+		}
+	}
+	deliver(f.out[:size])
+	return true, nil
+}
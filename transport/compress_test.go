@@ -0,0 +1,150 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+)
+
+func TestParseCompression(t *testing.T) {
+	for _, names := range []string{"", "none"} {
+		if list, err := ParseCompression(names); err != nil || list != nil {
+			t.Fatalf("bad: %q %v %v", names, list, err)
+		}
+	}
+	if list, err := ParseCompression("deflate"); err != nil || len(list) != 1 {
+		t.Fatalf("bad: %v %v", list, err)
+	}
+	if _, err := ParseCompression("zip"); err == nil {
+		t.Fatalf("bad: unknown compression accepted")
+	}
+}
+
+func runCompressionHandshake(key string, offered, accepted []string) (string, string, error, error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	type result struct {
+		chosen string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := serverHandshake(s, bufio.NewReader(s), key, &handshakeOffer{compression: accepted}, true, &bytes.Buffer{}, make([]byte, 65536))
+		if err != nil {
+			done <- result{"", err}
+			return
+		}
+		done <- result{res.compression, err}
+	}()
+	res, err := clientHandshake(c, bufio.NewReader(c), key, &handshakeOffer{compression: offered}, &bytes.Buffer{}, make([]byte, 65536))
+	server := <-done
+	if err != nil {
+		return "", server.chosen, err, server.err
+	}
+	return res.compression, server.chosen, err, server.err
+}
+
+func TestHandshake_Compression(t *testing.T) {
+	deflate := []string{compressDeflate}
+	for _, key := range []string{"hello-world", ""} {
+		client, server, clientErr, serverErr := runCompressionHandshake(key, deflate, deflate)
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("err: %v, %v", clientErr, serverErr)
+		}
+		if client != compressDeflate || server != compressDeflate {
+			t.Fatalf("bad: %q %q", client, server)
+		}
+
+		// both sides have to enable it
+		client, server, _, _ = runCompressionHandshake(key, deflate, nil)
+		if client != "" || server != "" {
+			t.Fatalf("bad: %q %q", client, server)
+		}
+		client, server, _, _ = runCompressionHandshake(key, nil, deflate)
+		if client != "" || server != "" {
+			t.Fatalf("bad: %q %q", client, server)
+		}
+	}
+}
+
+func TestHandshake_CompressionDowngrade(t *testing.T) {
+	h, _ := newHandshake("hello-world", nil)
+	h.compression = []string{compressDeflate}
+	hello := h.clientHello()
+
+	// strip the compression on the way
+	hello.Compression = nil
+	server, _ := newHandshake("hello-world", nil)
+	if _, _, err := server.respond(hello); err != ErrHandshake {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func inflated(t *testing.T, data []byte) []byte {
+	var out []byte
+	ok, err := inflatePacket(data, func(data []byte) { out = append([]byte(nil), data...) })
+	if !ok || err != nil {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	return out
+}
+
+func TestCompressPacket(t *testing.T) {
+	pkt := bytes.Repeat([]byte("GET /api/v1/logs HTTP/1.1\r\n"), 40)
+	skipped := statValue(statCompressSkipped)
+
+	buf := compressPacket(newRawPacket(7, pkt))
+	data := buf[frameHeaderSize:]
+	if data[0] != compressedPacket || len(data) >= len(pkt)/4 {
+		t.Fatalf("bad: %d bytes", len(data))
+	}
+	out := inflated(t, data)
+	if got, ok := ParsePacket(out); !ok || !bytes.Equal(got, pkt) || packetSeq(out) != 7 {
+		t.Fatalf("bad: %d bytes, seq %d", len(got), packetSeq(out))
+	}
+	freePacketBuf(buf)
+
+	// random bytes and small packets are sent as they are
+	random := make([]byte, 1400)
+	rand.Read(random)
+	for _, pkt := range [][]byte{random, []byte("ack")} {
+		buf := compressPacket(newRawPacket(0, pkt))
+		if got, ok := ParsePacket(buf[frameHeaderSize:]); !ok || !bytes.Equal(got, pkt) {
+			t.Fatalf("bad: %d bytes compressed", len(pkt))
+		}
+		freePacketBuf(buf)
+	}
+	if statValue(statCompressSkipped) != skipped+2 {
+		t.Fatalf("bad: %d skipped", statValue(statCompressSkipped)-skipped)
+	}
+}
+
+func TestInflatePacket(t *testing.T) {
+	if ok, _ := inflatePacket(newRawPacket(0, []byte("hello"))[frameHeaderSize:], nil); ok {
+		t.Fatalf("bad: raw packet taken for a compressed one")
+	}
+	if ok, err := inflatePacket([]byte{compressedPacket, 0, 1, 2, 3}, nil); !ok || err == nil {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	// a bomb doesn't get past the size of a frame
+	bomb := compressPacket(newRawPacket(0, make([]byte, 70000)))
+	if ok, err := inflatePacket(bomb[frameHeaderSize:], nil); !ok || err == nil {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+}
+
+func BenchmarkCompressPacket(b *testing.B) {
+	pkt := bytes.Repeat([]byte("GET /api/v1/logs HTTP/1.1\r\n"), 50)
+	b.SetBytes(int64(len(pkt)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := compressPacket(newRawPacket(0, pkt))
+		inflatePacket(buf[frameHeaderSize:], func([]byte) {})
+		freePacketBuf(buf)
+	}
+}
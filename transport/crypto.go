@@ -3,24 +3,89 @@ package transport
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"fmt"
+	"runtime"
+	"strings"
 
-	"github.com/matthewgao/qtun/utils"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
 )
 
-func makeAES128GCM(key string) (cipher.AEAD, error) {
-	bkey := utils.MD5([]byte(key))
-	block, err := aes.NewCipher(bkey)
+// CipherSuite is the aead used for the frames of a session, the client
+// offers its suites in order of preference in the handshake and the server
+// picks the first one it accepts
+type CipherSuite struct {
+	Name    string
+	keySize int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+var cipherSuites = map[string]*CipherSuite{
+	"aes-128-gcm":        {Name: "aes-128-gcm", keySize: 16, newAEAD: newAESGCM},
+	"aes-256-gcm":        {Name: "aes-256-gcm", keySize: 32, newAEAD: newAESGCM},
+	"chacha20-poly1305":  {Name: "chacha20-poly1305", keySize: chacha20poly1305.KeySize, newAEAD: chacha20poly1305.New},
+	"xchacha20-poly1305": {Name: "xchacha20-poly1305", keySize: chacha20poly1305.KeySize, newAEAD: chacha20poly1305.NewX},
+}
+
+// newAESGCM takes the raw key, 16 bytes for aes-128 and 32 for aes-256, the
+// session keys come from the handshake
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 	return cipher.NewGCM(block)
 }
 
-func makeAES256GCM(key string) (cipher.AEAD, error) {
-	bkey := utils.SHA256([]byte(key))
-	block, err := aes.NewCipher(bkey)
-	if err != nil {
-		return nil, err
+// hasAESHardware tells if aes-gcm is faster than chacha20-poly1305 here,
+// routers without aes instructions do a lot better with chacha
+func hasAESHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM
 	}
-	return cipher.NewGCM(block)
+	return false
+}
+
+func defaultCipherSuites() []string {
+	if hasAESHardware() {
+		return []string{"aes-128-gcm", "aes-256-gcm", "chacha20-poly1305", "xchacha20-poly1305"}
+	}
+	return []string{"chacha20-poly1305", "xchacha20-poly1305", "aes-128-gcm", "aes-256-gcm"}
+}
+
+// GetCipherSuites parses the --ciphers option, a comma separated list in
+// order of preference, auto picks all of them with the fastest one first
+func GetCipherSuites(names string) ([]*CipherSuite, error) {
+	list := defaultCipherSuites()
+	if names != "" && names != "auto" {
+		list = strings.Split(names, ",")
+	}
+
+	result := make([]*CipherSuite, 0, len(list))
+	for _, name := range list {
+		suite, ok := cipherSuites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher %q, expect aes-128-gcm, aes-256-gcm, chacha20-poly1305, xchacha20-poly1305 or auto", name)
+		}
+		result = append(result, suite)
+	}
+	return result, nil
+}
+
+// negotiateCipher picks the first suite offered by the client which the
+// server accepts
+func negotiateCipher(offered []string, accepted []*CipherSuite) (*CipherSuite, error) {
+	for _, name := range offered {
+		for _, suite := range accepted {
+			if suite.Name == name {
+				return suite, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no cipher in common, client offers %s", strings.Join(offered, ","))
 }
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGetCipherSuites(t *testing.T) {
+	suites, err := GetCipherSuites("auto")
+	if err != nil || len(suites) != len(cipherSuites) {
+		t.Fatalf("bad: %v %v", suites, err)
+	}
+
+	suites, err = GetCipherSuites("xchacha20-poly1305, aes-256-gcm")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(suites) != 2 || suites[0].Name != "xchacha20-poly1305" || suites[1].Name != "aes-256-gcm" {
+		t.Fatalf("bad: %v", suites)
+	}
+
+	if _, err := GetCipherSuites("aes-128-gcm,rc4"); err == nil {
+		t.Fatalf("bad: unknown cipher accepted")
+	}
+}
+
+func TestCipherSuites_Frame(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, secretSize)
+	for _, suite := range cipherSuites {
+		send, err := newSendKey(suite, secret)
+		if err != nil {
+			t.Fatalf("err: %s %v", suite.Name, err)
+		}
+		recv, err := newRecvKey(suite, secret)
+		if err != nil {
+			t.Fatalf("err: %s %v", suite.Name, err)
+		}
+
+		for i := 0; i < 3; i++ {
+			out, err := openFrame(recv, sealFrame(t, send, "ping"))
+			if err != nil || out != "ping" {
+				t.Fatalf("bad: %s %q %v", suite.Name, out, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package transport
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// how often the servers which are down are probed
+const healthCheckInterval = 10 * time.Second
+
+// Endpoint is one server of --remote_addrs, which is a comma separated list
+// of addresses with optional settings:
+//
+//	1.1.1.1:8080;priority=0;weight=2,2.2.2.2:8080;priority=1
+//
+// The servers with the lowest priority are used as long as one of them is
+// healthy, the connections are spread over them by weight
+type Endpoint struct {
+	Addr     string
+	Priority int
+	Weight   int
+	healthy  bool
+	// dial failures in a row, by the local address dialed from
+	failures map[string]int
+}
+
+func ParseEndpoints(addrs string) ([]*Endpoint, error) {
+	endpoints := []*Endpoint{}
+	for _, item := range strings.Split(addrs, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		fields := strings.Split(item, ";")
+		e := &Endpoint{Addr: fields[0], Weight: 1, healthy: true, failures: map[string]int{}}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid remote address option %q of %s, expect priority=n or weight=n", field, e.Addr)
+			}
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid remote address option %q of %s, expect a number", field, e.Addr)
+			}
+			switch kv[0] {
+			case "priority":
+				e.Priority = n
+			case "weight":
+				e.Weight = n
+			default:
+				return nil, fmt.Errorf("unknown remote address option %q of %s", kv[0], e.Addr)
+			}
+		}
+		endpoints = append(endpoints, e)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no remote address")
+	}
+
+	// the order of the list breaks the ties
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].Priority < endpoints[j].Priority
+	})
+	return endpoints, nil
+}
+
+// serverPool tracks the health of the endpoints, and tells each connection
+// slot of the client which endpoint it should use
+type serverPool struct {
+	endpoints []*Endpoint
+	downAfter int
+	binds     int
+	mutex     sync.RWMutex
+}
+
+// an endpoint is down after downAfter dial failures in a row, which gives
+// every carrier a chance before failing over to another server. With
+// several local binds it has to fail from all of them, a dead uplink is not
+// a dead server
+func newServerPool(endpoints []*Endpoint, downAfter, binds int) *serverPool {
+	if binds < 1 {
+		binds = 1
+	}
+	return &serverPool{
+		endpoints: endpoints,
+		downAfter: downAfter,
+		binds:     binds,
+	}
+}
+
+// activePriority is the lowest priority with a healthy endpoint
+func (p *serverPool) activePriority() int {
+	for _, e := range p.endpoints {
+		if e.healthy {
+			return e.Priority
+		}
+	}
+	// everything is down, keep trying the preferred ones
+	return p.endpoints[0].Priority
+}
+
+// pick returns the endpoint for the connection slot index, the slots are
+// spread over the endpoints of the active priority by weight
+func (p *serverPool) pick(index int) *Endpoint {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	priority := p.activePriority()
+	slots := []*Endpoint{}
+	for _, e := range p.endpoints {
+		if e.Priority != priority || (!e.healthy && p.hasHealthy(priority)) {
+			continue
+		}
+		for i := 0; i < e.Weight; i++ {
+			slots = append(slots, e)
+		}
+	}
+	if len(slots) == 0 {
+		// all the weights are 0
+		return p.endpoints[0]
+	}
+	return slots[index%len(slots)]
+}
+
+func (p *serverPool) hasHealthy(priority int) bool {
+	for _, e := range p.endpoints {
+		if e.Priority == priority && e.healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates are all the endpoints, the one of the slot first, in the
+// order they are tried when the client starts
+func (p *serverPool) candidates(index int) []*Endpoint {
+	first := p.pick(index)
+	result := []*Endpoint{first}
+	for _, e := range p.endpoints {
+		if e != first {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// fail records a dial failure from bind
+func (p *serverPool) fail(e *Endpoint, bind string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e.failures[bind]++
+	p.checkDown(e)
+}
+
+// down gives up the endpoint from bind at once, e.g. every carrier has failed
+func (p *serverPool) down(e *Endpoint, bind string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e.failures[bind] = p.downAfter
+	p.checkDown(e)
+}
+
+func (p *serverPool) checkDown(e *Endpoint) {
+	failed := 0
+	for _, n := range e.failures {
+		if n >= p.downAfter {
+			failed++
+		}
+	}
+	if failed < p.binds || !e.healthy {
+		return
+	}
+	e.healthy = false
+	log.Warn().Str("server_addr", e.Addr).Int("priority", e.Priority).
+		Msg("server is down, fail over")
+}
+
+// succeed records a successful connection, it returns true when the
+// endpoint comes back
+func (p *serverPool) succeed(e *Endpoint) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e.failures = map[string]int{}
+	if !e.healthy {
+		e.healthy = true
+		log.Info().Str("server_addr", e.Addr).Int("priority", e.Priority).
+			Msg("server is back")
+		return true
+	}
+	return false
+}
+
+// probeTargets are the endpoints which are down
+func (p *serverPool) probeTargets() []*Endpoint {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	targets := []*Endpoint{}
+	for _, e := range p.endpoints {
+		if !e.healthy {
+			targets = append(targets, e)
+		}
+	}
+	return targets
+}
+
+// healthCheck probes the endpoints which are down, onBack is called when
+// one of them comes back so the connections can fail back
+func (p *serverPool) healthCheck(probe func(e *Endpoint) error, onBack func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error().Interface("err", err).Msg("server health check panic")
+		}
+	}()
+
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, e := range p.probeTargets() {
+			err := probe(e)
+			if err != nil {
+				log.Debug().Err(err).Str("server_addr", e.Addr).Msg("server health check fail")
+				continue
+			}
+			if p.succeed(e) {
+				onBack()
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matthewgao/qtun/config"
+)
+
+func TestParseEndpoints(t *testing.T) {
+	endpoints, err := ParseEndpoints("3.3.3.3:8080;priority=1, 1.1.1.1:8080;weight=2,2.2.2.2:8080")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(endpoints) != 3 {
+		t.Fatalf("bad: %d endpoints", len(endpoints))
+	}
+
+	// sorted by priority, the order of the list breaks the ties
+	expect := []Endpoint{
+		{Addr: "1.1.1.1:8080", Priority: 0, Weight: 2},
+		{Addr: "2.2.2.2:8080", Priority: 0, Weight: 1},
+		{Addr: "3.3.3.3:8080", Priority: 1, Weight: 1},
+	}
+	for i, e := range endpoints {
+		if e.Addr != expect[i].Addr || e.Priority != expect[i].Priority || e.Weight != expect[i].Weight || !e.healthy {
+			t.Fatalf("bad: %d %+v", i, e)
+		}
+	}
+
+	for _, addrs := range []string{"", "1.1.1.1:8080;priority", "1.1.1.1:8080;weight=-1", "1.1.1.1:8080;port=1"} {
+		if _, err := ParseEndpoints(addrs); err == nil {
+			t.Fatalf("bad: %q accepted", addrs)
+		}
+	}
+}
+
+func TestServerPool_Pick(t *testing.T) {
+	endpoints, _ := ParseEndpoints("1.1.1.1:8080;weight=2,2.2.2.2:8080,3.3.3.3:8080;priority=1")
+	pool := newServerPool(endpoints, 1, 1)
+
+	count := map[string]int{}
+	for i := 0; i < 6; i++ {
+		count[pool.pick(i).Addr]++
+	}
+	if count["1.1.1.1:8080"] != 4 || count["2.2.2.2:8080"] != 2 {
+		t.Fatalf("bad: %v", count)
+	}
+
+	candidates := pool.candidates(2)
+	if len(candidates) != 3 || candidates[0].Addr != "2.2.2.2:8080" {
+		t.Fatalf("bad: %v", candidates)
+	}
+}
+
+func TestServerPool_Failover(t *testing.T) {
+	endpoints, _ := ParseEndpoints("1.1.1.1:8080,2.2.2.2:8080;priority=1")
+	primary, backup := endpoints[0], endpoints[1]
+	pool := newServerPool(endpoints, 2, 1)
+
+	pool.fail(primary, "")
+	if pool.pick(0) != primary {
+		t.Fatalf("bad: failed over after one failure")
+	}
+	pool.fail(primary, "")
+	if pool.pick(0) != backup {
+		t.Fatalf("bad: %s, expect the backup", pool.pick(0).Addr)
+	}
+	if targets := pool.probeTargets(); len(targets) != 1 || targets[0] != primary {
+		t.Fatalf("bad: %v", targets)
+	}
+
+	// everything is down, keep trying the preferred one
+	pool.down(backup, "")
+	if pool.pick(0) != primary {
+		t.Fatalf("bad: %s, expect the primary", pool.pick(0).Addr)
+	}
+
+	if !pool.succeed(backup) || pool.pick(0) != backup {
+		t.Fatalf("bad: backup is not back")
+	}
+	if !pool.succeed(primary) || pool.pick(0) != primary {
+		t.Fatalf("bad: no fail back to the primary")
+	}
+	if pool.succeed(primary) {
+		t.Fatalf("bad: healthy server came back")
+	}
+	if len(primary.failures) != 0 {
+		t.Fatalf("bad: %v failures", primary.failures)
+	}
+}
+
+func TestServerPool_Binds(t *testing.T) {
+	endpoints, _ := ParseEndpoints("1.1.1.1:8080,2.2.2.2:8080;priority=1")
+	primary := endpoints[0]
+	pool := newServerPool(endpoints, 1, 2)
+
+	// a dead uplink is not a dead server
+	pool.fail(primary, "eth0")
+	pool.fail(primary, "eth0")
+	if pool.pick(0) != primary {
+		t.Fatalf("bad: failed over on one bind")
+	}
+	pool.down(primary, "wwan0")
+	if pool.pick(0) == primary {
+		t.Fatalf("bad: no fail over")
+	}
+}
+
+func TestClient_StartDeadServer(t *testing.T) {
+	config.InitConfig(config.Config{})
+	// the server takes the connections and never answers the tls handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	accepted := make(chan net.Conn, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	endpoints, _ := ParseEndpoints(l.Addr().String())
+	clientTLS, err := NewClientTLS("", "", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c := NewClient(endpoints, "hello-world", 2, nil, []Carrier{&tcpCarrier{}}, clientTLS)
+	// no ping goes out before the lease, the pinger outlives the test
+	c.EnableLease("test")
+	start := time.Now()
+	c.Start()
+	if time.Since(start) > time.Second {
+		t.Fatalf("bad: start held up %v by the dead server", time.Since(start))
+	}
+
+	// the handshakes fail and the slots wait for the next attempt
+	l.Close()
+	for conn := range accepted {
+		conn.Close()
+	}
+	c.Stop()
+}
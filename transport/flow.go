@@ -0,0 +1,39 @@
+package transport
+
+import (
+	"hash/fnv"
+)
+
+// the packets of a flow are pinned to one connection, so they arrive in the
+// order they were sent, see iface.PacketIP.FlowHash. The connection is
+// picked by rendezvous hashing: each one gets a score for the flow and the
+// highest wins, when a connection goes away only its own flows move, and
+// they are spread over the others
+func flowScore(flow uint32, key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	// the finalizer of murmur3, every bit of the input flips half of the
+	// output, which fnv alone doesn't do for the high bits
+	x := flow ^ h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// PickFlow returns the index of the key the flow is pinned to, -1 when
+// there is none
+func PickFlow(flow uint32, keys []string) int {
+	best := -1
+	var bestScore uint32
+	for i, key := range keys {
+		score := flowScore(flow, key)
+		if best < 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
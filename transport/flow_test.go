@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"testing"
+
+	"github.com/matthewgao/qtun/iface"
+)
+
+func tcpPacket(srcPort, dstPort byte) iface.PacketIP {
+	pkt := iface.NewPacketIP(40)
+	pkt[0] = 0x45
+	pkt[9] = 6
+	copy(pkt[12:20], []byte{10, 4, 4, 3, 10, 4, 4, 2})
+	pkt[21], pkt[23] = srcPort, dstPort
+	return pkt
+}
+
+func TestFlowHash(t *testing.T) {
+	a := tcpPacket(1, 80)
+	if a.FlowHash() != tcpPacket(1, 80).FlowHash() {
+		t.Fatalf("bad: same flow, different hash")
+	}
+	if a.FlowHash() == tcpPacket(2, 80).FlowHash() {
+		t.Fatalf("bad: port is not hashed")
+	}
+
+	// the fragments of a packet stay with each other
+	first, next := tcpPacket(1, 80), tcpPacket(2, 81)
+	first[6], next[7] = 0x20, 0x10
+	if first.FlowHash() != next.FlowHash() {
+		t.Fatalf("bad: fragments hashed by port")
+	}
+
+	if iface.PacketIP([]byte{0x45}).FlowHash() != 0 {
+		t.Fatalf("bad: short packet")
+	}
+}
+
+func TestPickFlow(t *testing.T) {
+	keys := []string{"a", "b", "c", "d"}
+	if PickFlow(1, nil) != -1 {
+		t.Fatalf("bad: pick from nothing")
+	}
+
+	count := make([]int, len(keys))
+	picked := map[uint32]int{}
+	for port := 0; port < 1000; port++ {
+		flow := tcpPacket(byte(port), byte(port>>8)).FlowHash()
+		picked[flow] = PickFlow(flow, keys)
+		count[picked[flow]]++
+	}
+	for i, n := range count {
+		if n < 150 {
+			t.Fatalf("bad: %s got %d flows", keys[i], n)
+		}
+	}
+
+	// only the flows of the connection which goes away move
+	for flow, i := range picked {
+		j := PickFlow(flow, keys[:3])
+		if i != 3 && i != j {
+			t.Fatalf("bad: flow moved from %s to %s", keys[i], keys[j])
+		}
+	}
+}
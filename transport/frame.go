@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+var ErrFrameTooLarge = fmt.Errorf("frame is larger than the max frame size")
+
+const (
+	// secure(1) | len(4)
+	frameHeaderSize = 5
+
+	// each side tells the largest frame it accepts in the handshake, len
+	// doesn't count the header and the nonce. The read buffers are that
+	// large, so it's bounded by maxFrameLimit
+	defaultMaxFrame = 64 * 1024
+	minMaxFrame     = 4 * 1024
+	maxFrameLimit   = 16 * 1024 * 1024
+)
+
+// CheckMaxFrame validates --max_frame, the frames have to carry the packets
+// of the tun device
+func CheckMaxFrame(maxFrame, mtu int) error {
+	if maxFrame < minMaxFrame || maxFrame > maxFrameLimit {
+		return fmt.Errorf("invalid max frame %d, expect %d to %d", maxFrame, minMaxFrame, maxFrameLimit)
+	}
+	if mtu > maxPacketSize {
+		return fmt.Errorf("invalid mtu %d, expect at most %d", mtu, maxPacketSize)
+	}
+	if need := 1 + binary.MaxVarintLen64 + mtu + frameOverhead; maxFrame < need {
+		return fmt.Errorf("max frame %d is too small for mtu %d, expect at least %d", maxFrame, mtu, need)
+	}
+	return nil
+}
+
+// newFrameBuf returns a read buffer for frames up to maxFrame, with the room
+// for the nonce behind them
+func newFrameBuf(maxFrame int) []byte {
+	return make([]byte, maxFrame+frameOverhead)
+}
+
+// encodeFrame writes data into buf using the wire format shared by the
+// stream and the datagram path: secure(1) | len(4) | payload | nonce, the
+// secure byte carries the key phase and paddedFlag, see sendKey and obfuscator
+func encodeFrame(buf *bytes.Buffer, key *sendKey, data []byte) error {
+	buf.Reset()
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(data)+frameOverhead)
+	frame = sealInPlace(append(frame, data...), key, 0)
+	_, err := buf.Write(frame)
+	return err
+}
+
+// sealInPlace turns buf, frameHeaderSize bytes of headroom followed by the
+// payload, into a frame in place. The tag and the nonce are appended, so
+// nothing is allocated when buf has frameOverhead bytes of room left. pad
+// bytes of padding are added inside the encryption, see obfuscator
+func sealInPlace(buf []byte, key *sendKey, pad int) []byte {
+	room := frameOverhead
+	if pad > 0 {
+		room += pad + 2
+	}
+	if len(buf)+room > cap(buf) {
+		buf = append(make([]byte, 0, len(buf)+room), buf...)
+	}
+
+	var flag uint8
+	if pad > 0 {
+		buf = addPadding(buf, pad)
+		flag = paddedFlag
+	}
+	payload := buf[frameHeaderSize:]
+	if key == nil {
+		buf[0] = flag
+		binary.LittleEndian.PutUint32(buf[1:], uint32(len(payload)))
+		return buf
+	}
+
+	sealed, nonce, phase := key.seal(payload)
+	buf[0] = phaseBit(phase) | flag
+	binary.LittleEndian.PutUint32(buf[1:], uint32(len(sealed)))
+	buf = buf[:frameHeaderSize+len(sealed)]
+	return append(buf, nonce...)
+}
+
+// sealLimited seals buf like sealInPlace unless the frame is larger than
+// maxFrame, the limit of the peer, then it's dropped and false returned.
+// The padding is cut to fit
+func sealLimited(buf []byte, key *sendKey, pad, maxFrame int) ([]byte, bool) {
+	size := len(buf) - frameHeaderSize + frameOverhead
+	if size > maxFrame {
+		stats.Add(statOversize, 1)
+		return nil, false
+	}
+	if pad > 0 && size+pad+2 > maxFrame {
+		pad = maxFrame - size - 2
+	}
+	return sealInPlace(buf, key, pad), true
+}
+
+// decodeFrame reads one frame from reader, buf is used as the scratch space
+// for the payload so the returned slice is only valid until the next call.
+// A frame larger than buf is refused, see newFrameBuf
+func decodeFrame(reader io.Reader, key *recvKey, buf []byte) ([]byte, error) {
+	_, err := io.ReadFull(reader, buf[:frameHeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	secure, padded := buf[0]&^paddedFlag, buf[0]&paddedFlag != 0
+	dataLen := int(binary.LittleEndian.Uint32(buf[1:]))
+	if dataLen < 0 || dataLen > len(buf) {
+		// the stream can't be trusted any more
+		return nil, ErrFrameTooLarge
+	}
+	_, err = io.ReadFull(reader, buf[:dataLen])
+	if err != nil {
+		return nil, err
+	}
+	if secure == 0 {
+		if key != nil {
+			// never let a peer downgrade an encrypted session
+			stats.Add(statPlaintext, 1)
+			return nil, ErrPlaintext
+		}
+		if padded {
+			return stripPadding(buf[:dataLen])
+		}
+		return buf[:dataLen], nil
+	}
+
+	if key == nil {
+		return nil, ErrCiperNotMatch
+	}
+	// the nonce goes behind the payload when there's room
+	var nonce []byte
+	if nonceSize := key.nonceSize(); dataLen+nonceSize <= len(buf) {
+		nonce = buf[dataLen : dataLen+nonceSize]
+	} else {
+		nonce = make([]byte, nonceSize)
+	}
+	_, err = io.ReadFull(reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	data, err := key.open(secure, nonce, buf[:dataLen])
+	if err != nil || !padded {
+		return data, err
+	}
+	return stripPadding(data)
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestFrame_RoundTrip(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, secretSize)
+	send, err := newSendKey(cipherSuites["aes-128-gcm"], secret)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	recv, err := newRecvKey(cipherSuites["aes-128-gcm"], secret)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, keys := range []*sessionKeys{{}, {send: send, recv: recv}} {
+		buf := &bytes.Buffer{}
+		if err := encodeFrame(buf, keys.send, []byte("ping")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		out, err := decodeFrame(bytes.NewReader(buf.Bytes()), keys.recv, make([]byte, 65536))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(out) != "ping" {
+			t.Fatalf("bad: %q", out)
+		}
+	}
+}
+
+func TestFrame_WrongKey(t *testing.T) {
+	a, _ := newSendKey(cipherSuites["aes-128-gcm"], bytes.Repeat([]byte{1}, secretSize))
+	b, _ := newRecvKey(cipherSuites["aes-128-gcm"], bytes.Repeat([]byte{2}, secretSize))
+
+	buf := &bytes.Buffer{}
+	if err := encodeFrame(buf, a, []byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, err := decodeFrame(buf, b, make([]byte, 65536))
+	if err != ErrCiperNotMatch {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestFrame_Downgrade(t *testing.T) {
+	_, recv := testKeys(t)
+
+	buf := &bytes.Buffer{}
+	if err := encodeFrame(buf, nil, []byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := decodeFrame(buf, recv, make([]byte, 65536)); err != ErrPlaintext {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestFrame_Large(t *testing.T) {
+	send, recv := testKeys(t)
+	data := bytes.Repeat([]byte("a"), 200*1024)
+
+	buf := &bytes.Buffer{}
+	if err := encodeFrame(buf, send, data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	frame := append([]byte{}, buf.Bytes()...)
+	out, err := decodeFrame(bytes.NewReader(frame), recv, newFrameBuf(256*1024))
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("bad: %d bytes, %v", len(out), err)
+	}
+
+	// larger than the read buffer, nothing is read behind the header
+	reader := bytes.NewReader(frame)
+	if _, err := decodeFrame(reader, recv, newFrameBuf(defaultMaxFrame)); err != ErrFrameTooLarge {
+		t.Fatalf("bad: %v", err)
+	}
+	if reader.Len() != len(frame)-frameHeaderSize {
+		t.Fatalf("bad: %d bytes read", len(frame)-reader.Len())
+	}
+}
+
+func TestSealLimited(t *testing.T) {
+	send, _ := testKeys(t)
+	dropped := statValue(statOversize)
+
+	buf := append(newPacketBuf(100), make([]byte, 100)...)
+	if _, ok := sealLimited(buf, send, 0, 100+frameOverhead-1); ok || statValue(statOversize) != dropped+1 {
+		t.Fatalf("bad: oversize frame sent")
+	}
+
+	// the padding is cut to fit
+	frame, ok := sealLimited(buf, send, maxPadding, 200)
+	if !ok {
+		t.Fatalf("bad: frame dropped")
+	}
+	if size := binary.LittleEndian.Uint32(frame[1:]); size+uint32(send.aead.NonceSize()) > 200 {
+		t.Fatalf("bad: %d bytes", size)
+	}
+}
+
+func TestCheckMaxFrame(t *testing.T) {
+	if err := CheckMaxFrame(defaultMaxFrame, 9000); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, v := range [][2]int{{minMaxFrame - 1, 1500}, {maxFrameLimit + 1, 1500}, {defaultMaxFrame, 65535}, {1 << 20, 65536}} {
+		if err := CheckMaxFrame(v[0], v[1]); err == nil {
+			t.Fatalf("bad: %v accepted", v)
+		}
+	}
+}
+
+func TestHandshake_MaxFrame(t *testing.T) {
+	for _, key := range []string{"hello-world", ""} {
+		client, server, clientErr, serverErr := runHandshakeOffer(key, key,
+			&handshakeOffer{maxFrame: 1 << 20}, &handshakeOffer{}, true)
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("err: %v, %v", clientErr, serverErr)
+		}
+		if client.maxFrame != defaultMaxFrame || server.maxFrame != 1<<20 {
+			t.Fatalf("bad: %d %d", client.maxFrame, server.maxFrame)
+		}
+	}
+
+	_, _, _, serverErr := runHandshakeOffer("hello-world", "hello-world",
+		&handshakeOffer{maxFrame: 100}, &handshakeOffer{}, false)
+	if serverErr == nil {
+		t.Fatalf("bad: tiny max frame accepted")
+	}
+}
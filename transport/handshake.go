@@ -0,0 +1,441 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/matthewgao/qtun/protocol"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrHandshake = fmt.Errorf("handshake fail, the peer doesn't know the key")
+	ErrPlaintext = fmt.Errorf("unencrypted frame on an encrypted session")
+)
+
+// a client without --key sends an empty hello to ask for an unencrypted
+// session, which the server accepts or refuses by its PlaintextPolicy
+//
+// handshake is an ephemeral x25519 key exchange, authenticated by the
+// pre-shared key, run in plaintext frames right after the connection is
+// established:
+//
+//	client -> server: client public key | client nonce | offered ciphers | session | offered compression | max frame | mac
+//	server -> client: server public key | server nonce | chosen cipher | chosen compression | max frame | epoch | mac
+//
+// each side proves it knows the key with a hmac over the transcript so far,
+// and both derive the session keys with hkdf from the x25519 shared secret,
+// salted by the key. A leaked key doesn't decrypt recorded traffic, and a
+// replayed hello gets nowhere without the matching private key. The ciphers
+// and the compression are covered by the mac, so they can't be downgraded on
+// the way. Each side tells the largest frame it accepts, see CheckMaxFrame.
+// The server echoes the epoch of the bonded session the connection joins
+type handshake struct {
+	psk         []byte
+	private     []byte
+	suites      []*CipherSuite
+	compression []string
+	hello       *protocol.MessageHandshake
+}
+
+// handshakeOffer is what one side brings to the handshake, the client
+// offers the ciphers and the compression in order of preference, the server
+// accepts them
+type handshakeOffer struct {
+	suites      []*CipherSuite
+	compression []string
+	// the largest frame this side accepts, defaultMaxFrame when 0
+	maxFrame int
+	// the bonded session the connection joins, only for the client
+	session []byte
+	// join puts the connection into the bonded session of the client, and
+	// returns the epoch of the session echoed to the client, only for the
+	// server
+	join func(session []byte) uint64
+}
+
+// handshakeResult is what the two sides agreed on, keys is nil for an
+// unencrypted session
+type handshakeResult struct {
+	keys        *sessionKeys
+	session     []byte
+	compression string
+	// the largest frame the peer accepts
+	maxFrame int
+	// the epoch of the bonded session echoed by the server, it changes when
+	// the server starts the session over
+	epoch uint64
+}
+
+const (
+	// the connection is closed if the peer doesn't finish the handshake in time
+	handshakeTimeout   = 10 * time.Second
+	handshakeNonceSize = 32
+)
+
+// sessionKeys are one secret per direction, so the two sides never seal
+// with the same key
+type sessionKeys struct {
+	send *sendKey
+	recv *recvKey
+}
+
+// suites are the offered ciphers on the client, the accepted ones on the server
+func newHandshake(key string, suites []*CipherSuite) (*handshake, error) {
+	if suites == nil {
+		suites, _ = GetCipherSuites("auto")
+	}
+	private := make([]byte, curve25519.ScalarSize)
+	_, err := io.ReadFull(crand.Reader, private)
+	if err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, handshakeNonceSize)
+	_, err = io.ReadFull(crand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	psk := sha256.Sum256([]byte(key))
+	return &handshake{
+		psk:     psk[:],
+		private: private,
+		suites:  suites,
+		hello:   &protocol.MessageHandshake{PublicKey: public, Nonce: nonce},
+	}, nil
+}
+
+func (h *handshake) mac(label string, msgs ...*protocol.MessageHandshake) []byte {
+	mac := hmac.New(sha256.New, h.psk)
+	mac.Write([]byte(label))
+	for _, msg := range msgs {
+		mac.Write(msg.PublicKey)
+		mac.Write(msg.Nonce)
+		for _, name := range msg.Ciphers {
+			mac.Write([]byte(name))
+			mac.Write([]byte{0})
+		}
+		mac.Write(msg.Session)
+		for _, name := range msg.Compression {
+			mac.Write([]byte(name))
+			mac.Write([]byte{0})
+		}
+		mac.Write(binary.BigEndian.AppendUint32(nil, msg.MaxFrame))
+		mac.Write(binary.BigEndian.AppendUint64(nil, msg.Epoch))
+	}
+	return mac.Sum(nil)
+}
+
+func validHello(msg *protocol.MessageHandshake) bool {
+	return msg != nil && len(msg.PublicKey) == curve25519.PointSize &&
+		len(msg.Nonce) == handshakeNonceSize
+}
+
+// clientHello is the first message sent by the client
+func (h *handshake) clientHello() *protocol.MessageHandshake {
+	for _, suite := range h.suites {
+		h.hello.Ciphers = append(h.hello.Ciphers, suite.Name)
+	}
+	h.hello.Compression = h.compression
+	h.hello.MAC = h.mac("qtun client", h.hello)
+	return h.hello
+}
+
+// respond checks the client hello and answers it, it's called by the server
+func (h *handshake) respond(client *protocol.MessageHandshake) (*protocol.MessageHandshake, *sessionKeys, error) {
+	if err := h.verify(client); err != nil {
+		return nil, nil, err
+	}
+	suite, err := negotiateCipher(client.Ciphers, h.suites)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.hello.Ciphers = []string{suite.Name}
+	if name := negotiateCompression(client.Compression, h.compression); name != "" {
+		h.hello.Compression = []string{name}
+	}
+	h.hello.MAC = h.mac("qtun server", client, h.hello)
+
+	c2s, s2c, err := h.derive(client, h.hello, client.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, err := newSessionKeys(suite, s2c, c2s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h.hello, keys, nil
+}
+
+// verify checks the hello of the client was made with the same key
+func (h *handshake) verify(client *protocol.MessageHandshake) error {
+	if !validHello(client) || !hmac.Equal(client.MAC, h.mac("qtun client", client)) {
+		return ErrHandshake
+	}
+	return nil
+}
+
+// finish checks the server answer, it's called by the client
+func (h *handshake) finish(server *protocol.MessageHandshake) (*sessionKeys, error) {
+	if !validHello(server) || !hmac.Equal(server.MAC, h.mac("qtun server", h.hello, server)) {
+		return nil, ErrHandshake
+	}
+	if len(server.Ciphers) != 1 {
+		return nil, fmt.Errorf("server chose %d ciphers", len(server.Ciphers))
+	}
+	suite, err := negotiateCipher(server.Ciphers, h.suites)
+	if err != nil {
+		return nil, fmt.Errorf("server chose a cipher not offered: %s", server.Ciphers[0])
+	}
+
+	c2s, s2c, err := h.derive(h.hello, server, server.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return newSessionKeys(suite, c2s, s2c)
+}
+
+func newSessionKeys(suite *CipherSuite, sendSecret, recvSecret []byte) (*sessionKeys, error) {
+	send, err := newSendKey(suite, sendSecret)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newRecvKey(suite, recvSecret)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionKeys{send: send, recv: recv}, nil
+}
+
+func (h *handshake) derive(client, server *protocol.MessageHandshake, peer []byte) (c2s, s2c []byte, err error) {
+	shared, err := curve25519.X25519(h.private, peer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the macs cover the whole transcript
+	info := bytes.Join([][]byte{[]byte("qtun session"), client.MAC, server.MAC}, nil)
+	kdf := hkdf.New(sha256.New, shared, h.psk, info)
+
+	secrets := make([]byte, 2*secretSize)
+	_, err = io.ReadFull(kdf, secrets)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secrets[:secretSize], secrets[secretSize:], nil
+}
+
+func writeHandshake(w io.Writer, buf *bytes.Buffer, msg *protocol.MessageHandshake) error {
+	data, err := proto.Marshal(&protocol.Envelope{
+		Type: &protocol.Envelope_Handshake{Handshake: msg},
+	})
+	if err != nil {
+		return err
+	}
+	err = encodeFrame(buf, nil, data)
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+func readHandshake(reader *bufio.Reader, buf []byte) (*protocol.MessageHandshake, error) {
+	data, err := decodeFrame(reader, nil, buf)
+	if err == ErrCiperNotMatch {
+		// the peer skipped the handshake and sent an encrypted frame
+		return nil, ErrHandshake
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := protocol.Envelope{}
+	err = proto.Unmarshal(data, &envelope)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal handshake fail: %s", err)
+	}
+	msg := envelope.GetHandshake()
+	if msg == nil {
+		return nil, fmt.Errorf("expect a handshake, the peer runs an old version?")
+	}
+	return msg, nil
+}
+
+func plaintextHello(msg *protocol.MessageHandshake) bool {
+	return len(msg.PublicKey) == 0
+}
+
+// chosenCompression checks the compression picked by the server was offered
+func chosenCompression(msg *protocol.MessageHandshake, offered []string) (string, error) {
+	if len(msg.Compression) == 0 {
+		return "", nil
+	}
+	if len(msg.Compression) != 1 || negotiateCompression(msg.Compression, offered) == "" {
+		return "", fmt.Errorf("server chose a compression not offered: %v", msg.Compression)
+	}
+	return msg.Compression[0], nil
+}
+
+// peerMaxFrame returns the limit told by the peer, a peer which doesn't say
+// gets the default
+func peerMaxFrame(msg *protocol.MessageHandshake) (int, error) {
+	if msg.MaxFrame == 0 {
+		return defaultMaxFrame, nil
+	}
+	if msg.MaxFrame < minMaxFrame {
+		return 0, fmt.Errorf("peer accepts frames up to %d bytes, too small", msg.MaxFrame)
+	}
+	if msg.MaxFrame > maxFrameLimit {
+		return maxFrameLimit, nil
+	}
+	return int(msg.MaxFrame), nil
+}
+
+func (o *handshakeOffer) localMaxFrame() uint32 {
+	if o.maxFrame == 0 {
+		return defaultMaxFrame
+	}
+	return uint32(o.maxFrame)
+}
+
+// clientHandshake runs the client side of the handshake over conn
+func clientHandshake(conn io.Writer, reader *bufio.Reader, key string, offer *handshakeOffer, buf *bytes.Buffer, readBuf []byte) (*handshakeResult, error) {
+	if offer == nil {
+		offer = &handshakeOffer{}
+	}
+	var msg *protocol.MessageHandshake
+	result := &handshakeResult{session: offer.session}
+	if key == "" {
+		err := writeHandshake(conn, buf, &protocol.MessageHandshake{
+			Session:     offer.session,
+			Compression: offer.compression,
+			MaxFrame:    offer.localMaxFrame(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		msg, err = readHandshake(reader, readBuf)
+		if err != nil {
+			return nil, fmt.Errorf("%s, the server may refuse unencrypted sessions", err)
+		}
+		if !plaintextHello(msg) {
+			return nil, fmt.Errorf("the server requires encryption, please set --key")
+		}
+	} else {
+		h, err := newHandshake(key, offer.suites)
+		if err != nil {
+			return nil, err
+		}
+		h.hello.Session = offer.session
+		h.hello.MaxFrame = offer.localMaxFrame()
+		h.compression = offer.compression
+		err = writeHandshake(conn, buf, h.clientHello())
+		if err != nil {
+			return nil, err
+		}
+		msg, err = readHandshake(reader, readBuf)
+		if err != nil {
+			return nil, err
+		}
+		result.keys, err = h.finish(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	result.compression, err = chosenCompression(msg, offer.compression)
+	if err != nil {
+		return nil, err
+	}
+	result.maxFrame, err = peerMaxFrame(msg)
+	if err != nil {
+		return nil, err
+	}
+	result.epoch = msg.Epoch
+	return result, nil
+}
+
+// serverHandshake runs the server side of the handshake over conn, an
+// unencrypted session needs allowPlaintext. The result carries the bonded
+// session id sent by the client
+func serverHandshake(conn io.Writer, reader *bufio.Reader, key string, offer *handshakeOffer, allowPlaintext bool, buf *bytes.Buffer, readBuf []byte) (*handshakeResult, error) {
+	if offer == nil {
+		offer = &handshakeOffer{}
+	}
+	msg, err := readHandshake(reader, readBuf)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Session) != 0 && len(msg.Session) != sessionIDSize {
+		return nil, fmt.Errorf("invalid session id of %d bytes", len(msg.Session))
+	}
+	result := &handshakeResult{session: msg.Session}
+	result.maxFrame, err = peerMaxFrame(msg)
+	if err != nil {
+		return nil, err
+	}
+	// the session is only joined by a client which is let in, the answer
+	// carries its epoch
+	join := func() {
+		if len(msg.Session) != 0 && offer.join != nil {
+			result.epoch = offer.join(msg.Session)
+		}
+	}
+
+	if plaintextHello(msg) {
+		if !allowPlaintext {
+			return nil, fmt.Errorf("client asks for an unencrypted session, refused, see --insecure and --plaintext_from")
+		}
+		join()
+		resp := &protocol.MessageHandshake{MaxFrame: offer.localMaxFrame(), Epoch: result.epoch}
+		result.compression = negotiateCompression(msg.Compression, offer.compression)
+		if result.compression != "" {
+			resp.Compression = []string{result.compression}
+		}
+		return result, writeHandshake(conn, buf, resp)
+	}
+	if key == "" {
+		return nil, fmt.Errorf("client asks for an encrypted session, but the server runs without --key")
+	}
+
+	h, err := newHandshake(key, offer.suites)
+	if err != nil {
+		return nil, err
+	}
+	err = h.verify(msg)
+	if err != nil {
+		return nil, err
+	}
+	join()
+	h.hello.MaxFrame = offer.localMaxFrame()
+	h.hello.Epoch = result.epoch
+	h.compression = offer.compression
+	resp, keys, err := h.respond(msg)
+	if err != nil {
+		return nil, err
+	}
+	err = writeHandshake(conn, buf, resp)
+	if err != nil {
+		return nil, err
+	}
+	result.keys = keys
+	if len(resp.Compression) == 1 {
+		result.compression = resp.Compression[0]
+	}
+	return result, nil
+}
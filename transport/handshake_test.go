@@ -0,0 +1,186 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func runHandshake(clientKey, serverKey string, clientSuites, serverSuites []*CipherSuite) (*sessionKeys, *sessionKeys, error, error) {
+	return runHandshakePolicy(clientKey, serverKey, clientSuites, serverSuites, false)
+}
+
+func runHandshakePolicy(clientKey, serverKey string, clientSuites, serverSuites []*CipherSuite, allowPlaintext bool) (*sessionKeys, *sessionKeys, error, error) {
+	client, server, clientErr, serverErr := runHandshakeOffer(clientKey, serverKey,
+		&handshakeOffer{suites: clientSuites}, &handshakeOffer{suites: serverSuites}, allowPlaintext)
+	if clientErr != nil || serverErr != nil {
+		return nil, nil, clientErr, serverErr
+	}
+	return client.keys, server.keys, nil, nil
+}
+
+func runHandshakeOffer(clientKey, serverKey string, clientOffer, serverOffer *handshakeOffer, allowPlaintext bool) (*handshakeResult, *handshakeResult, error, error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	type result struct {
+		res *handshakeResult
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := serverHandshake(s, bufio.NewReader(s), serverKey, serverOffer, allowPlaintext, &bytes.Buffer{}, make([]byte, 65536))
+		if err != nil {
+			// unblock the client waiting for the answer
+			s.Close()
+		}
+		done <- result{res, err}
+	}()
+
+	client, clientErr := clientHandshake(c, bufio.NewReader(c), clientKey, clientOffer, &bytes.Buffer{}, make([]byte, 65536))
+	server := <-done
+	return client, server.res, clientErr, server.err
+}
+
+func TestHandshake(t *testing.T) {
+	client, server, clientErr, serverErr := runHandshake("hello-world", "hello-world", nil, nil)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("err: %v, %v", clientErr, serverErr)
+	}
+
+	// client -> server
+	buf := &bytes.Buffer{}
+	if err := encodeFrame(buf, client.send, []byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := decodeFrame(bytes.NewReader(buf.Bytes()), server.recv, make([]byte, 65536))
+	if err != nil || string(out) != "ping" {
+		t.Fatalf("bad: %q %v", out, err)
+	}
+
+	// server -> client
+	if err := encodeFrame(buf, server.send, []byte("pong")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err = decodeFrame(bytes.NewReader(buf.Bytes()), client.recv, make([]byte, 65536))
+	if err != nil || string(out) != "pong" {
+		t.Fatalf("bad: %q %v", out, err)
+	}
+
+	// each direction has its own key
+	if err := encodeFrame(buf, client.send, []byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := decodeFrame(bytes.NewReader(buf.Bytes()), client.recv, make([]byte, 65536)); err != ErrCiperNotMatch {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestHandshake_FreshKeys(t *testing.T) {
+	first, _, err1, _ := runHandshake("hello-world", "hello-world", nil, nil)
+	_, second, err2, _ := runHandshake("hello-world", "hello-world", nil, nil)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("err: %v, %v", err1, err2)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := encodeFrame(buf, first.send, []byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := decodeFrame(buf, second.recv, make([]byte, 65536)); err != ErrCiperNotMatch {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestHandshake_WrongKey(t *testing.T) {
+	_, _, clientErr, serverErr := runHandshake("hello-world", "hahaha", nil, nil)
+	if serverErr != ErrHandshake {
+		t.Fatalf("bad: %v", serverErr)
+	}
+	if clientErr == nil {
+		t.Fatalf("bad: client finished the handshake")
+	}
+}
+
+func TestHandshake_ForgedServer(t *testing.T) {
+	h, err := newHandshake("hello-world", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h.clientHello()
+
+	// a server which doesn't know the key
+	forged, err := newHandshake("hahaha", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	forged.hello.MAC = forged.mac("qtun server", h.hello, forged.hello)
+	if _, err := h.finish(forged.hello); err != ErrHandshake {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestHandshake_Cipher(t *testing.T) {
+	all, _ := GetCipherSuites("auto")
+	for _, suite := range all {
+		server := []*CipherSuite{suite}
+		client, _, clientErr, serverErr := runHandshake("hello-world", "hello-world", all, server)
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("err: %v, %v", clientErr, serverErr)
+		}
+		if client.send.suite != suite || client.recv.suite != suite {
+			t.Fatalf("bad: %s, expect %s", client.send.suite.Name, suite.Name)
+		}
+	}
+
+	// the client preference wins
+	client, _, clientErr, _ := runHandshake("hello-world", "hello-world",
+		[]*CipherSuite{cipherSuites["chacha20-poly1305"], cipherSuites["aes-128-gcm"]}, all)
+	if clientErr != nil || client.send.suite.Name != "chacha20-poly1305" {
+		t.Fatalf("bad: %v", clientErr)
+	}
+
+	_, _, clientErr, serverErr := runHandshake("hello-world", "hello-world",
+		[]*CipherSuite{cipherSuites["aes-128-gcm"]}, []*CipherSuite{cipherSuites["aes-256-gcm"]})
+	if clientErr == nil || serverErr == nil {
+		t.Fatalf("bad: no cipher in common")
+	}
+}
+
+func TestHandshake_Downgrade(t *testing.T) {
+	h, err := newHandshake("hello-world", []*CipherSuite{cipherSuites["aes-256-gcm"], cipherSuites["aes-128-gcm"]})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	hello := h.clientHello()
+
+	// strip the preferred cipher on the way
+	hello.Ciphers = hello.Ciphers[1:]
+	server, _ := newHandshake("hello-world", nil)
+	if _, _, err := server.respond(hello); err != ErrHandshake {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestHandshake_Plaintext(t *testing.T) {
+	client, server, clientErr, serverErr := runHandshakePolicy("", "hello-world", nil, nil, true)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("err: %v, %v", clientErr, serverErr)
+	}
+	if client != nil || server != nil {
+		t.Fatalf("bad: expect an unencrypted session")
+	}
+
+	_, _, clientErr, serverErr = runHandshakePolicy("", "hello-world", nil, nil, false)
+	if clientErr == nil || serverErr == nil {
+		t.Fatalf("bad: unencrypted session accepted")
+	}
+
+	// the server can't authenticate without a key
+	_, _, clientErr, serverErr = runHandshakePolicy("hello-world", "", nil, nil, true)
+	if clientErr == nil || serverErr == nil {
+		t.Fatalf("bad: encrypted session without a key")
+	}
+}
@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"time"
+)
+
+var ErrBadPadding = fmt.Errorf("bad frame padding")
+
+// obfuscation hides the sizes and the timing of the frames from an observer
+// of the carrier, the secure byte of a padded frame has paddedFlag set and
+// the padding goes behind the payload, inside the encryption:
+//
+//	payload | zeros(n) | n(2)
+//
+// a cover packet is coverPacket followed by zeros of random size, sent at
+// random intervals and dropped by the receiver
+const (
+	paddedFlag   = 0x80
+	maxPadding   = 1024
+	coverPacket  = 0x02
+	maxCoverSize = 1200
+)
+
+// ObfsPolicy is the padding and the cover traffic of each connection
+type ObfsPolicy struct {
+	padding   int
+	coverRate int
+}
+
+// NewObfsPolicy parses --padding and --cover_rate, every frame gets up to
+// padding random bytes, and coverRate cover frames are sent every second on
+// average, both 0 disable obfuscation
+func NewObfsPolicy(padding, coverRate int) (*ObfsPolicy, error) {
+	if padding < 0 || padding > maxPadding {
+		return nil, fmt.Errorf("invalid padding %d, expect 0 to %d bytes", padding, maxPadding)
+	}
+	if coverRate < 0 {
+		return nil, fmt.Errorf("invalid cover rate %d", coverRate)
+	}
+	if padding == 0 && coverRate == 0 {
+		return nil, nil
+	}
+	return &ObfsPolicy{padding: padding, coverRate: coverRate}, nil
+}
+
+// ParseALPN splits --alpn, the first protocol is preferred
+func ParseALPN(protos string) []string {
+	result := []string{}
+	for _, proto := range strings.Split(protos, ",") {
+		proto = strings.TrimSpace(proto)
+		if proto != "" {
+			result = append(result, proto)
+		}
+	}
+	if len(result) == 0 {
+		return []string{alpn}
+	}
+	return result
+}
+
+// obfuscator belongs to the writer of one connection, a nil one sends the
+// frames as they are
+type obfuscator struct {
+	padding   int
+	coverRate int
+	rand      *mrand.Rand
+}
+
+func newObfuscator(policy *ObfsPolicy) *obfuscator {
+	if policy == nil {
+		return nil
+	}
+	return &obfuscator{
+		padding:   policy.padding,
+		coverRate: policy.coverRate,
+		rand:      mrand.New(mrand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// pad returns the padding of the next frame
+func (o *obfuscator) pad() int {
+	if o == nil || o.padding == 0 {
+		return 0
+	}
+	return o.rand.Intn(o.padding + 1)
+}
+
+// coverTimer fires when the next cover frame is due, the intervals are
+// exponentially distributed like independent arrivals, nil without cover
+// traffic
+func (o *obfuscator) coverTimer() *time.Timer {
+	if o == nil || o.coverRate == 0 {
+		return nil
+	}
+	return time.NewTimer(o.nextCover())
+}
+
+func (o *obfuscator) nextCover() time.Duration {
+	return time.Duration(o.rand.ExpFloat64() / float64(o.coverRate) * float64(time.Second))
+}
+
+// cover returns a cover packet of random size
+func (o *obfuscator) cover() []byte {
+	data := make([]byte, 1+o.rand.Intn(maxCoverSize))
+	data[0] = coverPacket
+	stats.Add(statCoverFrames, 1)
+	return data
+}
+
+// addPadding appends pad zeros and the trailer to payload
+func addPadding(payload []byte, pad int) []byte {
+	payload = append(payload, make([]byte, pad)...)
+	return binary.LittleEndian.AppendUint16(payload, uint16(pad))
+}
+
+// stripPadding returns the payload of a padded frame
+func stripPadding(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, ErrBadPadding
+	}
+	end := len(data) - 2 - int(binary.LittleEndian.Uint16(data[len(data)-2:]))
+	if end < 0 {
+		return nil, ErrBadPadding
+	}
+	return data[:end], nil
+}
+
+// dropCover tells if data is a cover packet, which is thrown away
+func dropCover(data []byte) bool {
+	return len(data) > 0 && data[0] == coverPacket
+}
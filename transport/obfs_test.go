@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPadding(t *testing.T) {
+	send, recv := testKeys(t)
+	o := newObfuscator(&ObfsPolicy{padding: 256})
+
+	sizes := map[int]bool{}
+	for i := 0; i < 64; i++ {
+		buf := append(make([]byte, frameHeaderSize), "hello"...)
+		frame := sealInPlace(buf, send, o.pad())
+		sizes[len(frame)] = true
+		if out, err := openFrame(recv, frame); err != nil || out != "hello" {
+			t.Fatalf("bad: %q %v", out, err)
+		}
+	}
+	if len(sizes) < 16 {
+		t.Fatalf("bad: only %d frame sizes", len(sizes))
+	}
+
+	// unencrypted sessions are padded too
+	frame := sealInPlace(append(make([]byte, frameHeaderSize), "hello"...), nil, 100)
+	if frame[0] != paddedFlag || len(frame) != frameHeaderSize+5+100+2 {
+		t.Fatalf("bad: %x", frame[:frameHeaderSize])
+	}
+	if out, err := openFrame(nil, frame); err != nil || out != "hello" {
+		t.Fatalf("bad: %q %v", out, err)
+	}
+
+	// the padding length is checked
+	frame = append(make([]byte, frameHeaderSize), 0xff, 0xff)
+	frame[0] = paddedFlag
+	frame[1] = 2
+	if _, err := openFrame(nil, frame); err != ErrBadPadding {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestObfsPolicy(t *testing.T) {
+	if policy, err := NewObfsPolicy(0, 0); policy != nil || err != nil {
+		t.Fatalf("bad: %v %v", policy, err)
+	}
+	if newObfuscator(nil).pad() != 0 || newObfuscator(nil).coverTimer() != nil {
+		t.Fatalf("bad: nil obfuscator")
+	}
+	for _, v := range [][2]int{{-1, 0}, {maxPadding + 1, 0}, {0, -1}} {
+		if _, err := NewObfsPolicy(v[0], v[1]); err == nil {
+			t.Fatalf("bad: %v accepted", v)
+		}
+	}
+
+	policy, err := NewObfsPolicy(0, 1000)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	o := newObfuscator(policy)
+	timer := o.coverTimer()
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-time.After(time.Second):
+		t.Fatalf("bad: no cover frame")
+	}
+
+	cover := o.cover()
+	if !dropCover(cover) || len(cover) > maxCoverSize {
+		t.Fatalf("bad: %d bytes", len(cover))
+	}
+	if dropCover(newRawPacket(1, []byte("hello"))) {
+		t.Fatalf("bad: packet taken for cover")
+	}
+}
+
+func TestClientTLS_ALPN(t *testing.T) {
+	if protos := ParseALPN(" h3, h3-29 "); len(protos) != 2 || protos[0] != "h3" || protos[1] != "h3-29" {
+		t.Fatalf("bad: %v", protos)
+	}
+	if protos := ParseALPN(""); len(protos) != 1 || protos[0] != alpn {
+		t.Fatalf("bad: %v", protos)
+	}
+
+	c, _ := NewClientTLS("", "", "vpn.example.com")
+	conf := c.Config("1.1.1.1:8080")
+	if conf.ServerName != "vpn.example.com" || conf.NextProtos[0] != alpn {
+		t.Fatalf("bad: %s %v", conf.ServerName, conf.NextProtos)
+	}
+
+	c.SetALPN([]string{"h3"})
+	c.SetSNI("www.example.com")
+	conf = c.Config("1.1.1.1:8080")
+	if conf.ServerName != "www.example.com" || conf.NextProtos[0] != "h3" {
+		t.Fatalf("bad: %s %v", conf.ServerName, conf.NextProtos)
+	}
+}
@@ -0,0 +1,55 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// PlaintextPolicy decides which clients may run an unencrypted session, a
+// client without --key asks for one in the handshake. The server refuses
+// them unless it runs with --insecure, or the client connects from one of
+// the --plaintext_from cidrs, e.g. a trusted lan. Behind a reverse proxy
+// the source is the proxy
+type PlaintextPolicy struct {
+	insecure bool
+	sources  []*net.IPNet
+}
+
+func NewPlaintextPolicy(insecure bool, sources string) (*PlaintextPolicy, error) {
+	p := &PlaintextPolicy{insecure: insecure}
+	for _, cidr := range strings.Split(sources, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid plaintext source %q: %s", cidr, err)
+		}
+		p.sources = append(p.sources, ipNet)
+	}
+	return p, nil
+}
+
+// Allow tells if the client connecting from addr may skip encryption
+func (p *PlaintextPolicy) Allow(addr net.Addr) bool {
+	if p == nil {
+		return false
+	}
+	if p.insecure {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, ipNet := range p.sources {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
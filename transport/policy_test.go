@@ -0,0 +1,33 @@
+package transport
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPlaintextPolicy(t *testing.T) {
+	lan := &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 1234}
+	wan := &net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 1234}
+
+	var none *PlaintextPolicy
+	if none.Allow(lan) {
+		t.Fatalf("bad: nil policy allows plaintext")
+	}
+
+	p, err := NewPlaintextPolicy(false, "192.168.1.0/24, 10.0.0.1/32")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !p.Allow(lan) || p.Allow(wan) {
+		t.Fatalf("bad: %v", p.sources)
+	}
+
+	p, _ = NewPlaintextPolicy(true, "")
+	if !p.Allow(wan) {
+		t.Fatalf("bad: insecure refuses plaintext")
+	}
+
+	if _, err := NewPlaintextPolicy(false, "192.168.1.0"); err == nil {
+		t.Fatalf("bad: invalid cidr accepted")
+	}
+}
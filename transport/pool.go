@@ -1,18 +1,143 @@
 package transport
 
 import (
-	"bytes"
+	"encoding/binary"
 	"sync"
+
+	"github.com/matthewgao/qtun/iface"
+)
+
+// a packet takes one pooled buffer from the tun device to the wire: the
+// frame header is left in front of the payload and the room for the tag and
+// the nonce behind it, so the frame is sealed in place and written without
+// another copy. Packets which don't fit the jumbo buffers get one of their
+// own
+const (
+	packetBufSize = 2048
+	// room for --mtu 9000
+	jumboBufSize = 16384
+	// the largest tag and nonce of the cipher suites
+	frameOverhead = 16 + 24
+	// the largest ip packet, and the largest raw packet carrying it
+	maxPacketSize    = 65535
+	maxRawPacketSize = 1 + binary.MaxVarintLen64 + maxPacketSize
 )
 
-var noncePool = sync.Pool{
+var packetPool = sync.Pool{
 	New: func() interface{} {
-		return make([]byte, 12)
+		return new([packetBufSize]byte)
 	},
 }
 
-var bufPool = sync.Pool{
+var jumboPool = sync.Pool{
 	New: func() interface{} {
-		return &bytes.Buffer{}
+		return new([jumboBufSize]byte)
 	},
 }
+
+// newPacketBuf returns the frame headroom with the room for n more bytes
+func newPacketBuf(n int) []byte {
+	need := frameHeaderSize + n + frameOverhead
+	switch {
+	case need <= packetBufSize:
+		return packetPool.Get().(*[packetBufSize]byte)[:frameHeaderSize]
+	case need <= jumboBufSize:
+		return jumboPool.Get().(*[jumboBufSize]byte)[:frameHeaderSize]
+	}
+	return make([]byte, frameHeaderSize, need)
+}
+
+// freePacketBuf gives buf back once it's written or dropped, nothing may
+// hold on to it
+func freePacketBuf(buf []byte) {
+	switch cap(buf) {
+	case packetBufSize:
+		packetPool.Put((*[packetBufSize]byte)(buf[:packetBufSize]))
+	case jumboBufSize:
+		jumboPool.Put((*[jumboBufSize]byte)(buf[:jumboBufSize]))
+	}
+}
+
+// a data packet skips the protocol.Envelope, its payload starts with
+// rawPacket, which can't be confused with an envelope since 0 is not a
+// valid protobuf tag:
+//
+//	rawPacket(1) | seq(uvarint) | ip packet
+//
+// seq is 0 unless the session is bonded. It's always written in
+// binary.MaxVarintLen64 bytes, padded with continuation bits, so the headers
+// have the same size whatever the seq and the tun reads the ip packet right
+// behind them. binary.Uvarint reads it like any other uvarint
+const (
+	rawPacket = 0x00
+
+	packetHeadroom = frameHeaderSize + 1 + binary.MaxVarintLen64
+)
+
+// Packet is an ip packet in a pooled buffer, behind the room of the frame
+// and raw packet headers, so it's framed and sealed where the tun put it.
+// SendTunPacket takes it over, anything else has to Free it
+type Packet struct {
+	buf []byte
+}
+
+// NewPacket returns a packet of n bytes for the tun to read into
+func NewPacket(n int) Packet {
+	return Packet{newPacketBuf(1 + binary.MaxVarintLen64 + n)[:packetHeadroom+n]}
+}
+
+// CopyPacket copies pkt into a new packet
+func CopyPacket(pkt iface.PacketIP) Packet {
+	p := NewPacket(len(pkt))
+	copy(p.IP(), pkt)
+	return p
+}
+
+// IP returns the ip packet
+func (p Packet) IP() iface.PacketIP {
+	return iface.PacketIP(p.buf[packetHeadroom:])
+}
+
+// Truncate cuts the ip packet to the n bytes read
+func (p Packet) Truncate(n int) Packet {
+	return Packet{p.buf[:packetHeadroom+n]}
+}
+
+func (p Packet) Free() {
+	freePacketBuf(p.buf)
+}
+
+// frame writes the raw packet header in front of the ip packet, the result
+// is ready for WritePacket
+func (p Packet) frame(seq uint64) []byte {
+	p.buf[frameHeaderSize] = rawPacket
+	putPaddedUvarint(p.buf[frameHeaderSize+1:packetHeadroom], seq)
+	return p.buf
+}
+
+// putPaddedUvarint writes v into all the binary.MaxVarintLen64 bytes of buf
+func putPaddedUvarint(buf []byte, v uint64) {
+	for i := 0; i < binary.MaxVarintLen64-1; i++ {
+		buf[i] = byte(v) | 0x80
+		v >>= 7
+	}
+	buf[binary.MaxVarintLen64-1] = byte(v)
+}
+
+// newRawPacket copies pkt into a pooled buffer, ready for WritePacket
+func newRawPacket(seq uint64, pkt []byte) []byte {
+	return CopyPacket(pkt).frame(seq)
+}
+
+// ParsePacket returns the ip packet of a data packet received by the
+// handler, false for the envelopes
+func ParsePacket(data []byte) (iface.PacketIP, bool) {
+	if len(data) == 0 || data[0] != rawPacket {
+		return nil, false
+	}
+	_, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return nil, false
+	}
+	return iface.PacketIP(data[1+n:]), true
+}
@@ -0,0 +1,230 @@
+package transport
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/matthewgao/qtun/iface"
+	"github.com/matthewgao/qtun/protocol"
+)
+
+func TestRawPacket(t *testing.T) {
+	buf := newRawPacket(5, []byte("hello"))
+	data := buf[frameHeaderSize:]
+	pkt, ok := ParsePacket(data)
+	if !ok || string(pkt) != "hello" || packetSeq(data) != 5 {
+		t.Fatalf("bad: %q %v", pkt, ok)
+	}
+	freePacketBuf(buf)
+
+	// the peeks of the envelopes leave it alone
+	if ok, _ := (&recvKey{}).handleRekey(data); ok {
+		t.Fatalf("bad: packet taken for a rekey")
+	}
+	if unbatch(data, func([]byte) {}) {
+		t.Fatalf("bad: packet taken for a batch")
+	}
+
+	envelope, _ := proto.Marshal(&protocol.Envelope{
+		Type: &protocol.Envelope_Packet{
+			Packet: &protocol.MessagePacket{Payload: []byte("hello")},
+		},
+	})
+	if _, ok := ParsePacket(envelope); ok {
+		t.Fatalf("bad: envelope taken for a packet")
+	}
+}
+
+func TestPacketBuf(t *testing.T) {
+	small := newPacketBuf(1400)
+	if len(small) != frameHeaderSize || cap(small) != packetBufSize {
+		t.Fatalf("bad: %d %d", len(small), cap(small))
+	}
+	freePacketBuf(small)
+
+	jumbo := newPacketBuf(9000)
+	if cap(jumbo) != jumboBufSize {
+		t.Fatalf("bad: %d", cap(jumbo))
+	}
+	freePacketBuf(jumbo)
+
+	large := newPacketBuf(60000)
+	if cap(large) < frameHeaderSize+60000+frameOverhead {
+		t.Fatalf("bad: %d", cap(large))
+	}
+}
+
+func TestPacket(t *testing.T) {
+	for _, v := range []struct {
+		seq  uint64
+		size int
+	}{
+		{0, 1400},
+		{math.MaxUint64, 1400},
+		{300, 9000},
+	} {
+		// the way of the tun loop, read into a buffer of the mtu
+		p := NewPacket(9000)
+		n := copy(p.IP(), bytes.Repeat([]byte{1}, v.size))
+		data := p.Truncate(n).frame(v.seq)[frameHeaderSize:]
+
+		pkt, ok := ParsePacket(data)
+		if !ok || len(pkt) != v.size || packetSeq(data) != v.seq {
+			t.Fatalf("bad: %d bytes seq %d", len(pkt), packetSeq(data))
+		}
+		if &data[len(data)-1] != &p.Truncate(n).IP()[n-1] {
+			t.Fatalf("bad: packet moved")
+		}
+		p.Free()
+	}
+}
+
+func TestSealInPlace(t *testing.T) {
+	send, recv := testKeys(t)
+	pkt := bytes.Repeat([]byte{1}, 1400)
+	readBuf := make([]byte, 65536)
+	reader := bytes.NewReader(nil)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buf := newRawPacket(0, pkt)
+		frame := sealInPlace(buf, send, 0)
+		reader.Reset(frame)
+		data, err := decodeFrame(reader, recv, readBuf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out, _ := ParsePacket(data); !bytes.Equal(out, pkt) {
+			t.Fatalf("bad: %d bytes", len(out))
+		}
+		freePacketBuf(frame)
+	})
+	if allocs != 0 {
+		t.Fatalf("bad: %v allocs", allocs)
+	}
+}
+
+// benchmarkSend is the way of a 1400 byte packet from the tun device to the
+// wire and back, release is called once the frame is read
+func benchmarkSend(b *testing.B, encode func(key *sendKey, pkt []byte) []byte, release func([]byte)) {
+	keys, peer, err, _ := runHandshake("hello-world", "hello-world", nil, nil)
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	pkt := make([]byte, 1400)
+	readBuf := make([]byte, 65536)
+	reader := bytes.NewReader(nil)
+
+	b.SetBytes(int64(len(pkt)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frame := encode(keys.send, pkt)
+		reader.Reset(frame)
+		_, err := decodeFrame(reader, peer.recv, readBuf)
+		if err != nil {
+			b.Fatalf("err: %v", err)
+		}
+		release(frame)
+	}
+}
+
+// BenchmarkSend_Envelope is the data path before the packets went raw
+func BenchmarkSend_Envelope(b *testing.B) {
+	buf := &bytes.Buffer{}
+	benchmarkSend(b, func(key *sendKey, pkt []byte) []byte {
+		data, _ := proto.Marshal(&protocol.Envelope{
+			Type: &protocol.Envelope_Packet{
+				Packet: &protocol.MessagePacket{Payload: pkt},
+			},
+		})
+		encodeFrame(buf, key, data)
+		return buf.Bytes()
+	}, func([]byte) {})
+}
+
+func BenchmarkSend(b *testing.B) {
+	benchmarkSend(b, func(key *sendKey, pkt []byte) []byte {
+		return sealInPlace(newRawPacket(0, pkt), key, 0)
+	}, freePacketBuf)
+}
+
+// testClient is a client with threads connections which are up, the packets
+// wait in their queues for the caller to take them
+func testClient(threads int) *Client {
+	c := &Client{threads: threads}
+	for i := 0; i < threads; i++ {
+		c.conns = append(c.conns, &ClientConn{
+			connected: true,
+			packets:   newSendQueue(nil),
+			flowKey:   strconv.Itoa(i),
+			path:      &pathStats{},
+		})
+	}
+	return c
+}
+
+// take returns the packet SendPacket queued on one of the connections
+func (c *Client) take() []byte {
+	for {
+		for _, conn := range c.conns {
+			select {
+			case buf := <-conn.packets.ch:
+				conn.packets.taken()
+				return buf
+			default:
+			}
+		}
+	}
+}
+
+func testIPPacket(size int) iface.PacketIP {
+	pkt := make([]byte, size)
+	pkt[0], pkt[9] = 0x45, 17
+	copy(pkt[12:], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+	return pkt
+}
+
+func TestClient_SendPacketAllocs(t *testing.T) {
+	send, _ := testKeys(t)
+
+	// a full packet of the default and of the jumbo mtu
+	for _, pkt := range []iface.PacketIP{testIPPacket(1400), testIPPacket(9000)} {
+		for _, bonded := range []bool{false, true} {
+			c := testClient(4)
+			if bonded {
+				c.bond = newBond(nil)
+			}
+			allocs := testing.AllocsPerRun(100, func() {
+				// the copy stands for the read of the tun
+				c.SendPacket(pkt)
+				freePacketBuf(sealInPlace(c.take(), send, 0))
+			})
+			if allocs != 0 {
+				t.Fatalf("bad: %v allocs of %d bytes bonded %v", allocs, len(pkt), bonded)
+			}
+		}
+	}
+}
+
+// benchmarkClient is benchmarkSend from Client.SendPacket, so it covers the
+// pick of the connection as well
+func benchmarkClient(b *testing.B, c *Client) {
+	pkt := testIPPacket(1400)
+	benchmarkSend(b, func(key *sendKey, _ []byte) []byte {
+		c.SendPacket(pkt)
+		return sealInPlace(c.take(), key, 0)
+	}, freePacketBuf)
+}
+
+func BenchmarkSend_Client(b *testing.B) {
+	benchmarkClient(b, testClient(4))
+}
+
+func BenchmarkSend_Bonded(b *testing.B) {
+	c := testClient(4)
+	c.bond = newBond(nil)
+	benchmarkClient(b, c)
+}
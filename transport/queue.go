@@ -0,0 +1,107 @@
+package transport
+
+import (
+	"fmt"
+)
+
+const (
+	defaultQueueSize = 256
+
+	// control messages of the client waiting for the writer, the pings and
+	// the lease requests are repeated, so the ones of a stalled connection
+	// are dropped rather than holding up the sender and the other
+	// connections
+	controlQueueSize = 8
+)
+
+// QueuePolicy bounds the packets waiting for a connection, a slow or dead
+// peer only drops its own packets instead of holding up the tun readers
+type QueuePolicy struct {
+	size     int
+	dropHead bool
+}
+
+// NewQueuePolicy parses --queue_size and --queue_drop, tail drops the new
+// packet when the queue is full, head drops the oldest one, which keeps the
+// latency of the queue down
+func NewQueuePolicy(size int, drop string) (*QueuePolicy, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid queue size %d", size)
+	}
+	switch drop {
+	case "", "tail":
+		return &QueuePolicy{size: size}, nil
+	case "head":
+		return &QueuePolicy{size: size, dropHead: true}, nil
+	}
+	return nil, fmt.Errorf("unknown queue drop policy %q, expect tail or head", drop)
+}
+
+// sendQueue never blocks the sender, the depth and the drops of all the
+// queues are counted in stats
+type sendQueue struct {
+	ch       chan []byte
+	dropHead bool
+}
+
+func newSendQueue(policy *QueuePolicy) *sendQueue {
+	if policy == nil {
+		policy = &QueuePolicy{size: defaultQueueSize}
+	}
+	return &sendQueue{
+		ch:       make(chan []byte, policy.size),
+		dropHead: policy.dropHead,
+	}
+}
+
+// push returns false when data, or an older packet for head drop, is
+// dropped
+func (q *sendQueue) push(data []byte) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			// the connection is gone
+			stats.Add(statQueueDropped, 1)
+			freePacketBuf(data)
+			ok = false
+		}
+	}()
+
+	ok = true
+	for {
+		select {
+		case q.ch <- data:
+			stats.Add(statQueueDepth, 1)
+			return ok
+		default:
+		}
+
+		if !q.dropHead {
+			stats.Add(statQueueDropped, 1)
+			freePacketBuf(data)
+			return false
+		}
+		select {
+		case old := <-q.ch:
+			freePacketBuf(old)
+			stats.Add(statQueueDepth, -1)
+			stats.Add(statQueueDropped, 1)
+			ok = false
+		default:
+		}
+	}
+}
+
+// taken is called by the writer for every packet it takes out of ch
+func (q *sendQueue) taken() {
+	stats.Add(statQueueDepth, -1)
+}
+
+// close drops whatever is left in the queue, push fails from now on
+func (q *sendQueue) close() {
+	close(q.ch)
+	for data := range q.ch {
+		freePacketBuf(data)
+		stats.Add(statQueueDepth, -1)
+		stats.Add(statQueueDropped, 1)
+	}
+}
@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestNewQueuePolicy(t *testing.T) {
+	policy, err := NewQueuePolicy(2, "head")
+	if err != nil || policy.size != 2 || !policy.dropHead {
+		t.Fatalf("bad: %+v %v", policy, err)
+	}
+	for _, drop := range []string{"", "tail"} {
+		if policy, err := NewQueuePolicy(2, drop); err != nil || policy.dropHead {
+			t.Fatalf("bad: %q %+v %v", drop, policy, err)
+		}
+	}
+	if _, err := NewQueuePolicy(0, "tail"); err == nil {
+		t.Fatalf("bad: empty queue accepted")
+	}
+	if _, err := NewQueuePolicy(2, "random"); err == nil {
+		t.Fatalf("bad: unknown policy accepted")
+	}
+}
+
+func TestSendQueue_Tail(t *testing.T) {
+	q := newSendQueue(&QueuePolicy{size: 2})
+	depth, dropped := statValue(statQueueDepth), statValue(statQueueDropped)
+
+	if !q.push([]byte("a")) || !q.push([]byte("b")) {
+		t.Fatalf("bad: push fail")
+	}
+	if q.push([]byte("c")) {
+		t.Fatalf("bad: pushed to a full queue")
+	}
+	if statValue(statQueueDepth) != depth+2 || statValue(statQueueDropped) != dropped+1 {
+		t.Fatalf("bad: depth %d dropped %d", statValue(statQueueDepth)-depth, statValue(statQueueDropped)-dropped)
+	}
+
+	if out := <-q.ch; string(out) != "a" {
+		t.Fatalf("bad: %s", out)
+	}
+	q.taken()
+	if statValue(statQueueDepth) != depth+1 {
+		t.Fatalf("bad: depth %d", statValue(statQueueDepth)-depth)
+	}
+}
+
+func TestSendQueue_Head(t *testing.T) {
+	q := newSendQueue(&QueuePolicy{size: 2, dropHead: true})
+	depth, dropped := statValue(statQueueDepth), statValue(statQueueDropped)
+
+	q.push([]byte("a"))
+	q.push([]byte("b"))
+	if q.push([]byte("c")) {
+		t.Fatalf("bad: nothing dropped")
+	}
+	if statValue(statQueueDepth) != depth+2 || statValue(statQueueDropped) != dropped+1 {
+		t.Fatalf("bad: depth %d dropped %d", statValue(statQueueDepth)-depth, statValue(statQueueDropped)-dropped)
+	}
+	if out := <-q.ch; string(out) != "b" {
+		t.Fatalf("bad: %s, expect the oldest dropped", out)
+	}
+	q.taken()
+}
+
+func TestSendQueue_Close(t *testing.T) {
+	q := newSendQueue(nil)
+	depth, dropped := statValue(statQueueDepth), statValue(statQueueDropped)
+
+	q.push([]byte("a"))
+	q.close()
+	if q.push([]byte("b")) {
+		t.Fatalf("bad: pushed to a closed queue")
+	}
+	if statValue(statQueueDepth) != depth || statValue(statQueueDropped) != dropped+2 {
+		t.Fatalf("bad: depth %d dropped %d", statValue(statQueueDepth)-depth, statValue(statQueueDropped)-dropped)
+	}
+}
+
+func TestClientConn_Write(t *testing.T) {
+	endpoints, _ := ParseEndpoints("1.1.1.1:8080")
+	conn := NewClientConn(newServerPool(endpoints, 1, 1), "", 0, &sync.WaitGroup{}, false, nil, nil)
+
+	// nothing takes the messages, like a connection which is stalled
+	dropped := statValue(statControlDropped)
+	for i := 0; i < controlQueueSize+1; i++ {
+		conn.Write([]byte("ping"))
+	}
+	if statValue(statControlDropped) != dropped+1 || len(conn.chanWrite) != controlQueueSize {
+		t.Fatalf("bad: %d dropped %d queued", statValue(statControlDropped)-dropped, len(conn.chanWrite))
+	}
+}
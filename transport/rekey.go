@@ -0,0 +1,316 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/matthewgao/qtun/config"
+	"github.com/matthewgao/qtun/protocol"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// the rekey field number of protocol.Envelope
+const rekeyField = 4
+
+const secretSize = 32
+
+// each direction of a session has its own secret, which is ratcheted forward
+// on every rekey, the aead key of a phase is derived from the secret of that
+// phase. The phase is carried in the secure byte of the frame, so the
+// receiver knows which key to open it with:
+//
+//	0: plaintext, 1: even phase, 2: odd phase
+//
+// The sender announces the new phase with a MessageRekey sealed by the old
+// key before it switches, the receiver keeps the old key around for the
+// packets still in flight
+func expandSecret(secret []byte, label string, size int) ([]byte, error) {
+	out := make([]byte, size)
+	_, err := io.ReadFull(hkdf.Expand(sha256.New, secret, []byte(label)), out)
+	return out, err
+}
+
+func phaseAEAD(suite *CipherSuite, secret []byte) (cipher.AEAD, error) {
+	key, err := expandSecret(secret, "qtun key", suite.keySize)
+	if err != nil {
+		return nil, err
+	}
+	return suite.newAEAD(key)
+}
+
+func nextSecret(secret []byte) ([]byte, error) {
+	return expandSecret(secret, "qtun rekey", secretSize)
+}
+
+func phaseBit(phase uint32) uint8 {
+	return 1 + uint8(phase&1)
+}
+
+// rekeyPolicy returns when the send key is rotated, zero disables the limit
+func rekeyPolicy() (uint64, time.Duration) {
+	cfg := config.GetInstance()
+	if cfg == nil {
+		return 0, 0
+	}
+	return uint64(cfg.RekeyMB) << 20, time.Duration(cfg.RekeyInterval) * time.Second
+}
+
+// sendKey is used by the write process of the connection, the lock makes
+// sure a nonce is never used twice, even if another write process shows up
+type sendKey struct {
+	mutex    sync.Mutex
+	suite    *CipherSuite
+	secret   []byte
+	phase    uint32
+	aead     cipher.AEAD
+	nonce    []byte
+	counter  uint64
+	sealed   uint64
+	since    time.Time
+	maxBytes uint64
+	maxAge   time.Duration
+}
+
+func newSendKey(suite *CipherSuite, secret []byte) (*sendKey, error) {
+	aead, err := phaseAEAD(suite, secret)
+	if err != nil {
+		return nil, err
+	}
+	maxBytes, maxAge := rekeyPolicy()
+	return &sendKey{
+		suite:    suite,
+		secret:   secret,
+		aead:     aead,
+		nonce:    make([]byte, aead.NonceSize()),
+		since:    time.Now(),
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+	}, nil
+}
+
+// seal encrypts data in place and returns the ciphertext, its nonce copied
+// behind it when there is room, and the phase of the key
+func (k *sendKey) seal(data []byte) ([]byte, []byte, uint32) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	counterNonce(k.nonce, k.counter)
+	k.counter++
+	k.sealed += uint64(len(data))
+	sealed := k.aead.Seal(data[:0], k.nonce, data, nil)
+	return sealed, append(sealed[len(sealed):], k.nonce...), k.phase
+}
+
+func (k *sendKey) due() bool {
+	if k == nil {
+		return false
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return (k.maxBytes > 0 && k.sealed >= k.maxBytes) ||
+		(k.maxAge > 0 && time.Since(k.since) >= k.maxAge)
+}
+
+// state returns the phase of the key, the bytes it sealed and when it was
+// made, the seal path changes them under the lock
+func (k *sendKey) state() (uint32, uint64, time.Time) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.phase, k.sealed, k.since
+}
+
+func (k *sendKey) rotate() error {
+	secret, err := nextSecret(k.secret)
+	if err != nil {
+		return err
+	}
+	aead, err := phaseAEAD(k.suite, secret)
+	if err != nil {
+		return err
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.secret, k.aead = secret, aead
+	k.nonce = make([]byte, aead.NonceSize())
+	k.phase++
+	k.counter = 0
+	k.sealed = 0
+	k.since = time.Now()
+	return nil
+}
+
+// phaseKey opens the frames of one phase, each phase counts its frames
+// from 0 so it has its own replay window
+type phaseKey struct {
+	aead   cipher.AEAD
+	window replayWindow
+}
+
+func newPhaseKey(suite *CipherSuite, secret []byte) (*phaseKey, error) {
+	aead, err := phaseAEAD(suite, secret)
+	if err != nil {
+		return nil, err
+	}
+	return &phaseKey{aead: aead}, nil
+}
+
+// open decrypts in place, ciphertext is wiped when it fails
+func (p *phaseKey) open(nonce, ciphertext []byte) ([]byte, error) {
+	plain, err := p.aead.Open(ciphertext[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrCiperNotMatch
+	}
+	err = p.window.accept(nonceCounter(nonce))
+	if err != nil {
+		return nil, err
+	}
+	return plain, nil
+}
+
+// recvKey is shared by the stream and the datagram read process, frames of
+// the next phase can arrive on a datagram before the rekey message on the
+// stream, so the next key is always ready as well
+type recvKey struct {
+	mutex    sync.Mutex
+	suite    *CipherSuite
+	secret   []byte
+	phase    uint32
+	current  *phaseKey
+	previous *phaseKey
+	next     *phaseKey
+}
+
+func newRecvKey(suite *CipherSuite, secret []byte) (*recvKey, error) {
+	k := &recvKey{suite: suite, secret: secret}
+	var err error
+	k.current, err = newPhaseKey(suite, secret)
+	if err != nil {
+		return nil, err
+	}
+	err = k.prepareNext()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *recvKey) prepareNext() error {
+	secret, err := nextSecret(k.secret)
+	if err != nil {
+		return err
+	}
+	k.next, err = newPhaseKey(k.suite, secret)
+	return err
+}
+
+func (k *recvKey) nonceSize() int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.current.aead.NonceSize()
+}
+
+func (k *recvKey) advance() error {
+	secret, err := nextSecret(k.secret)
+	if err != nil {
+		return err
+	}
+	k.secret = secret
+	k.previous, k.current = k.current, k.next
+	k.phase++
+	return k.prepareNext()
+}
+
+func (k *recvKey) open(secure uint8, nonce, ciphertext []byte) ([]byte, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if secure == phaseBit(k.phase) {
+		return k.current.open(nonce, ciphertext)
+	}
+
+	// a late frame of the previous phase, or an early one of the next phase
+	if k.previous != nil {
+		saved := append([]byte(nil), ciphertext...)
+		plain, err := k.previous.open(nonce, ciphertext)
+		if err != ErrCiperNotMatch {
+			return plain, err
+		}
+		ciphertext = saved
+	}
+	plain, err := k.next.open(nonce, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return plain, k.advance()
+}
+
+// rekey handles the announcement of the peer, the key may have been
+// advanced already by a frame which overtook it
+func (k *recvKey) rekey(phase uint32) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if phase <= k.phase {
+		return nil
+	}
+	if phase != k.phase+1 {
+		return fmt.Errorf("unexpected rekey phase %d, current %d", phase, k.phase)
+	}
+	return k.advance()
+}
+
+// handleRekey tells if data is a rekey message and handles it, only the
+// envelope tag is peeked so the packets are not unmarshaled twice
+func (k *recvKey) handleRekey(data []byte) (bool, error) {
+	num, typ, n := protowire.ConsumeTag(data)
+	if n < 0 || num != rekeyField || typ != protowire.BytesType {
+		return false, nil
+	}
+	if k == nil {
+		return true, fmt.Errorf("rekey on a plaintext session")
+	}
+
+	envelope := protocol.Envelope{}
+	err := proto.Unmarshal(data, &envelope)
+	if err != nil {
+		return true, fmt.Errorf("unmarshal rekey fail: %s", err)
+	}
+	return true, k.rekey(envelope.GetRekey().GetPhase())
+}
+
+// writeRekey rotates the send key when it's due, the rekey message is sent
+// over the stream with the old key, everything after it uses the new one
+func writeRekey(w io.Writer, buf *bytes.Buffer, key *sendKey) error {
+	if !key.due() {
+		return nil
+	}
+	phase, sealed, since := key.state()
+
+	data, err := proto.Marshal(&protocol.Envelope{
+		Type: &protocol.Envelope_Rekey{
+			Rekey: &protocol.MessageRekey{Phase: phase + 1},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	err = encodeFrame(buf, key, data)
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Uint32("phase", phase+1).Uint64("sealed", sealed).
+		Dur("age", time.Since(since)).Msg("rotate session key")
+	return key.rotate()
+}
@@ -0,0 +1,200 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+func testKeys(t *testing.T) (*sendKey, *recvKey) {
+	secret := bytes.Repeat([]byte{1}, secretSize)
+	send, err := newSendKey(cipherSuites["aes-128-gcm"], secret)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	recv, err := newRecvKey(cipherSuites["aes-128-gcm"], secret)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return send, recv
+}
+
+func sealFrame(t *testing.T, key *sendKey, data string) []byte {
+	buf := &bytes.Buffer{}
+	if err := encodeFrame(buf, key, []byte(data)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return append([]byte{}, buf.Bytes()...)
+}
+
+func openFrame(key *recvKey, frame []byte) (string, error) {
+	out, err := decodeFrame(bytes.NewReader(frame), key, make([]byte, 65536))
+	return string(out), err
+}
+
+func TestRekey(t *testing.T) {
+	send, recv := testKeys(t)
+	send.maxBytes = 8
+
+	stream := &bytes.Buffer{}
+	if err := writeRekey(stream, &bytes.Buffer{}, send); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stream.Len() != 0 || send.phase != 0 {
+		t.Fatalf("bad: rekey before the limit")
+	}
+
+	old := sealFrame(t, send, "0123456789")
+	if err := writeRekey(stream, &bytes.Buffer{}, send); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if send.phase != 1 || send.sealed != 0 {
+		t.Fatalf("bad: phase %d sealed %d", send.phase, send.sealed)
+	}
+	announce := append([]byte{}, stream.Bytes()...)
+	early := sealFrame(t, send, "early")
+
+	// a datagram of the new phase overtakes the rekey message
+	if out, err := openFrame(recv, early); err != nil || out != "early" {
+		t.Fatalf("bad: %q %v", out, err)
+	}
+	if recv.phase != 1 {
+		t.Fatalf("bad: phase %d", recv.phase)
+	}
+
+	// the in-flight frames of the old phase still open
+	if out, err := openFrame(recv, old); err != nil || out != "0123456789" {
+		t.Fatalf("bad: %q %v", out, err)
+	}
+
+	data, err := openFrame(recv, announce)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ok, err := recv.handleRekey([]byte(data))
+	if !ok || err != nil {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if recv.phase != 1 {
+		t.Fatalf("bad: phase %d", recv.phase)
+	}
+
+	if out, err := openFrame(recv, sealFrame(t, send, "late")); err != nil || out != "late" {
+		t.Fatalf("bad: %q %v", out, err)
+	}
+}
+
+func TestRekey_Announce(t *testing.T) {
+	send, recv := testKeys(t)
+	send.maxBytes = 1
+	sealFrame(t, send, "ping")
+
+	stream := &bytes.Buffer{}
+	if err := writeRekey(stream, &bytes.Buffer{}, send); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, err := openFrame(recv, stream.Bytes())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok, err := recv.handleRekey([]byte(data)); !ok || err != nil {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if recv.phase != 1 {
+		t.Fatalf("bad: phase %d", recv.phase)
+	}
+
+	if _, err := openFrame(recv, sealFrame(t, send, "ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// a rekey can't skip a phase
+	if err := recv.rekey(3); err == nil {
+		t.Fatalf("bad: skipped a phase")
+	}
+}
+
+func TestRekey_NotRekey(t *testing.T) {
+	_, recv := testKeys(t)
+	for _, data := range [][]byte{nil, []byte("ping"), {0x12, 0x00}} {
+		if ok, _ := recv.handleRekey(data); ok {
+			t.Fatalf("bad: %v", data)
+		}
+	}
+}
+
+func TestSendKey_SealConcurrent(t *testing.T) {
+	send, _ := testKeys(t)
+	nonces := make(chan string, 2000)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				_, nonce, _ := send.seal(make([]byte, 16, 64))
+				nonces <- string(nonce)
+			}
+		}()
+	}
+	wg.Wait()
+	close(nonces)
+
+	seen := map[string]bool{}
+	for nonce := range nonces {
+		if seen[nonce] {
+			t.Fatalf("bad: nonce %x used twice", nonce)
+		}
+		seen[nonce] = true
+	}
+}
+
+// the datagram path seals while the stream writer rotates the key, run
+// with -race
+func TestSendKey_RekeyConcurrent(t *testing.T) {
+	send, _ := testKeys(t)
+	send.maxBytes = 1
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			send.seal(make([]byte, 16, 64))
+		}
+	}()
+	for j := 0; j < 1000; j++ {
+		if err := writeRekey(io.Discard, &bytes.Buffer{}, send); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	close(stop)
+	<-done
+}
+
+// the frame decoder asks for the nonce size while the key advances, run
+// with -race
+func TestRecvKey_NonceSizeConcurrent(t *testing.T) {
+	_, recv := testKeys(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for phase := uint32(1); phase <= 100; phase++ {
+			if err := recv.rekey(phase); err != nil {
+				t.Errorf("err: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if recv.nonceSize() == 0 {
+			t.Fatalf("bad: no nonce")
+		}
+	}
+	<-done
+}
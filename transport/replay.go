@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+var ErrReplay = fmt.Errorf("replayed or too old frame, drop")
+
+// the nonce of a frame is a counter in its last 8 bytes, big endian, it
+// starts from 0 for every key phase
+func counterNonce(nonce []byte, counter uint64) {
+	for i := range nonce[:len(nonce)-8] {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+}
+
+func nonceCounter(nonce []byte) uint64 {
+	return binary.BigEndian.Uint64(nonce[len(nonce)-8:])
+}
+
+const (
+	replayBlockBits  = 64
+	replayRingBlocks = 16
+	// datagrams can be reordered with each other and with the stream, so
+	// the window is a lot wider than the 64 frames of basic ipsec
+	replayWindowSize = (replayRingBlocks - 1) * replayBlockBits
+)
+
+// replayWindow is a sliding window over the frame counters, the bitmap is a
+// ring of blocks so sliding forward only clears whole blocks (RFC 6479, as
+// used by wireguard)
+type replayWindow struct {
+	last uint64
+	ring [replayRingBlocks]uint64
+}
+
+// accept has to be called after the frame is authenticated, otherwise a
+// forged frame could slide the window
+func (w *replayWindow) accept(counter uint64) error {
+	block := counter / replayBlockBits
+	if counter > w.last {
+		current := w.last / replayBlockBits
+		diff := block - current
+		if diff > replayRingBlocks {
+			diff = replayRingBlocks
+		}
+		for i := current + 1; diff > 0; i++ {
+			w.ring[i%replayRingBlocks] = 0
+			diff--
+		}
+		w.last = counter
+	} else if w.last-counter > replayWindowSize {
+		stats.Add(statOutOfWindow, 1)
+		return ErrReplay
+	}
+
+	bit := uint64(1) << (counter % replayBlockBits)
+	if w.ring[block%replayRingBlocks]&bit != 0 {
+		stats.Add(statReplayed, 1)
+		return ErrReplay
+	}
+	w.ring[block%replayRingBlocks] |= bit
+	return nil
+}
@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"expvar"
+	"testing"
+)
+
+func statValue(name string) int64 {
+	if v, ok := stats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestReplayWindow(t *testing.T) {
+	w := replayWindow{}
+	for _, c := range []uint64{0, 1, 3, 2, 100, 50} {
+		if err := w.accept(c); err != nil {
+			t.Fatalf("bad: %d %v", c, err)
+		}
+	}
+	for _, c := range []uint64{0, 3, 100, 50} {
+		if err := w.accept(c); err != ErrReplay {
+			t.Fatalf("bad: %d %v", c, err)
+		}
+	}
+
+	// slide far forward, everything behind the window is refused
+	if err := w.accept(100 + 10*replayWindowSize); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := w.accept(101); err != ErrReplay {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := w.accept(100 + 9*replayWindowSize); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestReplayWindow_Edge(t *testing.T) {
+	w := replayWindow{}
+	top := uint64(5 * replayWindowSize)
+	if err := w.accept(top); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := w.accept(top - replayWindowSize); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := w.accept(top - replayWindowSize - 1); err != ErrReplay {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestFrame_Replay(t *testing.T) {
+	send, recv := testKeys(t)
+	first := sealFrame(t, send, "first")
+	second := sealFrame(t, send, "second")
+
+	if nonceCounter(first[len(first)-12:]) != 0 || nonceCounter(second[len(second)-12:]) != 1 {
+		t.Fatalf("bad: nonces are not counters")
+	}
+
+	replayed := statValue(statReplayed)
+	for _, frame := range [][]byte{second, first} {
+		if _, err := openFrame(recv, frame); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if _, err := openFrame(recv, first); err != ErrReplay {
+		t.Fatalf("bad: %v", err)
+	}
+	if statValue(statReplayed) != replayed+1 {
+		t.Fatalf("bad: replay not counted")
+	}
+
+	// a frame with a tampered counter doesn't move the window
+	forged := append([]byte{}, second...)
+	forged[len(forged)-1] = 0xff
+	if _, err := openFrame(recv, forged); err != ErrCiperNotMatch {
+		t.Fatalf("bad: %v", err)
+	}
+	if recv.current.window.last != 1 {
+		t.Fatalf("bad: window moved to %d", recv.current.window.last)
+	}
+}
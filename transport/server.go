@@ -1,43 +1,49 @@
 package transport
 
 import (
-	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
 	"fmt"
-	"math/big"
+	"net"
+	"os"
 
 	// "log"
-	"net"
 	"sync"
 	"time"
 
-	"github.com/lucas-clemente/quic-go"
 	"github.com/matthewgao/qtun/config"
 	"github.com/rs/zerolog/log"
 )
 
 type Server struct {
-	publicAddr string
-	handler    GrpcHandler
-	key        string
-	// publicListener *net.TCPListener
-	publicListener quic.Listener
-	Mtx            *sync.Mutex
+	publicAddr  string
+	handler     GrpcHandler
+	key         string
+	carriers    []Carrier
+	tlsConf     *tls.Config
+	auth        *Authorizer
+	suites      []*CipherSuite
+	plaintext   *PlaintextPolicy
+	bonds       *bondTable
+	queue       *QueuePolicy
+	batch       *BatchPolicy
+	compression []string
+	obfs        *ObfsPolicy
+	maxFrame    int
+	Mtx         *sync.Mutex
 
 	//为了能够删除已经断开的连接，并能够反过来查询连接，所以有两个map
 	Conns        map[string]*ServerConn
 	ConnsReverse map[*ServerConn]string
 }
 
-func NewServer(publicAddr string, handler GrpcHandler, key string) *Server {
+func NewServer(publicAddr string, handler GrpcHandler, key string, carriers []Carrier) *Server {
 	srv := &Server{
 		publicAddr:   publicAddr,
 		handler:      handler,
 		key:          key,
+		carriers:     carriers,
+		bonds:        newBondTable(),
 		Conns:        make(map[string]*ServerConn),
 		ConnsReverse: make(map[*ServerConn]string),
 		Mtx:          &sync.Mutex{},
@@ -52,13 +58,28 @@ func (s *Server) Start() {
 }
 
 func (s *Server) StartListen() {
+	for _, carrier := range s.carriers {
+		if carrier.Name() == "ws" {
+			continue
+		}
+		go s.listenLoop(carrier, s.publicAddr)
+	}
+
+	// websocket is served over http on its own address, usually behind a reverse proxy
+	if wsListen := config.GetInstance().WsListen; wsListen != "" {
+		go s.listenLoop(carriers["ws"], wsListen)
+	}
+}
+
+func (s *Server) listenLoop(carrier Carrier, addr string) {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Error().Interface("err", err).
+			log.Error().Interface("err", err).Str("transport", carrier.Name()).
 				Msg("server listen panic")
 		}
 
-		log.Info().Str("addr", s.publicAddr).Msg("server listen exit, server closed")
+		log.Info().Str("addr", addr).Str("transport", carrier.Name()).
+			Msg("server listen exit, server closed")
 	}()
 	for {
 		// tcpAddr, err := net.ResolveTCPAddr("tcp", s.publicAddr)
@@ -67,9 +88,10 @@ func (s *Server) StartListen() {
 		// 	time.Sleep(time.Second * 5)
 		// 	continue
 		// }
-		err := s.listen()
+		err := s.listen(carrier, addr)
 		if err != nil {
-			log.Error().Err(err).Str("addr", s.publicAddr).Msg("server listen fail")
+			log.Error().Err(err).Str("addr", addr).Str("transport", carrier.Name()).
+				Msg("server listen fail")
 		}
 		time.Sleep(time.Second)
 	}
@@ -88,40 +110,53 @@ func (s *Server) StartListen() {
 // 	panic(err)
 // }
 
-func (s *Server) listen() error {
+func (s *Server) listen(carrier Carrier, addr string) error {
 	defer func() {
-		log.Info().Str("addr", s.publicAddr).Msg("server listener closed")
+		log.Info().Str("addr", addr).Str("transport", carrier.Name()).
+			Msg("server listener closed")
 	}()
 
 	// listener, err := net.ListenTCP("tcp", tcpAddr)
-	listener, err := quic.ListenAddr(s.publicAddr, s.generateTLSConfig(), nil)
+	listener, err := carrier.Listen(addr, s.tlsConf)
 	if err != nil {
-		return fmt.Errorf("Server::Listen::net listen tcp err: %s", err)
+		return fmt.Errorf("Server::Listen::%s listen err: %s", carrier.Name(), err)
 	}
 
 	defer listener.Close()
 	for {
-		sess, err := listener.Accept(context.Background())
+		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
 
-		log.Debug().Str("addr", s.publicAddr).Msg("server accept start accept stream")
-		stream, err := sess.AcceptStream(context.Background())
-		if nil != err {
-
-			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+		identity := ""
+		if s.auth != nil {
+			identity, err = s.auth.Identify(conn.PeerCertificates())
+			if err != nil {
+				log.Warn().Err(err).Str("from", conn.RemoteAddr().String()).Str("transport", carrier.Name()).
+					Msg("client is not authorized, connection closed")
+				conn.Close()
 				continue
 			}
-
-			log.Warn().Err(err).Str("addr", s.publicAddr).Msg("server accept fail")
-			continue
 		}
 
-		log.Info().Str("from", sess.RemoteAddr().Network()).Msg("server new accept")
+		log.Info().Str("from", conn.RemoteAddr().String()).Str("transport", carrier.Name()).
+			Str("identity", identity).Bool("datagram", conn.SupportsDatagrams()).Msg("server new accept")
 		// log.Info().Interface("from", stream).Msg("server new accept")
 
-		serverConn := NewServerConn(stream, sess, s.key, s.handler, config.GetInstance().NoDelay)
+		serverConn := NewServerConn(conn, s.key, s.handler, config.GetInstance().NoDelay)
+		serverConn.identity = identity
+		serverConn.suites = s.suites
+		serverConn.compression = s.compression
+		serverConn.plaintext = s.plaintext.Allow(conn.RemoteAddr())
+		serverConn.bonds = s.bonds
+		serverConn.packets = newSendQueue(s.queue)
+		serverConn.batch = newBatcher(s.batch)
+		serverConn.obfs = newObfuscator(s.obfs)
+		if s.maxFrame != 0 {
+			serverConn.maxFrame = s.maxFrame
+			serverConn.buf = newFrameBuf(s.maxFrame)
+		}
 		// s.ClientConns[sess.RemoteAddr().String()] = serverConn
 		// log.Info().Int("conn_size", len(s.Conns)).
 		// 	Int("reverse_size", len(s.ConnsReverse)).
@@ -129,37 +164,118 @@ func (s *Server) listen() error {
 		// 	Str("from", sess.RemoteAddr().String()).Msg("server start to read from connection")
 
 		//start to read pkt from connection
-		go serverConn.writeProcess()
-		go serverConn.readProcess(func() {
+		go serverConn.run(func() {
 			s.RemoveConnByConnPointer(serverConn)
 			// log.Warn().Str("from", serverConn.conn.RemoteAddr().String()).
 			// 	Interface("alive_conns", s.Conns).Msg("server read thread exit")
-			log.Warn().Str("from", sess.RemoteAddr().String()).Msg("server read thread exit")
+			log.Warn().Str("from", conn.RemoteAddr().String()).Msg("server read thread exit")
 		})
 	}
 }
 
-func (s *Server) generateTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
+// LoadCertificate has to be called before Start, see LoadServerTLSConfig
+func (s *Server) LoadCertificate(certFile, keyFile string) error {
+	tlsConf, err := LoadServerTLSConfig(certFile, keyFile)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	template := x509.Certificate{SerialNumber: big.NewInt(1)}
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	s.tlsConf = tlsConf
+	return nil
+}
+
+// EnableClientAuth requires every client to present a certificate signed by
+// the ca in clientCAFile, has to be called after LoadCertificate
+func (s *Server) EnableClientAuth(clientCAFile, aclFile, revokedFile string) error {
+	caPEM, err := os.ReadFile(clientCAFile)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("read client ca fail: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificate found in client ca %s", clientCAFile)
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
 
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	auth, err := LoadAuthorizer(aclFile, revokedFile)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   []string{"quic-echo-example"},
+
+	s.tlsConf.ClientCAs = pool
+	s.tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	s.auth = auth
+	return nil
+}
+
+// SetCipherSuites restricts the ciphers accepted from clients, all of them
+// are accepted by default
+func (s *Server) SetCipherSuites(suites []*CipherSuite) {
+	s.suites = suites
+}
+
+// SetPlaintextPolicy decides which clients may run unencrypted sessions,
+// none by default
+func (s *Server) SetPlaintextPolicy(policy *PlaintextPolicy) {
+	s.plaintext = policy
+}
+
+// SetQueuePolicy bounds the packets waiting for each connection, has to be
+// called before Start
+func (s *Server) SetQueuePolicy(policy *QueuePolicy) {
+	s.queue = policy
+}
+
+// SetBatchPolicy bounds the packets coalesced into one frame, has to be
+// called before Start
+func (s *Server) SetBatchPolicy(policy *BatchPolicy) {
+	s.batch = policy
+}
+
+// SetCompression sets the compression accepted from clients, none by default
+func (s *Server) SetCompression(compression []string) {
+	s.compression = compression
+}
+
+// SetObfsPolicy pads the frames and sends cover traffic, has to be called
+// before Start
+func (s *Server) SetObfsPolicy(policy *ObfsPolicy) {
+	s.obfs = policy
+}
+
+// SetMaxFrame sets the largest frame accepted from clients, see
+// CheckMaxFrame, has to be called before Start
+func (s *Server) SetMaxFrame(maxFrame int) {
+	s.maxFrame = maxFrame
+}
+
+// SetALPN sets the application protocols accepted from clients, has to be
+// called after LoadCertificate
+func (s *Server) SetALPN(protos []string) {
+	s.tlsConf.NextProtos = protos
+}
+
+// AllowIP tells if the client behind conn may claim the tunnel ip
+func (s *Server) AllowIP(conn *ServerConn, ip string) bool {
+	if s.auth == nil {
+		return true
+	}
+	return s.auth.AllowIP(conn.Identity(), net.ParseIP(ip))
+}
+
+// Prefixes returns the cidrs the client behind conn may claim, ok is false
+// when it may claim any ip
+func (s *Server) Prefixes(conn *ServerConn) ([]*net.IPNet, bool) {
+	if s.auth == nil {
+		return nil, false
 	}
+	return s.auth.Prefixes(conn.Identity())
+}
+
+// AllowPrefix tells if the client behind conn may advertise the subnet
+func (s *Server) AllowPrefix(conn *ServerConn, prefix *net.IPNet) bool {
+	if s.auth == nil {
+		return true
+	}
+	return s.auth.AllowPrefix(conn.Identity(), prefix)
 }
 
 func (s *Server) GetConnsByAddr(dst string) *ServerConn {
@@ -188,25 +304,33 @@ func (s *Server) DeleteDeadConn(dst string) {
 		Int("reverse_size", len(s.ConnsReverse)).Msg("delete dead conn")
 }
 
-func (s *Server) SetConns(dst string, serverConn *ServerConn) {
+// SetConns registers serverConn under the key dst it announces in its ping,
+// it fails when serverConn has another key, or dst belongs to another
+// connection which is still alive, the one of a dead connection is taken over
+func (s *Server) SetConns(dst string, serverConn *ServerConn) bool {
 	s.Mtx.Lock()
 	defer s.Mtx.Unlock()
-	if v, ok := s.Conns[dst]; !ok {
-		if serverConn == nil {
-			return
+	if serverConn == nil {
+		return false
+	}
+	if key, ok := s.ConnsReverse[serverConn]; ok && key != dst {
+		// one key per connection, it can't hold the ones of other clients
+		return false
+	}
+	if v, ok := s.Conns[dst]; ok && v != serverConn {
+		if v.conn != nil && !v.IsClosed() {
+			return false
 		}
-
-		// serverConn := NewServerConn(conn, s.key, s.handler, config.GetInstance().NoDelay)
-		//Urgly 应该保证连接只run一下，只为了writebuf里面的内容可以正确的被处理，现在run了两次, 应该把读和写都统一在一个对象里管理
-		// go serverConn.ProcessWrite()
-		s.Conns[dst] = serverConn
-		s.ConnsReverse[serverConn] = dst
-	} else {
 		if v.conn == nil {
 			v.Stop()
-			delete(s.Conns, dst)
 		}
+		delete(s.ConnsReverse, v)
 	}
+
+	//Urgly 应该保证连接只run一下，只为了writebuf里面的内容可以正确的被处理，现在run了两次, 应该把读和写都统一在一个对象里管理
+	s.Conns[dst] = serverConn
+	s.ConnsReverse[serverConn] = dst
+	return true
 }
 
 func (s *Server) RemoveConnByConnPointer(conn *ServerConn) {
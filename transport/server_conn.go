@@ -3,56 +3,102 @@ package transport
 import (
 	"bufio"
 	"bytes"
-	"crypto/cipher"
-	crand "crypto/rand"
-	"encoding/binary"
 	"fmt"
-	"io"
+	"sync/atomic"
+	"time"
 
 	// "log"
 
-	"github.com/golang/protobuf/proto"
-	"github.com/lucas-clemente/quic-go"
 	"github.com/matthewgao/qtun/iface"
-	"github.com/matthewgao/qtun/protocol"
-	"github.com/matthewgao/qtun/utils"
 	"github.com/rs/zerolog/log"
 )
 
 var ErrCiperNotMatch = fmt.Errorf("fail to match key")
 
 type ServerConn struct {
-	conn      quic.Stream
-	sess      quic.Connection
+	conn      Conn
 	key       string
 	buf       []byte
-	aesgcm    cipher.AEAD
+	dgramBuf  []byte
+	datagram  bool
+	sendKey   *sendKey
+	recvKey   *recvKey
 	handler   GrpcHandler
 	reader    *bufio.Reader
 	writeBuf  *bytes.Buffer
+	frame     []byte
 	chanWrite chan []byte
+	packets   *sendQueue
+	batch     *batcher
+	obfs      *obfuscator
 	chanClose chan bool
 	isClosed  bool
-	noDelay   bool
+	identity  string
+	suites    []*CipherSuite
+	// accepted in the handshake, compress is 1 when the client offered it.
+	// maxFrame is the largest frame accepted from the client, peerMax the
+	// largest accepted by the client
+	compression []string
+	compress    int32
+	maxFrame    int
+	peerMax     int
+	plaintext   bool
+	bonds       *bondTable
+	bond        *bondGroup
+	path        *pathStats
+	chanProbe   chan int64
+	noDelay     bool
 }
 
-func NewServerConn(conn quic.Stream, sess quic.Connection, key string, handler GrpcHandler, noDelay bool) *ServerConn {
+func NewServerConn(conn Conn, key string, handler GrpcHandler, noDelay bool) *ServerConn {
 	return &ServerConn{
 		conn:      conn,
-		sess:      sess,
 		key:       key,
 		handler:   handler,
-		buf:       make([]byte, 65536),
+		buf:       newFrameBuf(defaultMaxFrame),
+		dgramBuf:  make([]byte, 65536),
+		datagram:  conn.SupportsDatagrams(),
 		writeBuf:  &bytes.Buffer{},
+		frame:     make([]byte, frameHeaderSize, packetBufSize),
 		chanWrite: make(chan []byte, 2),
+		packets:   newSendQueue(nil),
+		batch:     newBatcher(nil),
 		chanClose: make(chan bool, 1),
+		path:      &pathStats{},
+		chanProbe: make(chan int64, 1),
 		noDelay:   noDelay,
+		maxFrame:  defaultMaxFrame,
+		peerMax:   defaultMaxFrame,
 	}
 }
 
 func (this *ServerConn) Stop() {
 	this.chanClose <- true
 	close(this.chanWrite)
+	this.packets.close()
+}
+
+// run does the handshake first, nothing else is read or written before the
+// session keys are ready
+func (sc *ServerConn) run(cleanup func()) {
+	sc.reader = bufio.NewReaderSize(sc.conn, 1024*4)
+	err := sc.handshake()
+	if err != nil {
+		log.Error().Err(err).Str("from", sc.conn.RemoteAddr().String()).
+			Msg("ServerConn::run handshake fail, closed")
+		if sc.bond != nil {
+			sc.bonds.leave(sc.bond.session, sc)
+		}
+		sc.conn.Close()
+		sc.isClosed = true
+		return
+	}
+
+	go sc.writeProcess()
+	if sc.datagram {
+		go sc.datagramProcess()
+	}
+	sc.readProcess(cleanup)
 }
 
 func (sc *ServerConn) readProcess(cleanup func()) {
@@ -64,18 +110,15 @@ func (sc *ServerConn) readProcess(cleanup func()) {
 
 		log.Warn().Msg("ServerConn::conn run, exit")
 		cleanup()
+		if sc.bond != nil {
+			sc.bonds.leave(sc.bond.session, sc)
+		}
 
 		sc.conn.Close()
-		// sc.sess.Close()
-		sc.sess.CloseWithError(0x1, "fail to write")
 		sc.isClosed = true
 		sc.Stop()
 		log.Warn().Msg("ServerConn::conn run, exit1")
 	}()
-	var err error
-	err = sc.crypto()
-	utils.POE(err)
-
 	// sc.conn.SetReadBuffer(1024 * 1024)
 	// sc.conn.SetWriteBuffer(1024 * 1024)
 	// sc.conn.
@@ -85,15 +128,20 @@ func (sc *ServerConn) readProcess(cleanup func()) {
 	// sc.conn.SetDeadline(time.Second * 30)
 	//
 	//FIXME:seems like the bufio buf is not release even if readProcess has fully exit
-	reader := bufio.NewReaderSize(sc.conn, 1024*4)
 	for {
 		// sc.conn.SetReadDeadline(time.Now().Add(time.Second * 10))
-		data, err := sc.read(reader)
+		data, err := sc.read(sc.reader)
 		//FIXME: if it's EOF then need to exit, if it's not should continue
 		// if err == io.EOF || err == io.ErrUnexpectedEOF {
 		// 	log.Error().Err(err).Msg("ServerConn::run conn read fail, it's closed by client")
 		// }
 
+		if err == ErrReplay {
+			// the frame is consumed, the stream is still in sync
+			log.Warn().Err(err).Msg("ServerConn::run drop frame")
+			continue
+		}
+
 		if err == ErrCiperNotMatch {
 			// log.Error().Err(err).Str("from", sc.conn.RemoteAddr().String()).Msg("fail to match key, break")
 			log.Error().Err(err).Msg("fail to match key, break")
@@ -105,111 +153,177 @@ func (sc *ServerConn) readProcess(cleanup func()) {
 			break
 		}
 
+		if ok, err := sc.recvKey.handleRekey(data); ok {
+			if err != nil {
+				log.Error().Err(err).Msg("ServerConn::run rekey fail, break")
+				break
+			}
+			continue
+		}
+
+		if ok, err := sc.path.handleProbe(data, sc.chanProbe); ok {
+			if err != nil {
+				log.Warn().Err(err).Msg("ServerConn::run bad probe, drop")
+			}
+			continue
+		}
+
 		if sc.handler != nil {
-			sc.handler.ServerOnData(data, sc)
+			sc.deliver(data)
 		} else {
 			log.Warn().Msg("ServerConn::run sever_conn is nil")
 		}
 	}
 }
 
-func (sc *ServerConn) crypto() error {
-	if sc.key == "" {
-		// log.Warn().Str("client_addr", sc.conn.RemoteAddr().String()).
-		// 	Msg("incoming encryption disabled")
-		log.Warn().Msg("incoming encryption disabled")
+func (sc *ServerConn) handshake() error {
+	timer := time.AfterFunc(handshakeTimeout, func() { sc.conn.Close() })
+	defer timer.Stop()
+	offer := &handshakeOffer{
+		suites:      sc.suites,
+		compression: sc.compression,
+		maxFrame:    sc.maxFrame,
+	}
+	if sc.bonds != nil {
+		// joined once the client is authenticated, before the answer, which
+		// carries the epoch of the session
+		offer.join = func(session []byte) uint64 {
+			sc.bond = sc.bonds.join(session, sc)
+			return sc.bond.epoch
+		}
+	}
+	result, err := serverHandshake(sc.conn, sc.reader, sc.key, offer, sc.plaintext, sc.writeBuf, sc.buf)
+	if err != nil {
+		return err
+	}
+	keys, compression := result.keys, result.compression
+	sc.peerMax = result.maxFrame
+	sc.batch.setLimit(result.maxFrame)
+	if compression != "" {
+		atomic.StoreInt32(&sc.compress, 1)
+		log.Info().Str("from", sc.conn.RemoteAddr().String()).Str("identity", sc.identity).
+			Str("compression", compression).Msg("compression enabled")
+	}
+	if sc.bond != nil {
+		log.Info().Str("from", sc.conn.RemoteAddr().String()).Str("identity", sc.identity).
+			Hex("session", sc.bond.session).Uint64("epoch", sc.bond.epoch).Msg("join bonded session")
+	}
+	if keys == nil {
+		log.Warn().Str("from", sc.conn.RemoteAddr().String()).Str("identity", sc.identity).
+			Msg("incoming encryption disabled")
 		return nil
 	}
-	var err error
-	sc.aesgcm, err = makeAES128GCM(sc.key)
-	return err
+	sc.sendKey, sc.recvKey = keys.send, keys.recv
+	return nil
 }
 
 func (sc *ServerConn) read(reader *bufio.Reader) ([]byte, error) {
-	var err error
-	var secure uint8 = 0
+	return decodeFrame(reader, sc.recvKey, sc.buf)
+}
 
-	// reader := sc.reader
-	err = binary.Read(reader, binary.LittleEndian, &secure)
-	if err != nil {
-		return nil, err
-	}
-	var dataLen uint16
-	err = binary.Read(reader, binary.LittleEndian, &dataLen)
-	if err != nil {
-		return nil, err
+// write sends a control message, it's copied behind the frame headroom
+func (cc *ServerConn) write(data []byte) error {
+	cc.frame = append(cc.frame[:frameHeaderSize], data...)
+	return cc.writeFrame(cc.frame)
+}
+
+// writeFrame seals buf, the frame headroom followed by the payload, in place
+// and writes it to the stream
+func (cc *ServerConn) writeFrame(buf []byte) error {
+	if cc.conn == nil {
+		return fmt.Errorf("no connection")
 	}
-	_, err = io.ReadFull(reader, sc.buf[:dataLen])
+	err := writeRekey(cc.conn, cc.writeBuf, cc.sendKey)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if secure == 0 {
-		return sc.buf[:dataLen], err
-	} else {
-		nonce := make([]byte, sc.aesgcm.NonceSize())
-		_, err = io.ReadFull(reader, nonce)
-		if err != nil {
-			return nil, err
-		}
-		plain, err := sc.aesgcm.Open(nil, nonce, sc.buf[:dataLen], nil)
-		if err != nil {
-			// return nil, err
-			return nil, ErrCiperNotMatch
-		}
-		return plain, nil
+	frame, ok := sealLimited(buf, cc.sendKey, cc.obfs.pad(), cc.peerMax)
+	if !ok {
+		log.Debug().Int("len", len(buf)).Msg("ServerConn::writeFrame frame is too large for the client, drop")
+		return nil
 	}
+	_, err = cc.conn.Write(frame)
+	return err
 }
 
-func (cc *ServerConn) write(data []byte) error {
+func (cc *ServerConn) writeDatagram(buf []byte) error {
 	if cc.conn == nil {
 		return fmt.Errorf("no connection")
 	}
-	var err error
-	cc.writeBuf.Reset()
-	var secure uint8 = 0
-	if cc.aesgcm != nil {
-		secure = 1
-	}
-	err = binary.Write(cc.writeBuf, binary.LittleEndian, &secure)
+	err := writeRekey(cc.conn, cc.writeBuf, cc.sendKey)
 	if err != nil {
 		return err
 	}
-	if secure == 0 {
-		dataLen := uint16(len(data))
-		err = binary.Write(cc.writeBuf, binary.LittleEndian, &dataLen)
-		if err != nil {
-			return err
+	frame, ok := sealLimited(buf, cc.sendKey, cc.obfs.pad(), cc.peerMax)
+	if !ok {
+		log.Debug().Int("len", len(buf)).Msg("ServerConn::writeDatagram frame is too large for the client, drop")
+		return nil
+	}
+	if len(frame) <= maxDatagramSize {
+		err = cc.conn.SendDatagram(frame)
+		if err == nil {
+			return nil
 		}
-		_, err = cc.writeBuf.Write(data)
-		if err != nil {
-			return err
+		log.Debug().Err(err).Int("len", len(frame)).
+			Msg("ServerConn::writeDatagram send datagram fail, fallback to stream")
+	}
+	// packet doesn't fit into a datagram frame, fallback to the stream
+	stats.Add(statDatagramFallback, 1)
+	_, err = cc.conn.Write(frame)
+	return err
+}
+
+func (sc *ServerConn) datagramProcess() {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error().Interface("err", err).
+				Msg("ServerConn::datagramProcess painc")
 		}
-	} else {
-		nonce := make([]byte, cc.aesgcm.NonceSize())
-		_, err = io.ReadFull(crand.Reader, nonce)
+	}()
+
+	for {
+		msg, err := sc.conn.ReceiveDatagram()
 		if err != nil {
-			return err
+			log.Warn().Err(err).Msg("ServerConn::datagramProcess receive fail, exit")
+			return
 		}
-		data2 := cc.aesgcm.Seal(nil, nonce, data, nil)
-		dataLen := uint16(len(data2))
-		err = binary.Write(cc.writeBuf, binary.LittleEndian, &dataLen)
+
+		data, err := decodeFrame(bytes.NewReader(msg), sc.recvKey, sc.dgramBuf)
 		if err != nil {
-			return err
+			// a broken datagram only loses one packet, keep the connection
+			log.Error().Err(err).Msg("ServerConn::datagramProcess decode fail, drop")
+			continue
 		}
-		_, err = cc.writeBuf.Write(data2)
-		if err != nil {
-			return err
+
+		if sc.handler != nil {
+			sc.deliver(data)
 		}
-		_, err = cc.writeBuf.Write(nonce)
+	}
+}
+
+// deliver hands data to the handler, the packets of a bonded session are
+// put back in order first
+func (sc *ServerConn) deliver(data []byte) {
+	if dropCover(data) {
+		return
+	}
+	if unbatch(data, sc.deliver) {
+		return
+	}
+	if ok, err := inflatePacket(data, sc.deliver); ok {
 		if err != nil {
-			return err
+			log.Warn().Err(err).Msg("ServerConn::deliver bad compressed packet, drop")
 		}
+		return
 	}
-	if err == nil {
-		_, err = cc.writeBuf.WriteTo(cc.conn)
+	seq := packetSeq(data)
+	if sc.bond == nil || seq == 0 {
+		sc.handler.ServerOnData(data, sc)
+		return
 	}
-
-	return err
+	sc.bond.reorder.push(seq, data, func(data []byte) {
+		sc.handler.ServerOnData(data, sc)
+	})
 }
 
 func (cc *ServerConn) Write(data []byte) {
@@ -225,14 +339,42 @@ func (cc *ServerConn) Write(data []byte) {
 	cc.chanWrite <- data
 }
 
+// SendPacket sends a copy of pkt to the client
 func (sc *ServerConn) SendPacket(pkt iface.PacketIP) {
-	data, _ := proto.Marshal(&protocol.Envelope{
-		Type: &protocol.Envelope_Packet{
-			Packet: &protocol.MessagePacket{Payload: pkt},
-		},
-	})
+	sc.SendTunPacket(CopyPacket(pkt))
+}
+
+// SendTunPacket sends a packet the tun was read into, it takes pkt over
+func (sc *ServerConn) SendTunPacket(pkt Packet) {
+	if sc.bond != nil {
+		sc.sendBonded(pkt)
+		return
+	}
+
+	sc.WritePacket(pkt.frame(0))
+}
+
+// sendBonded numbers the packet and sends it over the connection of the
+// session picked by the scheduler, whichever one the route points to
+func (sc *ServerConn) sendBonded(pkt Packet) {
+	data := sc.bond.marshalPacket(pkt)
+	conn := sc.bonds.pick(sc.bond)
+	if conn == nil {
+		sc.WritePacket(data)
+		return
+	}
+	conn.WritePacket(data)
+}
 
-	sc.Write(data)
+// packets go into datagrams when the peer supports them, otherwise they
+// share the stream with the control messages. WritePacket never blocks, the
+// packet is dropped when the queue is full or the connection is gone. data
+// is a buffer of newPacketBuf, the connection owns it from now on
+func (cc *ServerConn) WritePacket(data []byte) {
+	if atomic.LoadInt32(&cc.compress) == 1 {
+		data = compressPacket(data)
+	}
+	cc.packets.push(data)
 }
 
 func (cc *ServerConn) writeProcess() (err error) {
@@ -242,8 +384,6 @@ func (cc *ServerConn) writeProcess() (err error) {
 		}
 
 		cc.conn.Close()
-		// cc.sess.Close()
-		cc.sess.CloseWithError(0x1, "fail to read")
 		cc.isClosed = true
 		// log.Warn().Str("client_addr", cc.conn.RemoteAddr().String()).
 		// 	Msg("ServerConn::ProcessWrite conn closedd")
@@ -253,10 +393,46 @@ func (cc *ServerConn) writeProcess() (err error) {
 	// log.Info().Str("client_addr", cc.conn.RemoteAddr().String()).Msg("ServerConn::ProcessWrite Start")
 	log.Info().Msg("ServerConn::ProcessWrite Start")
 
+	var probeTick <-chan time.Time
+	if cc.bond != nil {
+		probeTicker := time.NewTicker(probeInterval)
+		defer probeTicker.Stop()
+		probeTick = probeTicker.C
+	}
+	var coverTick <-chan time.Time
+	coverTimer := cc.obfs.coverTimer()
+	if coverTimer != nil {
+		defer coverTimer.Stop()
+		coverTick = coverTimer.C
+	}
 	for {
 		select {
+		case now := <-probeTick:
+			err = cc.write(marshalProbe(cc.path.probe(now), false))
+		case timestamp := <-cc.chanProbe:
+			err = cc.write(marshalProbe(timestamp, true))
+		case <-coverTick:
+			err = cc.write(cc.obfs.cover())
+			coverTimer.Reset(cc.obfs.nextCover())
 		case buf := <-cc.chanWrite:
 			err = cc.write(buf)
+		case buf, ok := <-cc.packets.ch:
+			if !ok {
+				return err
+			}
+			cc.packets.taken()
+			if cc.datagram {
+				err = cc.writeDatagram(buf)
+				freePacketBuf(buf)
+			} else {
+				// a packet left over from a full batch starts the next one
+				for buf != nil && err == nil {
+					var frame []byte
+					frame, buf = cc.batch.collect(buf, cc.packets)
+					err = cc.writeFrame(frame)
+					cc.batch.release()
+				}
+			}
 		case stop := <-cc.chanClose:
 			if stop {
 				log.Info().Err(err).
@@ -276,6 +452,17 @@ func (cc *ServerConn) writeProcess() (err error) {
 	// return err
 }
 
+// Identity is the common name of the client certificate, empty when the
+// server doesn't ask for client certificates
+func (this *ServerConn) Identity() string {
+	return this.identity
+}
+
+// Close shuts the connection down, the read process exits and cleans it up
+func (this *ServerConn) Close() {
+	this.conn.Close()
+}
+
 func (this *ServerConn) IsClosed() bool {
 	return this.isClosed
 }
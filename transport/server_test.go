@@ -0,0 +1,41 @@
+package transport
+
+import (
+	"testing"
+)
+
+func TestServer_SetConns(t *testing.T) {
+	s := NewServer("", nil, "", nil)
+	victim := &ServerConn{conn: &tcpConn{}}
+	attacker := &ServerConn{conn: &tcpConn{}}
+
+	if !s.SetConns("10.4.4.3/24:1000", victim) {
+		t.Fatalf("bad: SetConns fail")
+	}
+	if !s.SetConns("10.4.4.3/24:1000", victim) {
+		t.Fatalf("bad: key of the same connection refused")
+	}
+	if s.SetConns("10.4.4.3/24:1000", attacker) {
+		t.Fatalf("bad: key of a live connection taken")
+	}
+	if s.GetConnsByAddr("10.4.4.3/24:1000") != victim {
+		t.Fatalf("bad: key routed to another connection")
+	}
+
+	if !s.SetConns("10.4.4.4/24:1000", attacker) {
+		t.Fatalf("bad: SetConns fail")
+	}
+	if s.SetConns("10.4.4.4/24:1001", attacker) {
+		t.Fatalf("bad: second key registered on a connection")
+	}
+
+	// the key of a closed connection goes to its successor
+	victim.isClosed = true
+	successor := &ServerConn{conn: &tcpConn{}}
+	if !s.SetConns("10.4.4.3/24:1000", successor) {
+		t.Fatalf("bad: key of a closed connection kept")
+	}
+	if _, ok := s.ConnsReverse[victim]; ok {
+		t.Fatalf("bad: closed connection still registered")
+	}
+}
@@ -0,0 +1,36 @@
+package transport
+
+import "expvar"
+
+// stats are published by expvar on /debug/vars of the localhost:6060 debug
+// server, next to statsviz
+var stats = expvar.NewMap("transport")
+
+const (
+	statReplayed    = "replayed_frames"
+	statOutOfWindow = "out_of_window_frames"
+	statPlaintext   = "plaintext_frames"
+
+	statReorderLate    = "reorder_late_packets"
+	statReorderSkipped = "reorder_skipped_packets"
+
+	statQueueDepth   = "send_queue_depth"
+	statQueueDropped = "send_queue_dropped_packets"
+
+	statControlDropped = "control_dropped_messages"
+
+	statBatchFrames  = "batch_frames"
+	statBatchPackets = "batched_packets"
+	statBatchNested  = "nested_batch_dropped_frames"
+
+	statCompressIn      = "compress_in_bytes"
+	statCompressOut     = "compress_out_bytes"
+	statCompressSkipped = "compress_skipped_packets"
+	statCompressRatio   = "compress_ratio"
+
+	statCoverFrames = "cover_frames"
+
+	statOversize = "oversize_dropped_frames"
+
+	statDatagramFallback = "datagram_fallback_packets"
+)
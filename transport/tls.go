@@ -0,0 +1,244 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LoadServerTLSConfig loads the server certificate from disk, when neither
+// file exists a self-signed one is generated and persisted, so the
+// fingerprint pinned by the clients stays the same across restarts
+func LoadServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		log.Warn().Str("cert", certFile).Str("key", keyFile).
+			Msg("server certificate not found, generate a self-signed one")
+		err := generateCertificate(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("generate server certificate fail: %s", err)
+		}
+	}
+
+	tlsCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate %s, %s fail: %s", certFile, keyFile, err)
+	}
+
+	log.Info().Str("cert", certFile).Str("fingerprint", CertFingerprint(tlsCert.Certificate[0])).
+		Msg("server certificate loaded, clients can pin it with --pin")
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		NextProtos:   []string{alpn},
+	}, nil
+}
+
+func generateCertificate(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "qtun"},
+		DNSNames:              []string{"qtun"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+}
+
+// CertFingerprint is the sha256 of the DER encoded certificate, which is
+// the format accepted by --pin
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func parseFingerprint(pin string) ([]byte, error) {
+	pin = strings.ToLower(strings.TrimSpace(pin))
+	pin = strings.TrimPrefix(pin, "sha256:")
+	pin = strings.ReplaceAll(pin, ":", "")
+	fp, err := hex.DecodeString(pin)
+	if err != nil || len(fp) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q, expect a hex encoded sha256 fingerprint", pin)
+	}
+	return fp, nil
+}
+
+// ClientTLS verifies the server certificate either against a pinned sha256
+// fingerprint or against a ca bundle, the system roots are used when neither
+// is configured
+type ClientTLS struct {
+	roots        *x509.CertPool
+	pin          []byte
+	serverName   string
+	sni          string
+	alpn         []string
+	certificates []tls.Certificate
+}
+
+func NewClientTLS(caFile, pin, serverName string) (*ClientTLS, error) {
+	c := &ClientTLS{serverName: serverName}
+
+	if pin != "" {
+		fp, err := parseFingerprint(pin)
+		if err != nil {
+			return nil, err
+		}
+		c.pin = fp
+	}
+
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca bundle fail: %s", err)
+		}
+		c.roots = x509.NewCertPool()
+		if !c.roots.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificate found in ca bundle %s", caFile)
+		}
+	}
+	return c, nil
+}
+
+// LoadCertificate loads the client certificate presented to servers which
+// run with --client_ca
+func (c *ClientTLS) LoadCertificate(certFile, keyFile string) error {
+	tlsCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load client certificate %s, %s fail: %s", certFile, keyFile, err)
+	}
+	c.certificates = []tls.Certificate{tlsCert}
+	return nil
+}
+
+// SetALPN sets the application protocols offered to the server, e.g. h3 to
+// look like a browser
+func (c *ClientTLS) SetALPN(protos []string) {
+	c.alpn = protos
+}
+
+// SetSNI sends sni in the client hello instead of the server name, the
+// certificate is still verified against the server name
+func (c *ClientTLS) SetSNI(sni string) {
+	c.sni = sni
+}
+
+// Config returns the tls config used to dial remoteAddr, the verification
+// is done by ourselves to give a clear error when it fails
+func (c *ClientTLS) Config(remoteAddr string) *tls.Config {
+	serverName := c.serverName
+	if serverName == "" {
+		serverName = hostOf(remoteAddr)
+	}
+	sni := c.sni
+	if sni == "" {
+		sni = serverName
+	}
+	protos := c.alpn
+	if len(protos) == 0 {
+		protos = []string{alpn}
+	}
+
+	return &tls.Config{
+		ServerName:         sni,
+		NextProtos:         protos,
+		Certificates:       c.certificates,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return c.verify(serverName, rawCerts)
+		},
+	}
+}
+
+func (c *ClientTLS) verify(serverName string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("server sent no certificate")
+	}
+	fingerprint := CertFingerprint(rawCerts[0])
+
+	if c.pin != nil {
+		sum := sha256.Sum256(rawCerts[0])
+		if subtle.ConstantTimeCompare(sum[:], c.pin) != 1 {
+			return fmt.Errorf("server certificate fingerprint mismatch, got %s, expect sha256:%s",
+				fingerprint, hex.EncodeToString(c.pin))
+		}
+		return nil
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("parse server certificate fail: %s", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         c.roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	if err != nil {
+		return fmt.Errorf("verify server certificate for %q fail: %s, set --ca, or --pin %s if the server uses a self-signed certificate",
+			serverName, err, fingerprint)
+	}
+	return nil
+}
+
+// hostOf strips the scheme, path and port from a remote address
+func hostOf(addr string) string {
+	if u, err := url.Parse(addr); err == nil && u.Host != "" {
+		addr = u.Host
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
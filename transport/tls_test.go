@@ -0,0 +1,67 @@
+package transport
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClientTLS_Verify(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+
+	serverConf, err := LoadServerTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	raw := serverConf.Certificates[0].Certificate
+	fingerprint := CertFingerprint(raw[0])
+
+	// loading again must reuse the persisted certificate
+	again, err := LoadServerTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if CertFingerprint(again.Certificates[0].Certificate[0]) != fingerprint {
+		t.Fatalf("certificate regenerated")
+	}
+
+	pinned, err := NewClientTLS("", strings.ToUpper(fingerprint[len("sha256:"):]), "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := pinned.verify("1.2.3.4", raw); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	wrong, _ := NewClientTLS("", "sha256:"+strings.Repeat("ab", 32), "")
+	if err := wrong.verify("1.2.3.4", raw); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	ca, err := NewClientTLS(certFile, "", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ca.verify("qtun", raw); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ca.verify("example.com", raw); err == nil || !strings.Contains(err.Error(), fingerprint) {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestHostOf(t *testing.T) {
+	cases := map[string]string{
+		"8.8.8.8:8080":             "8.8.8.8",
+		"example.com:443":          "example.com",
+		"wss://example.com/tunnel": "example.com",
+		"[::1]:8080":               "::1",
+	}
+	for addr, expect := range cases {
+		if host := hostOf(addr); host != expect {
+			t.Fatalf("bad: %s -> %s", addr, host)
+		}
+	}
+}